@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/newt/websocket"
+)
+
+// Error codes reported in olm/ack messages
+const (
+	AckInvalidMessage   = "invalid_message"
+	AckAlreadyConnected = "already_connected"
+	AckNotReady         = "not_ready"
+	AckNotFound         = "not_found"
+	AckConflict         = "conflict"
+	AckInvalidConfig    = "invalid_config"
+	AckResolveFailed    = "resolve_failed"
+	AckTunnelFailed     = "tunnel_failed"
+	AckWireGuardFailed  = "wireguard_failed"
+	AckRouteFailed      = "route_failed"
+	AckMonitorFailed    = "monitor_failed"
+	AckPartial          = "partial"
+	AckInternal         = "internal_error"
+)
+
+// ackError is an error carrying the code it is reported with in olm/ack
+type ackError struct {
+	code string
+	err  error
+}
+
+func (e *ackError) Error() string {
+	return e.err.Error()
+}
+
+func (e *ackError) Unwrap() error {
+	return e.err
+}
+
+// ackErrorf formats an error with an olm/ack error code
+func ackErrorf(code string, format string, args ...interface{}) error {
+	return &ackError{code: code, err: fmt.Errorf(format, args...)}
+}
+
+// ackCode returns the olm/ack code of an error
+func ackCode(err error) string {
+	var coded *ackError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+	return AckInternal
+}
+
+// AckResult is the outcome of one step of applying a control message
+type AckResult struct {
+	SiteID     int    `json:"siteId,omitempty"`
+	Step       string `json:"step"`
+	Success    bool   `json:"success"`
+	Error      string `json:"error,omitempty"`
+	RolledBack bool   `json:"rolledBack,omitempty"` // The step succeeded but was undone after a later step failed
+}
+
+// messageSender sends messages to Pangolin, the websocket client outside of tests
+type messageSender interface {
+	SendMessage(messageType string, data interface{}) error
+}
+
+// ack collects the outcome of a control message and reports it to Pangolin
+// as olm/ack. Messages without a requestId are not acknowledged.
+type ack struct {
+	olm       messageSender
+	msgType   string
+	requestID string
+	enabled   bool // Cleared when the server turned acks off
+	err       error
+	results   []AckResult
+}
+
+func newAck(olm messageSender, msg websocket.WSMessage) *ack {
+	a := &ack{olm: olm, msgType: msg.Type, enabled: true}
+	if data, ok := msg.Data.(map[string]interface{}); ok {
+		if requestID, ok := data["requestId"].(string); ok {
+			a.requestID = requestID
+		}
+	}
+	return a
+}
+
+// fail records the error of the message, keeping the first one
+func (a *ack) fail(err error) {
+	if a.err == nil {
+		a.err = err
+	}
+}
+
+// add records the results of steps taken for the message
+func (a *ack) add(results ...AckResult) {
+	a.results = append(a.results, results...)
+}
+
+// send reports the outcome to Pangolin
+func (a *ack) send() {
+	if !a.enabled || a.requestID == "" || a.olm == nil {
+		return
+	}
+
+	data := map[string]interface{}{
+		"requestId": a.requestID,
+		"type":      a.msgType,
+		"success":   a.err == nil,
+	}
+	if a.err != nil {
+		data["code"] = ackCode(a.err)
+		data["error"] = a.err.Error()
+	}
+	if len(a.results) > 0 {
+		data["results"] = a.results
+	}
+
+	if err := a.olm.SendMessage("olm/ack", data); err != nil {
+		logger.Error("Failed to send ack for %s request %s: %v", a.msgType, a.requestID, err)
+	}
+}
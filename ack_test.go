@@ -0,0 +1,202 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/fosrl/newt/websocket"
+)
+
+// fakeSender records the messages sent to Pangolin
+type fakeSender struct {
+	sent []sentMessage
+	err  error
+}
+
+type sentMessage struct {
+	msgType string
+	data    interface{}
+}
+
+func (f *fakeSender) SendMessage(messageType string, data interface{}) error {
+	f.sent = append(f.sent, sentMessage{msgType: messageType, data: data})
+	return f.err
+}
+
+// acks returns the olm/ack payloads sent, as Pangolin receives them
+func (f *fakeSender) acks(t *testing.T) []map[string]interface{} {
+	t.Helper()
+
+	var acks []map[string]interface{}
+	for _, msg := range f.sent {
+		if msg.msgType != "olm/ack" {
+			t.Errorf("sent %s, want only olm/ack", msg.msgType)
+			continue
+		}
+		b, err := json.Marshal(msg.data)
+		if err != nil {
+			t.Fatalf("failed to marshal ack: %v", err)
+		}
+		var payload map[string]interface{}
+		if err := json.Unmarshal(b, &payload); err != nil {
+			t.Fatalf("failed to unmarshal ack: %v", err)
+		}
+		acks = append(acks, payload)
+	}
+	return acks
+}
+
+// testMessage returns a message of msgType with the given request ID, if any
+func testMessage(msgType string, requestID string) websocket.WSMessage {
+	data := map[string]interface{}{"siteId": 1}
+	if requestID != "" {
+		data["requestId"] = requestID
+	}
+	return websocket.WSMessage{Type: msgType, Data: data}
+}
+
+func TestAckCode(t *testing.T) {
+	tests := map[string]struct {
+		err  error
+		want string
+	}{
+		"coded":         {ackErrorf(AckNotFound, "peer %d not found", 1), AckNotFound},
+		"wrapped":       {fmt.Errorf("remove peer: %w", ackErrorf(AckRouteFailed, "no route")), AckRouteFailed},
+		"plain":         {errors.New("something broke"), AckInternal},
+		"wrapped plain": {fmt.Errorf("remove peer: %w", errors.New("something broke")), AckInternal},
+	}
+	for name, tt := range tests {
+		if got := ackCode(tt.err); got != tt.want {
+			t.Errorf("%s: ackCode = %q, want %q", name, got, tt.want)
+		}
+	}
+
+	err := ackErrorf(AckConflict, "peer with site ID %d already exists", 3)
+	if err.Error() != "peer with site ID 3 already exists" {
+		t.Errorf("error message = %q", err.Error())
+	}
+}
+
+func TestAckSendSuccess(t *testing.T) {
+	sender := &fakeSender{}
+	a := newAck(sender, testMessage("olm/wg/peer/add", "req-1"))
+	a.add(AckResult{SiteID: 1, Step: "configure WireGuard peer", Success: true})
+	a.send()
+
+	acks := sender.acks(t)
+	if len(acks) != 1 {
+		t.Fatalf("sent %d acks, want 1", len(acks))
+	}
+	got := acks[0]
+	if got["requestId"] != "req-1" || got["type"] != "olm/wg/peer/add" || got["success"] != true {
+		t.Errorf("ack = %v", got)
+	}
+	if _, ok := got["code"]; ok {
+		t.Errorf("successful ack has code %v", got["code"])
+	}
+	if _, ok := got["error"]; ok {
+		t.Errorf("successful ack has error %v", got["error"])
+	}
+	results, ok := got["results"].([]interface{})
+	if !ok || len(results) != 1 {
+		t.Fatalf("results = %v, want 1 result", got["results"])
+	}
+	result := results[0].(map[string]interface{})
+	if result["siteId"] != float64(1) || result["step"] != "configure WireGuard peer" || result["success"] != true {
+		t.Errorf("result = %v", result)
+	}
+	if _, ok := result["rolledBack"]; ok {
+		t.Errorf("result has rolledBack without a rollback: %v", result)
+	}
+}
+
+func TestAckSendFailure(t *testing.T) {
+	sender := &fakeSender{}
+	a := newAck(sender, testMessage("olm/wg/peer/update", "req-2"))
+	a.add(
+		AckResult{SiteID: 1, Step: "configure WireGuard peer", Success: true, RolledBack: true},
+		AckResult{SiteID: 1, Step: "add route for remote subnet 10.1.0.0/24", Error: "no such device"},
+	)
+	a.fail(ackErrorf(AckRouteFailed, "failed to add route for remote subnet 10.1.0.0/24: no such device"))
+	a.fail(errors.New("later error"))
+	a.send()
+
+	acks := sender.acks(t)
+	if len(acks) != 1 {
+		t.Fatalf("sent %d acks, want 1", len(acks))
+	}
+	got := acks[0]
+	if got["success"] != false || got["code"] != AckRouteFailed {
+		t.Errorf("ack = %v", got)
+	}
+	// The first error is reported
+	if got["error"] != "failed to add route for remote subnet 10.1.0.0/24: no such device" {
+		t.Errorf("error = %v", got["error"])
+	}
+	results, ok := got["results"].([]interface{})
+	if !ok || len(results) != 2 {
+		t.Fatalf("results = %v, want 2 results", got["results"])
+	}
+	if rolledBack := results[0].(map[string]interface{})["rolledBack"]; rolledBack != true {
+		t.Errorf("first result rolledBack = %v, want true", rolledBack)
+	}
+	if errText := results[1].(map[string]interface{})["error"]; errText != "no such device" {
+		t.Errorf("second result error = %v", errText)
+	}
+}
+
+func TestAckSendUncodedError(t *testing.T) {
+	sender := &fakeSender{}
+	a := newAck(sender, testMessage("olm/wg/peer/remove", "req-3"))
+	a.fail(errors.New("something broke"))
+	a.send()
+
+	acks := sender.acks(t)
+	if len(acks) != 1 {
+		t.Fatalf("sent %d acks, want 1", len(acks))
+	}
+	if acks[0]["code"] != AckInternal {
+		t.Errorf("code = %v, want %q", acks[0]["code"], AckInternal)
+	}
+	if _, ok := acks[0]["results"]; ok {
+		t.Errorf("ack without results has results %v", acks[0]["results"])
+	}
+}
+
+func TestAckNotSent(t *testing.T) {
+	tests := map[string]struct {
+		msg     websocket.WSMessage
+		enabled bool
+	}{
+		"no request ID":        {testMessage("olm/wg/peer/add", ""), true},
+		"non-string ID":        {websocket.WSMessage{Type: "olm/wg/peer/add", Data: map[string]interface{}{"requestId": 7}}, true},
+		"data is not object":   {websocket.WSMessage{Type: "olm/wg/peer/add", Data: "req-4"}, true},
+		"turned off by server": {testMessage("olm/wg/peer/add", "req-4"), false},
+	}
+	for name, tt := range tests {
+		sender := &fakeSender{}
+		a := newAck(sender, tt.msg)
+		a.enabled = tt.enabled
+		a.fail(ackErrorf(AckNotFound, "peer not found"))
+		a.send()
+		if len(sender.sent) != 0 {
+			t.Errorf("%s: sent %d messages, want none", name, len(sender.sent))
+		}
+	}
+
+	// Without a client nothing is sent and nothing panics
+	a := newAck(nil, testMessage("olm/wg/peer/add", "req-5"))
+	a.send()
+}
+
+func TestAckSendError(t *testing.T) {
+	sender := &fakeSender{err: errors.New("not connected")}
+	a := newAck(sender, testMessage("olm/wg/peer/add", "req-6"))
+	a.send()
+
+	if len(sender.sent) != 1 {
+		t.Errorf("sent %d messages, want 1", len(sender.sent))
+	}
+}
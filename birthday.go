@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	mrand "math/rand"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/wgconfig"
+)
+
+// Caps on birthday punching. Larger requests from Pangolin are clamped to these.
+const (
+	birthdayMaxSockets  = 256
+	birthdayMaxRate     = 200 // Probes per second over all sockets
+	birthdayMaxDuration = 30 * time.Second
+	// Punches running at once per session, so all of them together stay
+	// within 512 sockets and 400 probes per second
+	birthdayMaxConcurrent = 2
+
+	birthdayDefaultSockets  = 64
+	birthdayDefaultRate     = 100
+	birthdayDefaultDuration = 10 * time.Second
+
+	// Lowest destination port probed when spraying, NATs rarely map below it
+	birthdayMinPort = 1024
+	// Longest token accepted, it is sent in every probe
+	birthdayMaxToken = 64
+)
+
+const (
+	// Magic bytes of birthday probes, "OLMB"
+	birthdayMagic uint32 = 0x4F4C4D42
+	// Probe sent by either side
+	birthdayProbe uint8 = 1
+	// Reply to a probe, sent from the socket it arrived on
+	birthdayReply uint8 = 2
+)
+
+// BirthdayPunchData asks olm to punch through to a site whose NAT maps ports
+// unpredictably. Pangolin sends the site the same token at the same time.
+type BirthdayPunchData struct {
+	SiteId   int    `json:"siteId"`
+	Token    string `json:"token"`              // Shared with the site, carried in every probe of this attempt
+	Endpoint string `json:"endpoint"`           // Public host or IP of the site
+	Port     uint16 `json:"port,omitempty"`     // Port the site is reachable on, 0 to spray random ports
+	Sockets  int    `json:"sockets,omitempty"`  // Local sockets to open, each with its own NAT mapping
+	Rate     int    `json:"rate,omitempty"`     // Probes per second over all sockets
+	Duration int    `json:"duration,omitempty"` // Seconds to keep trying
+}
+
+// Validate checks the punch request
+func (d BirthdayPunchData) Validate() error {
+	if d.SiteId <= 0 {
+		return fmt.Errorf("invalid site ID %d", d.SiteId)
+	}
+	if d.Token == "" || len(d.Token) > birthdayMaxToken {
+		return fmt.Errorf("token must be 1 to %d bytes", birthdayMaxToken)
+	}
+	if strings.TrimSpace(d.Endpoint) == "" {
+		return fmt.Errorf("missing endpoint for site %d", d.SiteId)
+	}
+	if d.Sockets < 0 || d.Rate < 0 || d.Duration < 0 {
+		return fmt.Errorf("negative punch limits")
+	}
+	return nil
+}
+
+// limits returns the size of the attempt, clamped to the caps
+func (d BirthdayPunchData) limits() (sockets int, rate int, duration time.Duration) {
+	sockets, rate, duration = birthdayDefaultSockets, birthdayDefaultRate, birthdayDefaultDuration
+	if d.Sockets > 0 {
+		sockets = min(d.Sockets, birthdayMaxSockets)
+	}
+	if d.Rate > 0 {
+		rate = min(d.Rate, birthdayMaxRate)
+	}
+	if d.Duration > 0 {
+		duration = min(time.Duration(d.Duration)*time.Second, birthdayMaxDuration)
+	}
+	return sockets, rate, duration
+}
+
+// handleBirthdayPunch starts a birthday punch to a configured site. The outcome
+// is sent as olm/wg/holepunch/birthday/result once it is known.
+func (s *session) handleBirthdayPunch(data BirthdayPunchData, ack *ack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.features[CapBirthday] {
+		ack.fail(ackErrorf(AckNotReady, "birthday punching is disabled"))
+		return
+	}
+	if s.dev == nil || s.bind == nil {
+		ack.fail(ackErrorf(AckNotReady, "tunnel is not up"))
+		return
+	}
+	if _, ok := s.peers[data.SiteId]; !ok {
+		ack.fail(ackErrorf(AckNotFound, "peer with site ID %d not found", data.SiteId))
+		return
+	}
+	if s.punching[data.SiteId] {
+		ack.fail(ackErrorf(AckNotReady, "already punching to site %d", data.SiteId))
+		return
+	}
+	if len(s.punching) >= birthdayMaxConcurrent {
+		ack.fail(ackErrorf(AckNotReady, "%d birthday punches are already running", len(s.punching)))
+		return
+	}
+
+	host, err := resolveDomain(data.Endpoint)
+	if err != nil {
+		ack.fail(ackErrorf(AckResolveFailed, "failed to resolve endpoint for site %d: %v", data.SiteId, err))
+		return
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	remoteIP, err := netip.ParseAddr(host)
+	if err != nil {
+		ack.fail(ackErrorf(AckResolveFailed, "invalid endpoint for site %d: %v", data.SiteId, err))
+		return
+	}
+
+	s.punching[data.SiteId] = true
+	go s.runBirthdayPunch(data, remoteIP.Unmap())
+	ack.add(AckResult{Step: "start birthday punch", Success: true})
+}
+
+// runBirthdayPunch punches to a site and moves the peer to the winning mapping
+func (s *session) runBirthdayPunch(data BirthdayPunchData, remoteIP netip.Addr) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.punching, data.SiteId)
+		s.mu.Unlock()
+	}()
+
+	sockets, rate, duration := data.limits()
+	logger.Info("Birthday punching to site %d at %s with %d sockets, %d probes/s for %v",
+		data.SiteId, remoteIP, sockets, rate, duration)
+
+	udpConn, remote, sent, err := birthdayPunch(remoteIP, data.Port, []byte(data.Token), sockets, rate, duration, s.done)
+	if err == nil {
+		s.mu.Lock()
+		err = s.adoptPunchedUnlocked(data.SiteId, udpConn, remote)
+		s.mu.Unlock()
+	}
+
+	result := map[string]interface{}{
+		"siteId":  data.SiteId,
+		"token":   data.Token,
+		"success": err == nil,
+		"probes":  sent,
+	}
+	if err != nil {
+		logger.Warn("Birthday punch to site %d failed after %d probes: %v", data.SiteId, sent, err)
+		result["error"] = err.Error()
+	} else {
+		logger.Info("Birthday punch to site %d won with %s after %d probes", data.SiteId, remote, sent)
+		result["endpoint"] = remote.String()
+		result["localPort"] = udpConn.LocalAddr().(*net.UDPAddr).Port
+	}
+
+	if err := s.olm.SendMessage("olm/wg/holepunch/birthday/result", result); err != nil {
+		logger.Error("Failed to send birthday punch result for site %d: %v", data.SiteId, err)
+	}
+}
+
+// adoptPunchedUnlocked hands a punched socket to WireGuard and points the peer
+// of the site at the remote mapping it reached.
+// This function assumes the mutex is already held by the caller
+func (s *session) adoptPunchedUnlocked(siteID int, udpConn *net.UDPConn, remote netip.AddrPort) error {
+	peer, ok := s.peers[siteID]
+	if s.closed || s.bind == nil || !ok {
+		udpConn.Close()
+		return fmt.Errorf("site %d is gone", siteID)
+	}
+
+	if previous, ok := s.punched[siteID]; ok && previous != remote {
+		s.bind.RemoveSocket(previous)
+	}
+	s.bind.AddSocket(remote, udpConn)
+	s.punched[siteID] = remote
+
+	var err error
+	if s.monitor != nil {
+		err = s.monitor.SetDirectEndpoint(siteID, remote)
+	} else {
+		spec := peer.spec.WithEndpoint(remote, wgconfig.PathDirect)
+		spec.UpdateOnly = true
+		err = s.dev.IpcSet(spec.UAPI())
+	}
+	if err != nil {
+		s.bind.RemoveSocket(remote)
+		delete(s.punched, siteID)
+		return err
+	}
+
+	if s.httpServer != nil {
+		s.httpServer.UpdatePeerEndpoint(siteID, remote.String())
+	}
+	return nil
+}
+
+// birthdayPunch opens sockets and probes remoteIP from them until a probe or a
+// reply of the site arrives on one of them. With port 0 every probe goes to a
+// random port, otherwise all probes go to port. The winning socket is returned
+// open with the remote address it reached; the others are closed.
+func birthdayPunch(remoteIP netip.Addr, port uint16, token []byte, sockets, rate int, duration time.Duration, stop <-chan struct{}) (*net.UDPConn, netip.AddrPort, int, error) {
+	network := "udp4"
+	if remoteIP.Is6() {
+		network = "udp6"
+	}
+
+	conns := make([]*net.UDPConn, 0, sockets)
+	for i := 0; i < sockets; i++ {
+		udpConn, err := net.ListenUDP(network, nil)
+		if err != nil {
+			logger.Warn("Birthday punch opened only %d of %d sockets: %v", len(conns), sockets, err)
+			break
+		}
+		conns = append(conns, udpConn)
+	}
+	if len(conns) == 0 {
+		return nil, netip.AddrPort{}, 0, fmt.Errorf("failed to open any socket")
+	}
+
+	type win struct {
+		index  int
+		remote netip.AddrPort
+	}
+	won := make(chan win, 1)
+
+	probe := birthdayPacket(birthdayProbe, token)
+	reply := birthdayPacket(birthdayReply, token)
+
+	var wg sync.WaitGroup
+	for i, udpConn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 128)
+			for {
+				n, from, err := udpConn.ReadFromUDPAddrPort(buf)
+				if err != nil {
+					return
+				}
+				from = normalizeAddrPort(from)
+				typ, ok := parseBirthdayPacket(buf[:n], token)
+				if !ok || from.Addr() != remoteIP {
+					continue
+				}
+				if typ == birthdayProbe {
+					// Let the site see the pair as well
+					udpConn.WriteToUDPAddrPort(reply, from)
+				}
+				select {
+				case won <- win{index: i, remote: from}:
+				default:
+				}
+				return
+			}
+		}()
+	}
+
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	timeout := time.NewTimer(duration)
+	defer timeout.Stop()
+
+	var winner *win
+	sent := 0
+loop:
+	for {
+		select {
+		case w := <-won:
+			winner = &w
+			break loop
+		case <-timeout.C:
+			break loop
+		case <-stop:
+			break loop
+		case <-ticker.C:
+			dst := port
+			if dst == 0 {
+				dst = uint16(birthdayMinPort + mrand.Intn(65536-birthdayMinPort))
+			}
+			udpConn := conns[sent%len(conns)]
+			if _, err := udpConn.WriteToUDPAddrPort(probe, netip.AddrPortFrom(remoteIP, dst)); err != nil {
+				logger.Debug("Failed to send birthday probe: %v", err)
+			}
+			sent++
+		}
+	}
+
+	// Stop the readers before the winning socket is handed on
+	now := time.Now()
+	for _, udpConn := range conns {
+		udpConn.SetReadDeadline(now)
+	}
+	wg.Wait()
+	if winner == nil {
+		select {
+		case w := <-won:
+			winner = &w
+		default:
+		}
+	}
+
+	for i, udpConn := range conns {
+		if winner == nil || i != winner.index {
+			udpConn.Close()
+		}
+	}
+	if winner == nil {
+		return nil, netip.AddrPort{}, sent, fmt.Errorf("no answer within %v", duration)
+	}
+
+	udpConn := conns[winner.index]
+	udpConn.SetReadDeadline(time.Time{})
+	return udpConn, winner.remote, sent, nil
+}
+
+// birthdayPacket builds a probe or reply:
+// - 4 bytes: magic (0x4F4C4D42)
+// - 1 byte: type (1 = probe, 2 = reply)
+// - rest: the token of the attempt
+func birthdayPacket(typ uint8, token []byte) []byte {
+	b := binary.BigEndian.AppendUint32(nil, birthdayMagic)
+	b = append(b, typ)
+	return append(b, token...)
+}
+
+// parseBirthdayPacket returns the type of a probe or reply carrying token
+func parseBirthdayPacket(b []byte, token []byte) (uint8, bool) {
+	if len(b) < 5 || binary.BigEndian.Uint32(b[0:4]) != birthdayMagic {
+		return 0, false
+	}
+	typ := b[4]
+	if typ != birthdayProbe && typ != birthdayReply {
+		return 0, false
+	}
+	return typ, bytes.Equal(b[5:], token)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+var testToken = []byte("token-1234")
+
+func TestBirthdayPacket(t *testing.T) {
+	for _, typ := range []uint8{birthdayProbe, birthdayReply} {
+		b := birthdayPacket(typ, testToken)
+		got, ok := parseBirthdayPacket(b, testToken)
+		if !ok || got != typ {
+			t.Errorf("parseBirthdayPacket(type %d) = %d, %v", typ, got, ok)
+		}
+	}
+
+	probe := birthdayPacket(birthdayProbe, testToken)
+	badMagic := append([]byte(nil), probe...)
+	badMagic[0] ^= 0xff
+	badType := append([]byte(nil), probe...)
+	badType[4] = 3
+
+	tests := map[string][]byte{
+		"empty":       nil,
+		"short":       probe[:4],
+		"bad magic":   badMagic,
+		"bad type":    badType,
+		"wrong token": birthdayPacket(birthdayProbe, []byte("token-5678")),
+		"no token":    birthdayPacket(birthdayProbe, nil),
+		"long token":  append(append([]byte(nil), probe...), 'x'),
+	}
+	for name, b := range tests {
+		if _, ok := parseBirthdayPacket(b, testToken); ok {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+func TestBirthdayLimits(t *testing.T) {
+	sockets, rate, duration := BirthdayPunchData{}.limits()
+	if sockets != birthdayDefaultSockets || rate != birthdayDefaultRate || duration != birthdayDefaultDuration {
+		t.Errorf("defaults = %d, %d, %v", sockets, rate, duration)
+	}
+
+	sockets, rate, duration = BirthdayPunchData{Sockets: 10000, Rate: 10000, Duration: 3600}.limits()
+	if sockets != birthdayMaxSockets || rate != birthdayMaxRate || duration != birthdayMaxDuration {
+		t.Errorf("clamped = %d, %d, %v", sockets, rate, duration)
+	}
+}
+
+// startSite answers birthday probes on a loopback socket the way a site does.
+// Replies carry reply as the token.
+func startSite(t *testing.T, reply []byte) netip.AddrPort {
+	t.Helper()
+
+	site, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { site.Close() })
+
+	go func() {
+		buf := make([]byte, 128)
+		for {
+			n, from, err := site.ReadFromUDPAddrPort(buf)
+			if err != nil {
+				return
+			}
+			if typ, ok := parseBirthdayPacket(buf[:n], testToken); ok && typ == birthdayProbe {
+				site.WriteToUDPAddrPort(birthdayPacket(birthdayReply, reply), from)
+			}
+		}
+	}()
+	return site.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func TestBirthdayPunchLoopback(t *testing.T) {
+	site := startSite(t, testToken)
+
+	udpConn, remote, sent, err := birthdayPunch(site.Addr(), site.Port(), testToken, 4, 100, 2*time.Second, nil)
+	if err != nil {
+		t.Fatalf("punch failed after %d probes: %v", sent, err)
+	}
+	defer udpConn.Close()
+
+	if remote != site {
+		t.Errorf("remote = %s, want %s", remote, site)
+	}
+	if sent < 1 {
+		t.Errorf("sent %d probes", sent)
+	}
+
+	// The winning socket stays usable
+	if _, err := udpConn.WriteToUDPAddrPort(birthdayPacket(birthdayProbe, testToken), remote); err != nil {
+		t.Errorf("winning socket is closed: %v", err)
+	}
+}
+
+func TestBirthdayPunchIgnoresOtherTokens(t *testing.T) {
+	site := startSite(t, []byte("token-5678"))
+
+	udpConn, _, sent, err := birthdayPunch(site.Addr(), site.Port(), testToken, 2, 50, 300*time.Millisecond, nil)
+	if err == nil {
+		udpConn.Close()
+		t.Fatalf("punch won on a reply for another token")
+	}
+	if sent < 1 {
+		t.Errorf("sent %d probes", sent)
+	}
+}
+
+func TestBirthdayPunchStops(t *testing.T) {
+	// Nothing answers on a port that was just freed
+	site, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	addr := site.LocalAddr().(*net.UDPAddr).AddrPort()
+	site.Close()
+
+	stop := make(chan struct{})
+	time.AfterFunc(100*time.Millisecond, func() { close(stop) })
+
+	start := time.Now()
+	if _, _, _, err := birthdayPunch(addr.Addr(), addr.Port(), testToken, 2, 50, 10*time.Second, stop); err == nil {
+		t.Fatalf("punch succeeded without a site")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("punch took %v after stop", elapsed)
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	cacheMagic   = "OLMC"
+	cacheVersion = 1
+
+	// How long to wait for Pangolin before bringing up the cached tunnel
+	offlineAfter = 15 * time.Second
+)
+
+// cachedState is the last configuration received from Pangolin, kept to bring
+// the tunnel up while Pangolin is unreachable
+type cachedState struct {
+	Version    int       `json:"version"`
+	OlmID      string    `json:"olmId"`
+	PrivateKey string    `json:"privateKey"` // The key the sites know this client by
+	WgData     WgData    `json:"wgData"`
+	SavedAt    time.Time `json:"savedAt"`
+}
+
+// cachePath returns the cache file of an olm ID
+func cachePath(dir, id string) (string, error) {
+	if id == "" || filepath.Base(id) != id {
+		return "", fmt.Errorf("invalid olm ID %q", id)
+	}
+	return filepath.Join(dir, id+".cache"), nil
+}
+
+// deriveCacheKey derives the cache encryption key from the olm credentials, so
+// only the same olm ID and secret can read or forge the cache
+func deriveCacheKey(id, secret string) ([]byte, error) {
+	key := make([]byte, chacha20poly1305.KeySize)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, []byte(secret), []byte(id), []byte("olm wgdata cache")), key); err != nil {
+		return nil, fmt.Errorf("failed to derive cache key: %v", err)
+	}
+	return key, nil
+}
+
+// sealCache encrypts state as magic, nonce and XChaCha20-Poly1305 ciphertext
+func sealCache(key []byte, state *cachedState) ([]byte, error) {
+	plaintext, err := json.Marshal(state)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode cache: %v", err)
+	}
+
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+
+	sealed := append([]byte(cacheMagic), nonce...)
+	return aead.Seal(sealed, nonce, plaintext, []byte(cacheMagic+state.OlmID)), nil
+}
+
+// openCache decrypts and checks a cache sealed for the olm ID
+func openCache(key []byte, id string, data []byte) (*cachedState, error) {
+	aead, err := chacha20poly1305.NewX(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(cacheMagic)+aead.NonceSize() || !bytes.Equal(data[:len(cacheMagic)], []byte(cacheMagic)) {
+		return nil, fmt.Errorf("not an olm cache file")
+	}
+
+	nonce := data[len(cacheMagic) : len(cacheMagic)+aead.NonceSize()]
+	plaintext, err := aead.Open(nil, nonce, data[len(cacheMagic)+aead.NonceSize():], []byte(cacheMagic+id))
+	if err != nil {
+		return nil, fmt.Errorf("cache is corrupt or was written with other credentials")
+	}
+
+	var state cachedState
+	if err := json.Unmarshal(plaintext, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode cache: %v", err)
+	}
+	if state.Version != cacheVersion {
+		return nil, fmt.Errorf("unsupported cache version %d", state.Version)
+	}
+	if state.OlmID != id {
+		return nil, fmt.Errorf("cache belongs to olm %s", state.OlmID)
+	}
+	if err := state.WgData.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid cached configuration: %v", err)
+	}
+	return &state, nil
+}
+
+// loadCache reads the cache of an olm ID, returning nil without error if there is none
+func loadCache(path string, key []byte, id string) (*cachedState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache: %v", err)
+	}
+	return openCache(key, id, data)
+}
+
+// writeCache seals state and replaces the cache file atomically
+func writeCache(path string, key []byte, state *cachedState) error {
+	data, err := sealCache(key, state)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create cache directory: %v", err)
+	}
+
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return fmt.Errorf("failed to write cache: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace cache: %v", err)
+	}
+	return nil
+}
+
+// openSessionCache finds the cache of an olm, returning its path, key and the
+// cached state if there is a usable one
+func openSessionCache(dir, id, secret string) (string, []byte, *cachedState) {
+	path, err := cachePath(dir, id)
+	if err != nil {
+		logger.Warn("Not caching configuration: %v", err)
+		return "", nil, nil
+	}
+	key, err := deriveCacheKey(id, secret)
+	if err != nil {
+		logger.Warn("Not caching configuration: %v", err)
+		return "", nil, nil
+	}
+
+	state, err := loadCache(path, key, id)
+	if err != nil {
+		logger.Warn("Ignoring configuration cache %s: %v", path, err)
+		return path, key, nil
+	}
+	if state != nil {
+		logger.Info("Found cached configuration for %d sites from %s", len(state.WgData.Sites), state.SavedAt.Format(time.RFC3339))
+	}
+	return path, key, state
+}
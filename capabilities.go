@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+)
+
+// olmVersion is the version of this build, set with -ldflags "-X main.olmVersion=..."
+var olmVersion = "dev"
+
+// How often the registration message is repeated until Pangolin answers
+const registerInterval = 1 * time.Second
+
+// olmProtocolVersion is the version of the control protocol spoken with Pangolin.
+// Version 2 adds olm/ack and validation of control messages.
+const olmProtocolVersion = 2
+
+// Capabilities exchanged with Pangolin on registration
+const (
+	CapHolepunch = "holepunch"
+	CapAck       = "ack"
+	CapBirthday  = "birthday-punch"
+)
+
+// localCapabilities returns the capabilities this build supports with the given configuration
+func localCapabilities(config *olmConfig) []string {
+	capabilities := []string{CapAck}
+	if config.doHolepunch {
+		capabilities = append(capabilities, CapHolepunch, CapBirthday)
+	}
+	return capabilities
+}
+
+// CapabilitiesData is the server's reply to the capabilities olm advertised
+type CapabilitiesData struct {
+	ProtocolVersion int      `json:"protocolVersion"`
+	Enabled         []string `json:"enabled,omitempty"`  // Features to turn on, if olm supports them
+	Disabled        []string `json:"disabled,omitempty"` // Features to turn off
+}
+
+// Validate checks the protocol version and feature names
+func (d CapabilitiesData) Validate() error {
+	if d.ProtocolVersion < 0 {
+		return fmt.Errorf("invalid protocol version %d", d.ProtocolVersion)
+	}
+	for _, name := range append(append([]string(nil), d.Enabled...), d.Disabled...) {
+		if strings.TrimSpace(name) == "" {
+			return fmt.Errorf("empty capability name")
+		}
+	}
+	return nil
+}
+
+// registrationDataUnlocked builds the olm/wg/register message for this session.
+// This function assumes the mutex is already held by the caller
+func (s *session) registrationDataUnlocked() map[string]interface{} {
+	data := map[string]interface{}{
+		"publicKey":       s.privateKey.PublicKey().String(),
+		"relay":           !s.features[CapHolepunch],
+		"olmVersion":      olmVersion,
+		"protocolVersion": olmProtocolVersion,
+		"os":              runtime.GOOS,
+		"arch":            runtime.GOARCH,
+		"capabilities":    localCapabilities(s.config),
+	}
+	if s.nat != nil {
+		data["natType"] = s.nat.NATType
+		data["natMapping"] = s.nat.Mapping
+		data["natFiltering"] = s.nat.Filtering
+	}
+	return data
+}
+
+// featureEnabled reports whether a capability is currently in use
+func (s *session) featureEnabled(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.features[name]
+}
+
+// handleCapabilities applies the features the server turned on or off. Features
+// olm does not support are never turned on, and unknown names are ignored so
+// newer servers can talk to older clients.
+func (s *session) handleCapabilities(data CapabilitiesData, ack *ack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if data.ProtocolVersion > olmProtocolVersion {
+		logger.Info("Server speaks protocol version %d, olm speaks %d", data.ProtocolVersion, olmProtocolVersion)
+	}
+
+	supported := make(map[string]bool)
+	for _, name := range localCapabilities(s.config) {
+		supported[name] = true
+	}
+
+	holepunch := s.features[CapHolepunch]
+	for _, name := range data.Enabled {
+		if !supported[name] {
+			logger.Debug("Server enabled capability %s which olm does not support, ignoring", name)
+			ack.add(AckResult{Step: "enable " + name, Error: "not supported"})
+			continue
+		}
+		s.features[name] = true
+		ack.add(AckResult{Step: "enable " + name, Success: true})
+	}
+	for _, name := range data.Disabled {
+		if !supported[name] {
+			continue
+		}
+		s.features[name] = false
+		ack.add(AckResult{Step: "disable " + name, Success: true})
+	}
+
+	logger.Info("Server capabilities applied, enabled features: %v", s.enabledFeaturesUnlocked())
+
+	if s.features[CapHolepunch] == holepunch {
+		return
+	}
+
+	if s.monitor != nil {
+		s.monitor.SetHandleRelaySwitch(s.features[CapHolepunch])
+	}
+
+	// Re-register while still waiting for sites so the server sees the new relay mode
+	if !s.connected && s.stopRegister != nil {
+		s.stopRegister()
+		s.stopRegister = s.olm.SendMessageInterval("olm/wg/register", s.registrationDataUnlocked(), registerInterval)
+	}
+}
+
+// enabledFeaturesUnlocked lists the features in use, in advertisement order.
+// This function assumes the mutex is already held by the caller
+func (s *session) enabledFeaturesUnlocked() []string {
+	var enabled []string
+	for _, name := range localCapabilities(s.config) {
+		if s.features[name] {
+			enabled = append(enabled, name)
+		}
+	}
+	return enabled
+}
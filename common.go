@@ -11,11 +11,13 @@ import (
 	"runtime"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/fosrl/newt/logger"
 	"github.com/fosrl/newt/websocket"
 	"github.com/fosrl/olm/peermonitor"
+	"github.com/fosrl/olm/wgconfig"
 	"github.com/vishvananda/netlink"
 	"golang.org/x/crypto/chacha20poly1305"
 	"golang.org/x/crypto/curve25519"
@@ -31,12 +33,14 @@ type WgData struct {
 }
 
 type SiteConfig struct {
-	SiteId        int    `json:"siteId"`
-	Endpoint      string `json:"endpoint"`
-	PublicKey     string `json:"publicKey"`
-	ServerIP      string `json:"serverIP"`
-	ServerPort    uint16 `json:"serverPort"`
-	RemoteSubnets string `json:"remoteSubnets,omitempty"` // optional, comma-separated list of subnets that this site can access
+	SiteId        int      `json:"siteId"`
+	Endpoint      string   `json:"endpoint"`
+	PublicKey     string   `json:"publicKey"`
+	ServerIP      string   `json:"serverIP"`
+	ServerPort    uint16   `json:"serverPort"`
+	RemoteSubnets string   `json:"remoteSubnets,omitempty"` // optional, comma-separated list of subnets that this site can access
+	MonitorKey    string   `json:"monitorKey,omitempty"`    // optional, base64 key material for authenticated monitor probes
+	Relays        []string `json:"relays,omitempty"`        // optional, relays (host or host:port) to choose from on failover
 }
 
 type TargetsByType struct {
@@ -63,16 +67,6 @@ type EncryptedHolePunchMessage struct {
 	Ciphertext         []byte `json:"ciphertext"`
 }
 
-var (
-	peerMonitor        *peermonitor.PeerMonitor
-	stopHolepunch      chan struct{}
-	stopRegister       func()
-	stopPing           chan struct{}
-	olmToken           string
-	gerbilServerPubKey string
-	holePunchRunning   bool
-)
-
 const (
 	ENV_WG_TUN_FD             = "WG_TUN_FD"
 	ENV_WG_UAPI_FD            = "WG_UAPI_FD"
@@ -92,22 +86,26 @@ type PeerAction struct {
 
 // UpdatePeerData represents the data needed to update a peer
 type UpdatePeerData struct {
-	SiteId        int    `json:"siteId"`
-	Endpoint      string `json:"endpoint"`
-	PublicKey     string `json:"publicKey"`
-	ServerIP      string `json:"serverIP"`
-	ServerPort    uint16 `json:"serverPort"`
-	RemoteSubnets string `json:"remoteSubnets,omitempty"` // optional, comma-separated list of subnets that this site can access
+	SiteId        int      `json:"siteId"`
+	Endpoint      string   `json:"endpoint"`
+	PublicKey     string   `json:"publicKey"`
+	ServerIP      string   `json:"serverIP"`
+	ServerPort    uint16   `json:"serverPort"`
+	RemoteSubnets string   `json:"remoteSubnets,omitempty"` // optional, comma-separated list of subnets that this site can access
+	MonitorKey    string   `json:"monitorKey,omitempty"`    // optional, base64 key material for authenticated monitor probes
+	Relays        []string `json:"relays,omitempty"`        // optional, relays (host or host:port) to choose from on failover
 }
 
 // AddPeerData represents the data needed to add a peer
 type AddPeerData struct {
-	SiteId        int    `json:"siteId"`
-	Endpoint      string `json:"endpoint"`
-	PublicKey     string `json:"publicKey"`
-	ServerIP      string `json:"serverIP"`
-	ServerPort    uint16 `json:"serverPort"`
-	RemoteSubnets string `json:"remoteSubnets,omitempty"` // optional, comma-separated list of subnets that this site can access
+	SiteId        int      `json:"siteId"`
+	Endpoint      string   `json:"endpoint"`
+	PublicKey     string   `json:"publicKey"`
+	ServerIP      string   `json:"serverIP"`
+	ServerPort    uint16   `json:"serverPort"`
+	RemoteSubnets string   `json:"remoteSubnets,omitempty"` // optional, comma-separated list of subnets that this site can access
+	MonitorKey    string   `json:"monitorKey,omitempty"`    // optional, base64 key material for authenticated monitor probes
+	Relays        []string `json:"relays,omitempty"`        // optional, relays (host or host:port) to choose from on failover
 }
 
 // RemovePeerData represents the data needed to remove a peer
@@ -226,8 +224,8 @@ func resolveDomain(domain string) (string, error) {
 	return ipAddr, nil
 }
 
-func sendUDPHolePunchWithConn(conn *net.UDPConn, remoteAddr *net.UDPAddr, olmID string) error {
-	if gerbilServerPubKey == "" || olmToken == "" {
+func sendUDPHolePunchWithConn(conn *net.UDPConn, remoteAddr *net.UDPAddr, olmID, token, serverPubKey string) error {
+	if serverPubKey == "" || token == "" {
 		return nil
 	}
 
@@ -236,7 +234,7 @@ func sendUDPHolePunchWithConn(conn *net.UDPConn, remoteAddr *net.UDPAddr, olmID
 		Token string `json:"token"`
 	}{
 		OlmID: olmID,
-		Token: olmToken,
+		Token: token,
 	}
 
 	// Convert payload to JSON
@@ -246,7 +244,7 @@ func sendUDPHolePunchWithConn(conn *net.UDPConn, remoteAddr *net.UDPAddr, olmID
 	}
 
 	// Encrypt the payload using the server's WireGuard public key
-	encryptedPayload, err := encryptPayload(payloadBytes, gerbilServerPubKey)
+	encryptedPayload, err := encryptPayload(payloadBytes, serverPubKey)
 	if err != nil {
 		return fmt.Errorf("failed to encrypt payload: %v", err)
 	}
@@ -319,19 +317,10 @@ func encryptPayload(payload []byte, serverPublicKey string) (interface{}, error)
 	return encryptedMsg, nil
 }
 
-func keepSendingUDPHolePunch(endpoint string, olmID string, sourcePort uint16) {
-	// Check if hole punching is already running
-	if holePunchRunning {
-		logger.Debug("UDP hole punch already running, skipping new request")
-		return
-	}
-
-	// Set the flag to indicate hole punching is running
-	holePunchRunning = true
-	defer func() {
-		holePunchRunning = false
-		logger.Info("UDP hole punch goroutine ended")
-	}()
+// keepSendingUDPHolePunch punches from sourcePort to the endpoint until stop is
+// closed. Each punch carries the token and server key credentials returns then.
+func keepSendingUDPHolePunch(endpoint string, olmID string, sourcePort uint16, credentials func() (string, string), stop <-chan struct{}) {
+	defer logger.Info("UDP hole punch goroutine ended")
 
 	host, err := resolveDomain(endpoint)
 	if err != nil {
@@ -361,7 +350,8 @@ func keepSendingUDPHolePunch(endpoint string, olmID string, sourcePort uint16) {
 	defer conn.Close()
 
 	// Execute once immediately before starting the loop
-	if err := sendUDPHolePunchWithConn(conn, remoteAddr, olmID); err != nil {
+	token, serverPubKey := credentials()
+	if err := sendUDPHolePunchWithConn(conn, remoteAddr, olmID, token, serverPubKey); err != nil {
 		logger.Error("Failed to send UDP hole punch: %v", err)
 	}
 
@@ -370,11 +360,12 @@ func keepSendingUDPHolePunch(endpoint string, olmID string, sourcePort uint16) {
 
 	for {
 		select {
-		case <-stopHolepunch:
+		case <-stop:
 			logger.Info("Stopping UDP holepunch")
 			return
 		case <-ticker.C:
-			if err := sendUDPHolePunchWithConn(conn, remoteAddr, olmID); err != nil {
+			token, serverPubKey := credentials()
+			if err := sendUDPHolePunchWithConn(conn, remoteAddr, olmID, token, serverPubKey); err != nil {
 				logger.Error("Failed to send UDP hole punch: %v", err)
 			}
 		}
@@ -429,7 +420,7 @@ func sendPing(olm *websocket.Client) error {
 	return nil
 }
 
-func keepSendingPing(olm *websocket.Client) {
+func keepSendingPing(olm *websocket.Client, stop <-chan struct{}) {
 	// Send ping immediately on startup
 	if err := sendPing(olm); err != nil {
 		logger.Error("Failed to send initial ping: %v", err)
@@ -443,7 +434,7 @@ func keepSendingPing(olm *websocket.Client) {
 
 	for {
 		select {
-		case <-stopPing:
+		case <-stop:
 			logger.Info("Stopping ping messages")
 			return
 		case <-ticker.C:
@@ -454,113 +445,233 @@ func keepSendingPing(olm *websocket.Client) {
 	}
 }
 
-// ConfigurePeer sets up or updates a peer within the WireGuard device
-func ConfigurePeer(dev *device.Device, siteConfig SiteConfig, privateKey wgtypes.Key, endpoint string) error {
+// Number of sites whose endpoints are resolved at the same time during bring-up
+const maxConcurrentResolves = 32
+
+// preparedPeer is a site with its endpoints resolved, ready to be applied to the device
+type preparedPeer struct {
+	site       SiteConfig
+	spec       wgconfig.PeerSpec
+	monitorKey []byte
+	relays     []string
+}
+
+// preparePeer resolves the endpoints of a site and builds its peer configuration.
+// The relays of the site are only resolved if peers are monitored.
+func preparePeer(siteConfig SiteConfig, monitored bool) (*preparedPeer, error) {
 	siteHost, err := resolveDomain(siteConfig.Endpoint)
 	if err != nil {
-		return fmt.Errorf("failed to resolve endpoint for site %d: %v", siteConfig.SiteId, err)
+		return nil, ackErrorf(AckResolveFailed, "failed to resolve endpoint for site %d: %v", siteConfig.SiteId, err)
 	}
 
-	// Split off the CIDR of the server IP which is just a string and add /32 for the allowed IP
-	allowedIp := strings.Split(siteConfig.ServerIP, "/")
-	if len(allowedIp) > 1 {
-		allowedIp[1] = "32"
-	} else {
-		allowedIp = append(allowedIp, "32")
-	}
-	allowedIpStr := strings.Join(allowedIp, "/")
-
-	// Collect all allowed IPs in a slice
-	var allowedIPs []string
-	allowedIPs = append(allowedIPs, allowedIpStr)
-
-	// If we have anything in remoteSubnets, add those as well
-	if siteConfig.RemoteSubnets != "" {
-		// Split remote subnets by comma and add each one
-		remoteSubnets := strings.Split(siteConfig.RemoteSubnets, ",")
-		for _, subnet := range remoteSubnets {
-			subnet = strings.TrimSpace(subnet)
-			if subnet != "" {
-				allowedIPs = append(allowedIPs, subnet)
+	var monitorKey []byte
+	if siteConfig.MonitorKey != "" {
+		monitorKey, err = base64.StdEncoding.DecodeString(siteConfig.MonitorKey)
+		if err != nil {
+			return nil, ackErrorf(AckInvalidConfig, "invalid monitor key for site %d: %v", siteConfig.SiteId, err)
+		}
+	}
+
+	spec, err := sitePeerSpec(siteConfig, siteHost)
+	if err != nil {
+		return nil, &ackError{code: AckInvalidConfig, err: err}
+	}
+
+	var relays []string
+	if monitored {
+		for _, relay := range siteConfig.Relays {
+			resolved, err := resolveDomain(relay)
+			if err != nil {
+				logger.Warn("Failed to resolve relay %s for site %d: %v", relay, siteConfig.SiteId, err)
+				continue
 			}
+			relays = append(relays, resolved)
 		}
 	}
 
-	// Construct WireGuard config for this peer
-	var configBuilder strings.Builder
-	configBuilder.WriteString(fmt.Sprintf("private_key=%s\n", fixKey(privateKey.String())))
-	configBuilder.WriteString(fmt.Sprintf("public_key=%s\n", fixKey(siteConfig.PublicKey)))
+	return &preparedPeer{
+		site:       siteConfig,
+		spec:       spec,
+		monitorKey: monitorKey,
+		relays:     relays,
+	}, nil
+}
 
-	// Add each allowed IP separately
-	for _, allowedIP := range allowedIPs {
-		configBuilder.WriteString(fmt.Sprintf("allowed_ip=%s\n", allowedIP))
+// monitorPeer starts monitoring a peer that was applied to the device
+func monitorPeer(monitor *peermonitor.PeerMonitor, peer *preparedPeer, primaryRelay string) error {
+	if monitor == nil {
+		return nil
 	}
 
-	configBuilder.WriteString(fmt.Sprintf("endpoint=%s\n", siteHost))
-	configBuilder.WriteString("persistent_keepalive_interval=1\n")
+	siteConfig := peer.site
+	monitorAddress := strings.Split(siteConfig.ServerIP, "/")[0]
+	monitorPeer := fmt.Sprintf("%s:%d", monitorAddress, siteConfig.ServerPort+1) // +1 for the monitor port
+	logger.Debug("Setting up peer monitor for site %d at %s", siteConfig.SiteId, monitorPeer)
 
-	config := configBuilder.String()
-	logger.Debug("Configuring peer with config: %s", config)
+	wgConfig := &peermonitor.WireGuardConfig{
+		SiteID:       siteConfig.SiteId,
+		PublicKey:    fixKey(siteConfig.PublicKey),
+		ServerIP:     strings.Split(siteConfig.ServerIP, "/")[0],
+		Endpoint:     siteConfig.Endpoint,
+		PrimaryRelay: primaryRelay,
+		MonitorKey:   peer.monitorKey,
+		Relays:       peermonitor.RelayEndpoints(peer.relays),
+		Spec:         peer.spec,
+	}
 
-	err = dev.IpcSet(config)
+	err := monitor.AddPeer(siteConfig.SiteId, monitorPeer, wgConfig)
 	if err != nil {
+		return fmt.Errorf("failed to setup monitoring for site %d: %v", siteConfig.SiteId, err)
+	}
+
+	logger.Info("Started monitoring for site %d at %s", siteConfig.SiteId, monitorPeer)
+	return nil
+}
+
+// applyPeer applies the WireGuard configuration of a prepared peer to the device
+func applyPeer(dev *device.Device, peer *preparedPeer, privateKey wgtypes.Key) error {
+	config := wgconfig.Config{PrivateKey: &privateKey, Peers: []wgconfig.PeerSpec{peer.spec}}.UAPI()
+	logger.Debug("Configuring peer with config: %s", config)
+
+	if err := dev.IpcSet(config); err != nil {
 		return fmt.Errorf("failed to configure WireGuard peer: %v", err)
 	}
+	return nil
+}
 
-	// Set up peer monitoring
-	if peerMonitor != nil {
-		monitorAddress := strings.Split(siteConfig.ServerIP, "/")[0]
-		monitorPeer := fmt.Sprintf("%s:%d", monitorAddress, siteConfig.ServerPort+1) // +1 for the monitor port
-		logger.Debug("Setting up peer monitor for site %d at %s", siteConfig.SiteId, monitorPeer)
+// resolvePrimaryRelay resolves the relay Pangolin is reached through, if peers are monitored
+func resolvePrimaryRelay(monitor *peermonitor.PeerMonitor, endpoint string) string {
+	if monitor == nil {
+		return ""
+	}
 
-		primaryRelay, err := resolveDomain(endpoint) // Using global endpoint variable
-		if err != nil {
-			logger.Warn("Failed to resolve primary relay endpoint: %v", err)
-		}
+	primaryRelay, err := resolveDomain(endpoint)
+	if err != nil {
+		logger.Warn("Failed to resolve primary relay endpoint: %v", err)
+	}
+	return primaryRelay
+}
 
-		wgConfig := &peermonitor.WireGuardConfig{
-			SiteID:       siteConfig.SiteId,
-			PublicKey:    fixKey(siteConfig.PublicKey),
-			ServerIP:     strings.Split(siteConfig.ServerIP, "/")[0],
-			Endpoint:     siteConfig.Endpoint,
-			PrimaryRelay: primaryRelay,
+// ConfigurePeers sets up many peers at once. Endpoints are resolved concurrently
+// and all peers are applied with a single IpcSet. A failing site does not hold
+// back the others; its error is returned keyed by site ID. The peers that were
+// applied are returned in the order of sites.
+func ConfigurePeers(dev *device.Device, monitor *peermonitor.PeerMonitor, sites []SiteConfig, privateKey wgtypes.Key, endpoint string) ([]*preparedPeer, map[int]error) {
+	failures := make(map[int]error)
+	prepared := make([]*preparedPeer, len(sites))
+	errs := make([]error, len(sites))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, maxConcurrentResolves)
+	for i, site := range sites {
+		wg.Add(1)
+		go func(i int, site SiteConfig) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			prepared[i], errs[i] = preparePeer(site, monitor != nil)
+		}(i, site)
+	}
+	primaryRelay := resolvePrimaryRelay(monitor, endpoint)
+	wg.Wait()
+
+	var peers []*preparedPeer
+	var specs []wgconfig.PeerSpec
+	for i, peer := range prepared {
+		if errs[i] != nil {
+			failures[sites[i].SiteId] = errs[i]
+			continue
 		}
+		peers = append(peers, peer)
+		specs = append(specs, peer.spec)
+	}
 
-		err = peerMonitor.AddPeer(siteConfig.SiteId, monitorPeer, wgConfig)
-		if err != nil {
-			logger.Warn("Failed to setup monitoring for site %d: %v", siteConfig.SiteId, err)
-		} else {
-			logger.Info("Started monitoring for site %d at %s", siteConfig.SiteId, monitorPeer)
+	config := wgconfig.Config{PrivateKey: &privateKey, Peers: specs}.UAPI()
+	logger.Debug("Configuring %d peers with config: %s", len(specs), config)
+
+	if err := dev.IpcSet(config); err != nil {
+		// The device stops at the first bad peer, apply them one at a time to isolate it
+		logger.Warn("Failed to configure peers in one batch, retrying one at a time: %v", err)
+		peers = configurePeersIndividually(dev, peers, privateKey, failures)
+	}
+
+	for _, peer := range peers {
+		if err := monitorPeer(monitor, peer, primaryRelay); err != nil {
+			logger.Warn("%v", err)
 		}
 	}
 
-	return nil
+	return peers, failures
 }
 
-// RemovePeer removes a peer from the WireGuard device
-func RemovePeer(dev *device.Device, siteId int, publicKey string) error {
-	// Construct WireGuard config to remove the peer
-	var configBuilder strings.Builder
-	configBuilder.WriteString(fmt.Sprintf("public_key=%s\n", fixKey(publicKey)))
-	configBuilder.WriteString("remove=true\n")
+// configurePeersIndividually applies each peer with its own IpcSet, recording
+// the failures, and returns the peers that were applied
+func configurePeersIndividually(dev *device.Device, peers []*preparedPeer, privateKey wgtypes.Key, failures map[int]error) []*preparedPeer {
+	if err := dev.IpcSet(wgconfig.Config{PrivateKey: &privateKey}.UAPI()); err != nil {
+		for _, peer := range peers {
+			failures[peer.site.SiteId] = ackErrorf(AckWireGuardFailed, "failed to set private key: %v", err)
+		}
+		return nil
+	}
+
+	var applied []*preparedPeer
+	for _, peer := range peers {
+		if err := dev.IpcSet(peer.spec.UAPI()); err != nil {
+			failures[peer.site.SiteId] = ackErrorf(AckWireGuardFailed, "failed to configure WireGuard peer: %v", err)
+			continue
+		}
+		applied = append(applied, peer)
+	}
+	return applied
+}
 
-	config := configBuilder.String()
+// removeDevicePeer removes a peer from the WireGuard device
+func removeDevicePeer(dev *device.Device, publicKey wgtypes.Key) error {
+	config := wgconfig.RemovePeer(publicKey).UAPI()
 	logger.Debug("Removing peer with config: %s", config)
 
-	err := dev.IpcSet(config)
-	if err != nil {
+	if err := dev.IpcSet(config); err != nil {
 		return fmt.Errorf("failed to remove WireGuard peer: %v", err)
 	}
+	return nil
+}
 
-	// Stop monitoring this peer
-	if peerMonitor != nil {
-		peerMonitor.RemovePeer(siteId)
+// stopMonitoringPeer stops monitoring a site and drops its probe history
+func stopMonitoringPeer(monitor *peermonitor.PeerMonitor, siteId int) error {
+	if monitor != nil {
+		monitor.RemovePeer(siteId)
 		logger.Info("Stopped monitoring for site %d", siteId)
 	}
-
 	return nil
 }
 
+// sitePeerSpec builds the WireGuard configuration of a site on its direct path
+func sitePeerSpec(siteConfig SiteConfig, siteHost string) (wgconfig.PeerSpec, error) {
+	publicKey, err := wgconfig.ParseKey(siteConfig.PublicKey)
+	if err != nil {
+		return wgconfig.PeerSpec{}, fmt.Errorf("invalid public key for site %d: %v", siteConfig.SiteId, err)
+	}
+
+	endpoint, err := wgconfig.ParseEndpoint(siteHost)
+	if err != nil {
+		return wgconfig.PeerSpec{}, fmt.Errorf("invalid endpoint for site %d: %v", siteConfig.SiteId, err)
+	}
+
+	// The server IP as a host route plus every remote subnet of the site
+	allowedIPs, err := wgconfig.SiteAllowedIPs(siteConfig.ServerIP, siteConfig.RemoteSubnets)
+	if err != nil {
+		return wgconfig.PeerSpec{}, fmt.Errorf("invalid allowed IPs for site %d: %v", siteConfig.SiteId, err)
+	}
+
+	return wgconfig.PeerSpec{
+		PublicKey:  publicKey,
+		Endpoint:   endpoint,
+		Path:       wgconfig.PathDirect,
+		AllowedIPs: allowedIPs,
+		Keepalive:  wgconfig.DefaultKeepalive,
+	}, nil
+}
+
 // ConfigureInterface configures a network interface with an IP address and brings it up
 func ConfigureInterface(interfaceName string, wgData WgData) error {
 	var ipAddr string = wgData.TunnelIP
@@ -583,6 +694,42 @@ func ConfigureInterface(interfaceName string, wgData WgData) error {
 	}
 }
 
+// UnconfigureInterface removes the tunnel IP address from a network interface
+func UnconfigureInterface(interfaceName string, tunnelIP string) error {
+	ip, ipNet, err := net.ParseCIDR(tunnelIP)
+	if err != nil {
+		return fmt.Errorf("invalid IP address: %v", err)
+	}
+
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		link, err := netlink.LinkByName(interfaceName)
+		if err != nil {
+			return fmt.Errorf("failed to get interface %s: %v", interfaceName, err)
+		}
+		if err := netlink.AddrDel(link, &netlink.Addr{IPNet: &net.IPNet{IP: ip, Mask: ipNet.Mask}}); err != nil {
+			return fmt.Errorf("failed to remove IP address: %v", err)
+		}
+		return nil
+	case "darwin":
+		cmd = exec.Command("ifconfig", interfaceName, "inet", ip.String(), "-alias")
+	case "windows":
+		cmd = exec.Command("netsh", "interface", "ipv4", "delete", "address",
+			fmt.Sprintf("name=%s", interfaceName),
+			fmt.Sprintf("addr=%s", ip.String()))
+	default:
+		return fmt.Errorf("unsupported operating system: %s", runtime.GOOS)
+	}
+
+	logger.Info("Running command: %v", cmd)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to remove IP address: %v, output: %s", err, out)
+	}
+	return nil
+}
+
 func configureWindows(interfaceName string, ip net.IP, ipNet *net.IPNet) error {
 	logger.Info("Configuring Windows interface: %s", interfaceName)
 
@@ -955,76 +1102,93 @@ func removeRouteForServerIP(serverIP string) error {
 	return nil
 }
 
-// addRoutesForRemoteSubnets adds routes for each comma-separated CIDR in RemoteSubnets
-func addRoutesForRemoteSubnets(remoteSubnets, interfaceName string) error {
-	if remoteSubnets == "" {
-		return nil
-	}
-
-	// Split remote subnets by comma and add routes for each one
-	subnets := strings.Split(remoteSubnets, ",")
-	for _, subnet := range subnets {
+// splitSubnets splits a comma-separated RemoteSubnets string into trimmed CIDRs
+func splitSubnets(remoteSubnets string) []string {
+	var subnets []string
+	for _, subnet := range strings.Split(remoteSubnets, ",") {
 		subnet = strings.TrimSpace(subnet)
-		if subnet == "" {
-			continue
+		if subnet != "" {
+			subnets = append(subnets, subnet)
 		}
+	}
+	return subnets
+}
 
-		// Add route based on operating system
-		if runtime.GOOS == "darwin" {
-			if err := DarwinAddRoute(subnet, "", interfaceName); err != nil {
-				logger.Error("Failed to add Darwin route for subnet %s: %v", subnet, err)
-				return err
-			}
-		} else if runtime.GOOS == "windows" {
-			if err := WindowsAddRoute(subnet, "", interfaceName); err != nil {
-				logger.Error("Failed to add Windows route for subnet %s: %v", subnet, err)
-				return err
-			}
-		} else if runtime.GOOS == "linux" {
-			if err := LinuxAddRoute(subnet, "", interfaceName); err != nil {
-				logger.Error("Failed to add Linux route for subnet %s: %v", subnet, err)
-				return err
-			}
+// addRoutesForRemoteSubnets adds routes for each comma-separated CIDR in RemoteSubnets
+func addRoutesForRemoteSubnets(remoteSubnets, interfaceName string) error {
+	for _, subnet := range splitSubnets(remoteSubnets) {
+		if err := addRouteForSubnet(subnet, interfaceName); err != nil {
+			return err
 		}
-
-		logger.Info("Added route for remote subnet: %s", subnet)
 	}
 	return nil
 }
 
+// unkeptSubnets returns the comma-separated CIDRs in remoteSubnets that are not in kept
+func unkeptSubnets(remoteSubnets string, kept map[string]bool) string {
+	var subnets []string
+	for _, subnet := range splitSubnets(remoteSubnets) {
+		if !kept[subnet] {
+			subnets = append(subnets, subnet)
+		}
+	}
+	return strings.Join(subnets, ",")
+}
+
 // removeRoutesForRemoteSubnets removes routes for each comma-separated CIDR in RemoteSubnets
 func removeRoutesForRemoteSubnets(remoteSubnets string) error {
-	if remoteSubnets == "" {
-		return nil
+	for _, subnet := range splitSubnets(remoteSubnets) {
+		if err := removeRouteForSubnet(subnet); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Split remote subnets by comma and remove routes for each one
-	subnets := strings.Split(remoteSubnets, ",")
-	for _, subnet := range subnets {
-		subnet = strings.TrimSpace(subnet)
-		if subnet == "" {
-			continue
+// addRouteForSubnet adds an OS-specific route for one remote subnet
+func addRouteForSubnet(subnet, interfaceName string) error {
+	// Add route based on operating system
+	if runtime.GOOS == "darwin" {
+		if err := DarwinAddRoute(subnet, "", interfaceName); err != nil {
+			logger.Error("Failed to add Darwin route for subnet %s: %v", subnet, err)
+			return err
 		}
-
-		// Remove route based on operating system
-		if runtime.GOOS == "darwin" {
-			if err := DarwinRemoveRoute(subnet); err != nil {
-				logger.Error("Failed to remove Darwin route for subnet %s: %v", subnet, err)
-				return err
-			}
-		} else if runtime.GOOS == "windows" {
-			if err := WindowsRemoveRoute(subnet); err != nil {
-				logger.Error("Failed to remove Windows route for subnet %s: %v", subnet, err)
-				return err
-			}
-		} else if runtime.GOOS == "linux" {
-			if err := LinuxRemoveRoute(subnet); err != nil {
-				logger.Error("Failed to remove Linux route for subnet %s: %v", subnet, err)
-				return err
-			}
+	} else if runtime.GOOS == "windows" {
+		if err := WindowsAddRoute(subnet, "", interfaceName); err != nil {
+			logger.Error("Failed to add Windows route for subnet %s: %v", subnet, err)
+			return err
 		}
+	} else if runtime.GOOS == "linux" {
+		if err := LinuxAddRoute(subnet, "", interfaceName); err != nil {
+			logger.Error("Failed to add Linux route for subnet %s: %v", subnet, err)
+			return err
+		}
+	}
 
-		logger.Info("Removed route for remote subnet: %s", subnet)
+	logger.Info("Added route for remote subnet: %s", subnet)
+	return nil
+}
+
+// removeRouteForSubnet removes the OS-specific route for one remote subnet
+func removeRouteForSubnet(subnet string) error {
+	// Remove route based on operating system
+	if runtime.GOOS == "darwin" {
+		if err := DarwinRemoveRoute(subnet); err != nil {
+			logger.Error("Failed to remove Darwin route for subnet %s: %v", subnet, err)
+			return err
+		}
+	} else if runtime.GOOS == "windows" {
+		if err := WindowsRemoveRoute(subnet); err != nil {
+			logger.Error("Failed to remove Windows route for subnet %s: %v", subnet, err)
+			return err
+		}
+	} else if runtime.GOOS == "linux" {
+		if err := LinuxRemoveRoute(subnet); err != nil {
+			logger.Error("Failed to remove Linux route for subnet %s: %v", subnet, err)
+			return err
+		}
 	}
+
+	logger.Info("Removed route for remote subnet: %s", subnet)
 	return nil
 }
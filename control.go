@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/httpserver"
+	"github.com/fosrl/olm/peermonitor"
+)
+
+// sessionManager owns the current websocket session and handles control requests
+type sessionManager struct {
+	mu         sync.Mutex
+	config     *olmConfig
+	httpServer *httpserver.HTTPServer
+	session    *session
+	id         string
+	secret     string
+	endpoint   string
+	terminated chan struct{}  // Closed when Pangolin terminated olm and it should exit
+	upgrades   chan string    // Binaries to hand the session off to
+	detached   *session       // Handed off session whose device runs until exec
+	leftUp     bool           // The tunnel was left up on shutdown
+	adopted    *adoptedTunnel // Interface left up by the previous olm, given to the next session
+	state      *stateDir      // Passed to every session, nil if none
+}
+
+// What olm does after Pangolin terminates it
+const (
+	TerminateExit = "exit" // Exit with exitTerminated
+	TerminateIdle = "idle" // Stay running and wait for credentials via /connect
+)
+
+// exitTerminated is the exit code of olm after Pangolin terminated it
+const exitTerminated = 3
+
+func newSessionManager(config *olmConfig, httpServer *httpserver.HTTPServer) *sessionManager {
+	return &sessionManager{
+		config:     config,
+		httpServer: httpServer,
+		terminated: make(chan struct{}),
+		upgrades:   make(chan string, 1),
+	}
+}
+
+// SetStateDir sets the state directory sessions record their tunnel in
+func (m *sessionManager) SetStateDir(state *stateDir) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.state = state
+}
+
+// SetAdopted gives the interface left up by the previous olm to the next session
+func (m *sessionManager) SetAdopted(adopted *adoptedTunnel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.adopted = adopted
+}
+
+// Connect starts a new session with the given credentials, replacing any existing one
+func (m *sessionManager) Connect(id, secret, endpoint string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.session != nil && m.id != id {
+		logger.Info("Switching from olm %s to olm %s", m.id, id)
+	}
+
+	m.id = id
+	m.secret = secret
+	m.endpoint = endpoint
+
+	return m.startLocked()
+}
+
+// startLocked closes the current session and starts a new one with the stored
+// credentials. The caller must hold m.mu.
+func (m *sessionManager) startLocked() error {
+	if m.session != nil {
+		m.session.Close()
+		m.session = nil
+	}
+
+	sess, err := newSession(m.config, m.httpServer, m.id, m.secret, m.endpoint)
+	if err != nil {
+		return err
+	}
+	sess.onTerminate = m.handleTerminate
+	sess.state = m.state
+	sess.adopted = m.adopted
+	m.adopted = nil
+
+	if err := sess.Start(); err != nil {
+		sess.Close()
+		return err
+	}
+
+	m.session = sess
+	return nil
+}
+
+// handleTerminate drops a session Pangolin terminated, then exits or waits for
+// new credentials depending on the configuration
+func (m *sessionManager) handleTerminate(sess *session) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A newer session may have replaced it meanwhile
+	if m.session != sess {
+		return
+	}
+	m.session = nil
+
+	if m.config.onTerminate == TerminateIdle && m.httpServer != nil {
+		logger.Info("Terminated by server, waiting for credentials via /connect")
+		m.id, m.secret, m.endpoint = "", "", ""
+		m.httpServer.SetState(httpserver.StateIdle)
+		return
+	}
+
+	logger.Info("Terminated by server, exiting")
+	select {
+	case <-m.terminated:
+	default:
+		close(m.terminated)
+	}
+}
+
+// Terminated returns a channel closed when olm should exit because Pangolin terminated it
+func (m *sessionManager) Terminated() <-chan struct{} {
+	return m.terminated
+}
+
+// Upgrade checks binary and asks main to hand the session off to it
+func (m *sessionManager) Upgrade(binary string) error {
+	if runtime.GOOS == "windows" {
+		return fmt.Errorf("upgrades are not supported on Windows")
+	}
+	if !filepath.IsAbs(binary) {
+		return fmt.Errorf("binary must be an absolute path")
+	}
+
+	m.mu.Lock()
+	connected := m.session != nil && m.session.isConnected()
+	m.mu.Unlock()
+	if !connected {
+		return fmt.Errorf("not connected, nothing to hand off")
+	}
+
+	if err := checkUpgradeBinary(binary); err != nil {
+		return err
+	}
+
+	select {
+	case m.upgrades <- binary:
+		return nil
+	default:
+		return fmt.Errorf("an upgrade is already in progress")
+	}
+}
+
+// Upgrades returns the binaries main should hand the session off to
+func (m *sessionManager) Upgrades() <-chan string {
+	return m.upgrades
+}
+
+// Handoff detaches the current session from its tunnel for an upgrade and
+// returns the descriptor of the written handoff state
+func (m *sessionManager) Handoff() (*handoffState, int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.session == nil {
+		return nil, -1, fmt.Errorf("not connected")
+	}
+
+	state, stateFD, err := m.session.handoff(m.secret)
+	if err != nil {
+		return nil, -1, err
+	}
+	m.detached = m.session
+	m.session = nil
+	return state, stateFD, nil
+}
+
+// TunnelLeftUp reports whether a tunnel was handed off or left up and is still up
+func (m *sessionManager) TunnelLeftUp() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.detached != nil || m.leftUp
+}
+
+// Resume starts a session on the tunnel handed off by the previous olm
+func (m *sessionManager) Resume(state *handoffState) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	// A failed upgrade resumes in this process, on the descriptors it handed off
+	if m.detached != nil {
+		m.detached.releaseDevice()
+		m.detached = nil
+	}
+
+	m.id = state.OlmID
+	m.secret = state.Secret
+	m.endpoint = state.Endpoint
+
+	sess, err := newSession(m.config, m.httpServer, m.id, m.secret, m.endpoint)
+	if err != nil {
+		return err
+	}
+	sess.onTerminate = m.handleTerminate
+	sess.state = m.state
+
+	if err := sess.resume(state); err != nil {
+		sess.Close()
+		return err
+	}
+	if err := sess.Start(); err != nil {
+		sess.Close()
+		return err
+	}
+
+	m.session = sess
+	return nil
+}
+
+// Disconnect closes the websocket session and tears down the tunnel
+func (m *sessionManager) Disconnect() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.session == nil {
+		return fmt.Errorf("not connected")
+	}
+
+	logger.Info("Disconnecting on control request")
+	m.session.Close()
+	m.session = nil
+	return nil
+}
+
+// Reconnect tears down the current session and connects again with the same credentials
+func (m *sessionManager) Reconnect() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.id == "" && m.secret == "" && m.endpoint == "" {
+		return fmt.Errorf("no credentials to reconnect with")
+	}
+
+	logger.Info("Reconnecting on control request")
+	return m.startLocked()
+}
+
+// SetLogLevel changes the log level of the running process
+func (m *sessionManager) SetLogLevel(level string) error {
+	switch strings.ToUpper(level) {
+	case "DEBUG", "INFO", "WARN", "ERROR", "FATAL":
+	default:
+		return fmt.Errorf("invalid log level %q (DEBUG, INFO, WARN, ERROR, FATAL)", level)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.config.loggerLevel = parseLogLevel(level)
+	logger.GetLogger().SetLevel(m.config.loggerLevel)
+	logger.Info("Log level set to %s", strings.ToUpper(level))
+	return nil
+}
+
+// Routes returns the routes installed by the current session
+func (m *sessionManager) Routes() []httpserver.RouteInfo {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.session == nil {
+		return nil
+	}
+	return m.session.Routes()
+}
+
+// Close tears down the current session
+func (m *sessionManager) Close() {
+	m.Shutdown(false)
+}
+
+// Shutdown closes the current session. If leaveTunnel is set and the
+// platform supports it, the interface with its address and routes outlives olm.
+func (m *sessionManager) Shutdown(leaveTunnel bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.session != nil {
+		if leaveTunnel && m.session.leaveUp() {
+			m.session.Shutdown(true)
+			m.leftUp = true
+		} else {
+			m.session.Close()
+		}
+		m.session = nil
+	}
+	if m.adopted != nil {
+		// No session took the interface, it goes away with its routes
+		m.adopted.tdev.Close()
+		m.adopted = nil
+	}
+}
+
+// monitor returns the peer monitor of the current session, nil if there is none
+func (m *sessionManager) monitor() *peermonitor.PeerMonitor {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.session == nil {
+		return nil
+	}
+	return m.session.Monitor()
+}
+
+// TestPeer runs an on-demand connectivity test against one site
+func (m *sessionManager) TestPeer(siteID int) (httpserver.PeerTestResult, error) {
+	monitor := m.monitor()
+	if monitor == nil {
+		return httpserver.PeerTestResult{}, fmt.Errorf("not connected")
+	}
+
+	result, err := monitor.TestPeer(siteID)
+	if err != nil {
+		return httpserver.PeerTestResult{}, err
+	}
+	return toPeerTestResult(result), nil
+}
+
+// TestAllPeers runs on-demand connectivity tests against all sites concurrently
+func (m *sessionManager) TestAllPeers() ([]httpserver.PeerTestResult, error) {
+	monitor := m.monitor()
+	if monitor == nil {
+		return nil, fmt.Errorf("not connected")
+	}
+
+	results := monitor.TestAllPeers()
+	converted := make([]httpserver.PeerTestResult, len(results))
+	for i, result := range results {
+		converted[i] = toPeerTestResult(result)
+	}
+	return converted, nil
+}
+
+// PeerQuality returns the probe quality of every site over the stats windows
+func (m *sessionManager) PeerQuality() map[int][]httpserver.PeerQuality {
+	monitor := m.monitor()
+	if monitor == nil {
+		return nil
+	}
+
+	quality := make(map[int][]httpserver.PeerQuality)
+	for _, site := range monitor.Stats() {
+		windows := make([]httpserver.PeerQuality, len(site.Windows))
+		for i, w := range site.Windows {
+			windows[i] = httpserver.PeerQuality{
+				Window:  w.Window,
+				Samples: w.Samples,
+				Loss:    w.Loss,
+				Uptime:  w.Uptime,
+				P50:     w.P50,
+				P95:     w.P95,
+				P99:     w.P99,
+				Jitter:  w.Jitter,
+			}
+		}
+		quality[site.SiteID] = windows
+	}
+	return quality
+}
+
+func toPeerTestResult(result peermonitor.PeerTestResult) httpserver.PeerTestResult {
+	return httpserver.PeerTestResult{
+		SiteID:    result.SiteID,
+		Connected: result.Connected,
+		RTT:       result.RTT,
+		Attempts:  result.Attempts,
+	}
+}
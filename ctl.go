@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fosrl/olm/httpserver"
+)
+
+// ctlCommands are the subcommands that talk to a running olm over the control socket
+var ctlCommands = map[string]bool{
+	"status":     true,
+	"peers":      true,
+	"disconnect": true,
+	"reconnect":  true,
+	"set":        true,
+	"routes":     true,
+	"test":       true,
+	"events":     true,
+	"stats":      true,
+	"upgrade":    true,
+}
+
+func isCtlCommand(arg string) bool {
+	return ctlCommands[arg]
+}
+
+// ctlClient sends requests to the control socket of a running olm
+type ctlClient struct {
+	http *http.Client
+}
+
+func newCtlClient(socket string) *ctlClient {
+	return &ctlClient{
+		http: &http.Client{
+			Timeout: 60 * time.Second,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+	}
+}
+
+// do sends a request and decodes the JSON response into out
+func (c *ctlClient) do(method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequest(method, "http://olm"+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach olm (is it running?): %v", err)
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s", strings.TrimSpace(string(data)))
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// runCtl runs a control subcommand and returns the process exit code
+func runCtl(args []string) int {
+	if len(args) == 0 {
+		printCtlUsage()
+		return 2
+	}
+
+	command := args[0]
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	socket := flags.String("socket", defaultControlSocket(), "Path of the olm control socket")
+	jsonOutput := flags.Bool("json", false, "Print JSON instead of a table")
+	binary := flags.String("binary", "", "New olm binary to upgrade to")
+	positional, err := parseInterspersed(flags, args[1:])
+	if err != nil {
+		return 2
+	}
+
+	client := newCtlClient(*socket)
+
+	switch command {
+	case "status":
+		err = ctlStatus(client, *jsonOutput)
+	case "peers":
+		err = ctlPeers(client, *jsonOutput)
+	case "routes":
+		err = ctlRoutes(client, *jsonOutput)
+	case "disconnect":
+		err = ctlAction(client, "/disconnect", nil, *jsonOutput)
+	case "reconnect":
+		err = ctlAction(client, "/reconnect", nil, *jsonOutput)
+	case "set":
+		err = ctlSet(client, positional, *jsonOutput)
+	case "test":
+		err = ctlTest(client, positional, *jsonOutput)
+	case "events":
+		err = ctlEvents(client, *jsonOutput)
+	case "stats":
+		err = ctlStats(client, positional, *jsonOutput)
+	case "upgrade":
+		err = ctlUpgrade(client, *binary, *jsonOutput)
+	default:
+		printCtlUsage()
+		return 2
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// parseInterspersed parses flags that may appear before, between or after positional arguments
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func printCtlUsage() {
+	fmt.Println("Usage: olm <command> [--json] [--socket path]")
+	fmt.Println("\nCommands:")
+	fmt.Println("  status              Show connection status")
+	fmt.Println("  peers               List peers and their connection state")
+	fmt.Println("  routes              List routes installed for sites")
+	fmt.Println("  disconnect          Disconnect from Pangolin and tear down the tunnel")
+	fmt.Println("  reconnect           Reconnect to Pangolin with the current credentials")
+	fmt.Println("  set log-level LVL   Change the log level (DEBUG, INFO, WARN, ERROR, FATAL)")
+	fmt.Println("  test [SITE]         Test reachability of one site, or all sites")
+	fmt.Println("  events              Show recent peer and path changes")
+	fmt.Println("  stats [SITE]        Show RTT percentiles, loss, jitter and uptime per site")
+	fmt.Println("  upgrade --binary P  Hand the running tunnel off to the olm binary at P")
+}
+
+// printJSON writes v as indented JSON to stdout
+func printJSON(v interface{}) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func ctlStatus(client *ctlClient, jsonOutput bool) error {
+	var status httpserver.StatusResponse
+	if err := client.do(http.MethodGet, "/status", nil, &status); err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(status)
+	}
+
+	connectedPeers := 0
+	for _, peer := range status.PeerStatuses {
+		if peer.Connected {
+			connectedPeers++
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "Status:\t%s\n", status.Status)
+	if status.TunnelIP != "" {
+		fmt.Fprintf(w, "Tunnel IP:\t%s\n", status.TunnelIP)
+	}
+	fmt.Fprintf(w, "Peers:\t%d (%d connected)\n", len(status.PeerStatuses), connectedPeers)
+	return w.Flush()
+}
+
+func ctlPeers(client *ctlClient, jsonOutput bool) error {
+	var peers []httpserver.PeerStatus
+	if err := client.do(http.MethodGet, "/peers", nil, &peers); err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(peers)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tENDPOINT\tPATH\tCONNECTED\tRTT\tLAST SEEN")
+	for _, peer := range peers {
+		lastSeen := "-"
+		if !peer.LastSeen.IsZero() {
+			lastSeen = time.Since(peer.LastSeen).Round(time.Second).String() + " ago"
+		}
+		path := peer.Path
+		if path == "" {
+			path = "-"
+		} else if peer.Relay != "" {
+			path += " (" + peer.Relay + ")"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%v\t%v\t%s\n", peer.SiteID, peer.Endpoint, path, peer.Connected, peer.RTT.Round(time.Microsecond), lastSeen)
+	}
+	return w.Flush()
+}
+
+func ctlRoutes(client *ctlClient, jsonOutput bool) error {
+	var routes []httpserver.RouteInfo
+	if err := client.do(http.MethodGet, "/routes", nil, &routes); err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(routes)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "DESTINATION\tSITE\tINTERFACE")
+	for _, route := range routes {
+		fmt.Fprintf(w, "%s\t%d\t%s\n", route.Destination, route.SiteID, route.Interface)
+	}
+	return w.Flush()
+}
+
+func ctlEvents(client *ctlClient, jsonOutput bool) error {
+	var events []httpserver.Event
+	if err := client.do(http.MethodGet, "/events", nil, &events); err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(events)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "TIME\tSITE\tTYPE\tMESSAGE")
+	for _, event := range events {
+		site := "-"
+		if event.SiteID != 0 {
+			site = strconv.Itoa(event.SiteID)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", event.Time.Format(time.RFC3339), site, event.Type, event.Message)
+	}
+	return w.Flush()
+}
+
+func ctlStats(client *ctlClient, args []string, jsonOutput bool) error {
+	siteID := 0
+	switch len(args) {
+	case 0:
+	case 1:
+		var err error
+		siteID, err = strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid site ID %q", args[0])
+		}
+	default:
+		return fmt.Errorf("usage: olm stats [site-id]")
+	}
+
+	var peers []httpserver.PeerStatus
+	if err := client.do(http.MethodGet, "/peers", nil, &peers); err != nil {
+		return err
+	}
+	if siteID != 0 {
+		var filtered []httpserver.PeerStatus
+		for _, peer := range peers {
+			if peer.SiteID == siteID {
+				filtered = append(filtered, peer)
+			}
+		}
+		if len(filtered) == 0 {
+			return fmt.Errorf("site %d not found", siteID)
+		}
+		peers = filtered
+	}
+
+	if jsonOutput {
+		return printJSON(peers)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tWINDOW\tSAMPLES\tLOSS\tUPTIME\tP50\tP95\tP99\tJITTER")
+	for _, peer := range peers {
+		for _, q := range peer.Quality {
+			fmt.Fprintf(w, "%d\t%s\t%d\t%.1f%%\t%.1f%%\t%v\t%v\t%v\t%v\n", peer.SiteID, q.Window, q.Samples,
+				q.Loss*100, q.Uptime*100, q.P50.Round(time.Microsecond), q.P95.Round(time.Microsecond),
+				q.P99.Round(time.Microsecond), q.Jitter.Round(time.Microsecond))
+		}
+	}
+	return w.Flush()
+}
+
+func ctlSet(client *ctlClient, args []string, jsonOutput bool) error {
+	if len(args) != 2 || args[0] != "log-level" {
+		return fmt.Errorf("usage: olm set log-level <DEBUG|INFO|WARN|ERROR|FATAL>")
+	}
+	return ctlAction(client, "/log-level", httpserver.LogLevelRequest{Level: args[1]}, jsonOutput)
+}
+
+func ctlUpgrade(client *ctlClient, binary string, jsonOutput bool) error {
+	if binary == "" {
+		return fmt.Errorf("usage: olm upgrade --binary <path>")
+	}
+	// The running olm resolves paths from its own working directory
+	path, err := filepath.Abs(binary)
+	if err != nil {
+		return err
+	}
+	return ctlAction(client, "/upgrade", httpserver.UpgradeRequest{Binary: path}, jsonOutput)
+}
+
+func ctlTest(client *ctlClient, args []string, jsonOutput bool) error {
+	var results []httpserver.PeerTestResult
+
+	switch len(args) {
+	case 0:
+		if err := client.do(http.MethodPost, "/peers/test", nil, &results); err != nil {
+			return err
+		}
+	case 1:
+		siteID, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("invalid site ID %q", args[0])
+		}
+		var result httpserver.PeerTestResult
+		if err := client.do(http.MethodPost, fmt.Sprintf("/peers/%d/test", siteID), nil, &result); err != nil {
+			return err
+		}
+		results = append(results, result)
+	default:
+		return fmt.Errorf("usage: olm test [site-id]")
+	}
+
+	if jsonOutput {
+		return printJSON(results)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SITE\tREACHABLE\tRTT\tATTEMPTS")
+	for _, result := range results {
+		rtt := "-"
+		if result.Connected {
+			rtt = result.RTT.Round(time.Microsecond).String()
+		}
+		fmt.Fprintf(w, "%d\t%v\t%s\t%d\n", result.SiteID, result.Connected, rtt, result.Attempts)
+	}
+	return w.Flush()
+}
+
+// ctlAction posts to a control endpoint and prints the resulting status
+func ctlAction(client *ctlClient, path string, body interface{}, jsonOutput bool) error {
+	var result map[string]string
+	if err := client.do(http.MethodPost, path, body, &result); err != nil {
+		return err
+	}
+	if jsonOutput {
+		return printJSON(result)
+	}
+	fmt.Println(result["status"])
+	return nil
+}
@@ -1,9 +1,21 @@
 package httpserver
 
 import (
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -20,28 +32,134 @@ type ConnectionRequest struct {
 // PeerStatus represents the status of a peer connection
 type PeerStatus struct {
 	SiteID    int           `json:"siteId"`
+	Endpoint  string        `json:"endpoint,omitempty"`
 	Connected bool          `json:"connected"`
 	RTT       time.Duration `json:"rtt"`
 	LastSeen  time.Time     `json:"lastSeen"`
+	Path      string        `json:"path,omitempty"`  // "direct" or "relay"
+	Relay     string        `json:"relay,omitempty"` // Relay in use when Path is "relay"
+	Quality   []PeerQuality `json:"quality,omitempty"`
+}
+
+// PeerQuality summarizes the monitor probes of a peer over a rolling window
+type PeerQuality struct {
+	Window  string        `json:"window"`
+	Samples int           `json:"samples"`
+	Loss    float64       `json:"loss"`   // Fraction of probes lost, 0 to 1
+	Uptime  float64       `json:"uptime"` // Fraction of probes taken while the peer was up, 0 to 1
+	P50     time.Duration `json:"p50"`
+	P95     time.Duration `json:"p95"`
+	P99     time.Duration `json:"p99"`
+	Jitter  time.Duration `json:"jitter"`
+}
+
+// Event types recorded in the event log
+const (
+	EventPeerConnected    = "peer-connected"
+	EventPeerDisconnected = "peer-disconnected"
+	EventPathChanged      = "path-changed"
+	EventPeerFailed       = "peer-failed"
+)
+
+// Number of events kept for the /events endpoint
+const maxEvents = 256
+
+// Event is a notable change in the session, such as a peer switching paths
+type Event struct {
+	Time    time.Time `json:"time"`
+	Type    string    `json:"type"`
+	SiteID  int       `json:"siteId,omitempty"`
+	Message string    `json:"message"`
+}
+
+// RouteInfo describes an OS route installed for a site
+type RouteInfo struct {
+	Destination string `json:"destination"`
+	SiteID      int    `json:"siteId"`
+	Interface   string `json:"interface"`
+}
+
+// PeerTestResult is the outcome of an on-demand connectivity test of one peer
+type PeerTestResult struct {
+	SiteID    int           `json:"siteId"`
+	Connected bool          `json:"connected"`
+	RTT       time.Duration `json:"rtt"`
+	Attempts  int           `json:"attempts"`
+}
+
+// LogLevelRequest is the body of the /log-level endpoint
+type LogLevelRequest struct {
+	Level string `json:"level"`
+}
+
+// UpgradeRequest asks olm to hand its session off to another binary
+type UpgradeRequest struct {
+	Binary string `json:"binary"` // Absolute path of the new olm binary
+}
+
+// Controller is implemented by the Olm process to act on control requests
+type Controller interface {
+	Disconnect() error
+	Reconnect() error
+	SetLogLevel(level string) error
+	Routes() []RouteInfo
+	TestPeer(siteID int) (PeerTestResult, error)
+	TestAllPeers() ([]PeerTestResult, error)
+	PeerQuality() map[int][]PeerQuality
+	Upgrade(binary string) error
 }
 
 // StatusResponse is returned by the status endpoint
 type StatusResponse struct {
 	Status       string              `json:"status"`
 	Connected    bool                `json:"connected"`
+	ID           string              `json:"id,omitempty"`
+	Endpoint     string              `json:"endpoint,omitempty"`
 	TunnelIP     string              `json:"tunnelIP,omitempty"`
+	CachedAt     *time.Time          `json:"cachedAt,omitempty"` // When the cached configuration in use was saved, set while offline
 	PeerStatuses map[int]*PeerStatus `json:"peers,omitempty"`
 }
 
+// Session states reported by the status endpoint
+const (
+	StateIdle         = "idle"         // No credentials yet, waiting for /connect
+	StateConnecting   = "connecting"   // Connecting to the Pangolin websocket
+	StateRegistering  = "registering"  // Websocket connected, waiting for the tunnel configuration
+	StateConnected    = "connected"    // Tunnel is up
+	StateOffline      = "offline"      // Pangolin is unreachable, tunnel is up from the cached configuration
+	StateDisconnected = "disconnected" // Session closed
+)
+
+// unixPrefix marks an address as a Unix domain socket path, e.g. "unix:/var/run/olm/http.sock"
+const unixPrefix = "unix:"
+
 // HTTPServer represents the HTTP server and its state
 type HTTPServer struct {
 	addr           string
 	server         *http.Server
+	listener       net.Listener
+	authToken      string
+	tlsCertFile    string
+	tlsKeyFile     string
+	clientCAFile   string
+	allowRemote    bool // Allow /connect over plain TCP on non-loopback addresses
+	plainRemote    bool // Set when listening on plain TCP on a non-loopback address
 	connectionChan chan ConnectionRequest
 	statusMu       sync.RWMutex
 	peerStatuses   map[int]*PeerStatus
+	events         []Event        // Most recent events, oldest first
+	malformed      map[string]int // Rejected control messages by message type
 	connectedAt    time.Time
 	isConnected    bool
+	tunnelIP       string
+	cachedAt       time.Time
+	state          string
+	olmID          string
+	olmEndpoint    string
+	controller     Controller
+	mux            *http.ServeMux
+	controlServer  *http.Server
+	controlPath    string
 }
 
 // NewHTTPServer creates a new HTTP server
@@ -50,25 +168,76 @@ func NewHTTPServer(addr string) *HTTPServer {
 		addr:           addr,
 		connectionChan: make(chan ConnectionRequest, 1),
 		peerStatuses:   make(map[int]*PeerStatus),
+		malformed:      make(map[string]int),
 	}
 
+	s.mux = http.NewServeMux()
+	s.mux.HandleFunc("/connect", s.handleConnect)
+	s.mux.HandleFunc("/status", s.handleStatus)
+	s.mux.HandleFunc("/peers", s.handlePeers)
+	s.mux.HandleFunc("/routes", s.handleRoutes)
+	s.mux.HandleFunc("/events", s.handleEvents)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc("/disconnect", s.handleDisconnect)
+	s.mux.HandleFunc("/reconnect", s.handleReconnect)
+	s.mux.HandleFunc("/log-level", s.handleLogLevel)
+	s.mux.HandleFunc("/upgrade", s.handleUpgrade)
+	s.mux.HandleFunc("/peers/test", s.handleTestAllPeers)
+	s.mux.HandleFunc("/peers/{id}/test", s.handleTestPeer)
+
 	return s
 }
 
+// SetController sets the handler for control requests such as /disconnect
+func (s *HTTPServer) SetController(controller Controller) {
+	s.controller = controller
+}
+
+// SetAuthToken requires every request to carry "Authorization: Bearer <token>".
+// An empty token disables bearer authentication.
+func (s *HTTPServer) SetAuthToken(token string) {
+	s.authToken = token
+}
+
+// SetTLS serves the API over TLS using the given certificate and key. If
+// clientCAFile is not empty, clients must present a certificate signed by it (mTLS).
+func (s *HTTPServer) SetTLS(certFile, keyFile, clientCAFile string) {
+	s.tlsCertFile = certFile
+	s.tlsKeyFile = keyFile
+	s.clientCAFile = clientCAFile
+}
+
+// SetAllowRemoteConnect allows /connect to be served over plain TCP on a
+// non-loopback address. Credentials would otherwise travel unencrypted.
+func (s *HTTPServer) SetAllowRemoteConnect(allow bool) {
+	s.allowRemote = allow
+}
+
 // Start starts the HTTP server
 func (s *HTTPServer) Start() error {
-	mux := http.NewServeMux()
-	mux.HandleFunc("/connect", s.handleConnect)
-	mux.HandleFunc("/status", s.handleStatus)
+	listener, err := s.listen()
+	if err != nil {
+		return err
+	}
+	s.listener = listener
+
+	if s.plainRemote {
+		if s.authToken == "" {
+			logger.Warn("HTTP server is listening on non-loopback address %s without TLS or a token", s.addr)
+		}
+		if !s.allowRemote {
+			logger.Warn("Refusing /connect on %s: plain TCP on a non-loopback address (see --http-allow-remote-connect)", s.addr)
+		}
+	}
 
 	s.server = &http.Server{
-		Addr:    s.addr,
-		Handler: mux,
+		Handler:           s.authenticate(s.mux),
+		ReadHeaderTimeout: 10 * time.Second,
 	}
 
 	logger.Info("Starting HTTP server on %s", s.addr)
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := s.server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			logger.Error("HTTP server error: %v", err)
 		}
 	}()
@@ -76,10 +245,178 @@ func (s *HTTPServer) Start() error {
 	return nil
 }
 
-// Stop stops the HTTP server
+// StartControlSocket serves the API on a Unix socket for local control.
+// Access is restricted by the socket's 0600 permissions instead of a token.
+func (s *HTTPServer) StartControlSocket(path string) error {
+	listener, err := listenUnix(path)
+	if err != nil {
+		return err
+	}
+
+	s.controlPath = path
+	s.controlServer = &http.Server{
+		Handler:           s.mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	logger.Info("Starting control socket on %s", path)
+	go func() {
+		if err := s.controlServer.Serve(listener); err != nil && err != http.ErrServerClosed {
+			logger.Error("Control socket error: %v", err)
+		}
+	}()
+
+	return nil
+}
+
+// listenUnix listens on a Unix socket that only the current user can access
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, fmt.Errorf("failed to create socket directory: %v", err)
+	}
+	// Remove a stale socket left behind by a previous run
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove stale socket %s: %v", path, err)
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", path, err)
+	}
+	// The mux behind the socket has no auth, restrict it to the owner before
+	// serving. Connecting needs write access, so until then only users the
+	// umask grants write access could get in.
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to set permissions on %s: %v", path, err)
+	}
+	return listener, nil
+}
+
+// listen opens the TCP or Unix socket listener for the configured address
+func (s *HTTPServer) listen() (net.Listener, error) {
+	if strings.HasPrefix(s.addr, unixPrefix) {
+		return listenUnix(strings.TrimPrefix(s.addr, unixPrefix))
+	}
+
+	listener, err := net.Listen("tcp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %v", s.addr, err)
+	}
+
+	if s.tlsCertFile == "" {
+		s.plainRemote = !isLoopbackAddr(listener.Addr())
+		return listener, nil
+	}
+
+	tlsConfig, err := s.tlsConfig()
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return tls.NewListener(listener, tlsConfig), nil
+}
+
+// tlsConfig builds the server TLS configuration, enabling mTLS when a client CA is set
+func (s *HTTPServer) tlsConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(s.tlsCertFile, s.tlsKeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load TLS certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if s.clientCAFile != "" {
+		caPEM, err := os.ReadFile(s.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read client CA: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPEM) {
+			return nil, fmt.Errorf("no certificates found in client CA %s", s.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return config, nil
+}
+
+// isLoopbackAddr reports whether a TCP listener address is bound to loopback only
+func isLoopbackAddr(addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	return tcpAddr.IP.IsLoopback()
+}
+
+// authenticate wraps a handler with bearer token checks when a token is configured
+func (s *HTTPServer) authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.authToken != "" {
+			token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.authToken)) != 1 {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="olm"`)
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Stop stops the HTTP server and the control socket
 func (s *HTTPServer) Stop() error {
 	logger.Info("Stopping HTTP server")
-	return s.server.Close()
+	var err error
+	if s.server != nil {
+		err = s.server.Close()
+		if strings.HasPrefix(s.addr, unixPrefix) {
+			os.Remove(strings.TrimPrefix(s.addr, unixPrefix))
+		}
+	}
+	if s.controlServer != nil {
+		if cerr := s.controlServer.Close(); err == nil {
+			err = cerr
+		}
+		os.Remove(s.controlPath)
+	}
+	return err
+}
+
+// LoadOrCreateToken reads a bearer token from path. If the file does not
+// exist, a random token is generated and written there with 0600 permissions.
+func LoadOrCreateToken(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err == nil {
+		token := strings.TrimSpace(string(data))
+		if token == "" {
+			return "", fmt.Errorf("token file %s is empty", path)
+		}
+		return token, nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", fmt.Errorf("failed to read token file: %v", err)
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := hex.EncodeToString(buf)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return "", fmt.Errorf("failed to create token directory: %v", err)
+	}
+	if err := os.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return "", fmt.Errorf("failed to write token file: %v", err)
+	}
+	logger.Info("Generated new HTTP API token in %s", path)
+
+	return token, nil
 }
 
 // GetConnectionChannel returns the channel for receiving connection requests
@@ -105,6 +442,116 @@ func (s *HTTPServer) UpdatePeerStatus(siteID int, connected bool, rtt time.Durat
 	status.LastSeen = time.Now()
 }
 
+// UpdatePeerEndpoint records the endpoint of a peer
+func (s *HTTPServer) UpdatePeerEndpoint(siteID int, endpoint string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	status, exists := s.peerStatuses[siteID]
+	if !exists {
+		status = &PeerStatus{
+			SiteID: siteID,
+		}
+		s.peerStatuses[siteID] = status
+	}
+
+	status.Endpoint = endpoint
+}
+
+// UpdatePeerPath records whether a peer is reached directly or through a relay, and which relay
+func (s *HTTPServer) UpdatePeerPath(siteID int, path string, relay string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	status, exists := s.peerStatuses[siteID]
+	if !exists {
+		status = &PeerStatus{
+			SiteID: siteID,
+		}
+		s.peerStatuses[siteID] = status
+	}
+
+	status.Path = path
+	status.Relay = relay
+}
+
+// AddEvent appends an event to the event log, dropping the oldest once it is full
+func (s *HTTPServer) AddEvent(eventType string, siteID int, message string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	if len(s.events) >= maxEvents {
+		s.events = append(s.events[:0], s.events[1:]...)
+	}
+	s.events = append(s.events, Event{
+		Time:    time.Now(),
+		Type:    eventType,
+		SiteID:  siteID,
+		Message: message,
+	})
+}
+
+// RecordMalformedMessage counts a control message that was rejected as malformed
+func (s *HTTPServer) RecordMalformedMessage(msgType string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	s.malformed[msgType]++
+}
+
+// MalformedMessages returns the number of rejected control messages by message type
+func (s *HTTPServer) MalformedMessages() map[string]int {
+	s.statusMu.RLock()
+	defer s.statusMu.RUnlock()
+
+	malformed := make(map[string]int, len(s.malformed))
+	for msgType, count := range s.malformed {
+		malformed[msgType] = count
+	}
+	return malformed
+}
+
+// RemovePeerStatus forgets the status of a removed peer
+func (s *HTTPServer) RemovePeerStatus(siteID int) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	delete(s.peerStatuses, siteID)
+}
+
+// SetState sets the session state reported by the status endpoint
+func (s *HTTPServer) SetState(state string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	s.state = state
+}
+
+// SetIdentity sets the Olm ID and endpoint of the current session
+func (s *HTTPServer) SetIdentity(id, endpoint string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	s.olmID = id
+	s.olmEndpoint = endpoint
+}
+
+// SetTunnelIP sets the tunnel IP reported by the status endpoint
+func (s *HTTPServer) SetTunnelIP(tunnelIP string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	s.tunnelIP = tunnelIP
+}
+
+// SetCachedAt records when the cached configuration in use was saved, zero when none is in use
+func (s *HTTPServer) SetCachedAt(t time.Time) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+
+	s.cachedAt = t
+}
+
 // SetConnectionStatus sets the overall connection status
 func (s *HTTPServer) SetConnectionStatus(isConnected bool) {
 	s.statusMu.Lock()
@@ -117,6 +564,7 @@ func (s *HTTPServer) SetConnectionStatus(isConnected bool) {
 	} else {
 		// Clear peer statuses when disconnected
 		s.peerStatuses = make(map[int]*PeerStatus)
+		s.tunnelIP = ""
 	}
 }
 
@@ -127,6 +575,12 @@ func (s *HTTPServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Never accept credentials in the clear from other hosts unless explicitly allowed
+	if s.plainRemote && !s.allowRemote {
+		http.Error(w, "Refusing /connect over plain TCP on a non-loopback address; use TLS or --http-allow-remote-connect", http.StatusForbidden)
+		return
+	}
+
 	var req ConnectionRequest
 	decoder := json.NewDecoder(r.Body)
 	if err := decoder.Decode(&req); err != nil {
@@ -141,7 +595,12 @@ func (s *HTTPServer) handleConnect(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Send the request to the main goroutine
-	s.connectionChan <- req
+	select {
+	case s.connectionChan <- req:
+	default:
+		http.Error(w, "Another connection request is in progress", http.StatusConflict)
+		return
+	}
 
 	// Return a success response
 	w.Header().Set("Content-Type", "application/json")
@@ -158,15 +617,29 @@ func (s *HTTPServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	peers := s.snapshotPeers()
+
 	s.statusMu.RLock()
 	defer s.statusMu.RUnlock()
 
 	resp := StatusResponse{
 		Connected:    s.isConnected,
-		PeerStatuses: s.peerStatuses,
+		ID:           s.olmID,
+		Endpoint:     s.olmEndpoint,
+		TunnelIP:     s.tunnelIP,
+		PeerStatuses: make(map[int]*PeerStatus, len(peers)),
+	}
+	if !s.cachedAt.IsZero() {
+		cachedAt := s.cachedAt
+		resp.CachedAt = &cachedAt
+	}
+	for i := range peers {
+		resp.PeerStatuses[peers[i].SiteID] = &peers[i]
 	}
 
-	if s.isConnected {
+	if s.state != "" {
+		resp.Status = s.state
+	} else if s.isConnected {
 		resp.Status = "connected"
 	} else {
 		resp.Status = "disconnected"
@@ -175,3 +648,233 @@ func (s *HTTPServer) handleStatus(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(resp)
 }
+
+// handlePeers handles the /peers endpoint
+func (s *HTTPServer) handlePeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s.snapshotPeers())
+}
+
+// snapshotPeers returns a copy of the peer statuses with their probe quality,
+// ordered by site ID
+func (s *HTTPServer) snapshotPeers() []PeerStatus {
+	var quality map[int][]PeerQuality
+	if s.controller != nil {
+		quality = s.controller.PeerQuality()
+	}
+
+	s.statusMu.RLock()
+	peers := make([]PeerStatus, 0, len(s.peerStatuses))
+	for _, status := range s.peerStatuses {
+		peer := *status
+		peer.Quality = quality[peer.SiteID]
+		peers = append(peers, peer)
+	}
+	s.statusMu.RUnlock()
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].SiteID < peers[j].SiteID
+	})
+	return peers
+}
+
+// handleEvents handles the /events endpoint. The optional since parameter
+// (RFC 3339) only returns events after that time.
+func (s *HTTPServer) handleEvents(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var since time.Time
+	if value := r.URL.Query().Get("since"); value != "" {
+		var err error
+		since, err = time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			http.Error(w, "Invalid since time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	s.statusMu.RLock()
+	events := make([]Event, 0, len(s.events))
+	for _, event := range s.events {
+		if event.Time.After(since) {
+			events = append(events, event)
+		}
+	}
+	s.statusMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// handleRoutes handles the /routes endpoint
+func (s *HTTPServer) handleRoutes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	routes := []RouteInfo{}
+	if s.controller != nil {
+		if r := s.controller.Routes(); r != nil {
+			routes = r
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(routes)
+}
+
+// handleDisconnect handles the /disconnect endpoint
+func (s *HTTPServer) handleDisconnect(w http.ResponseWriter, r *http.Request) {
+	s.handleControlAction(w, r, "disconnected", func(c Controller) error {
+		return c.Disconnect()
+	})
+}
+
+// handleReconnect handles the /reconnect endpoint
+func (s *HTTPServer) handleReconnect(w http.ResponseWriter, r *http.Request) {
+	s.handleControlAction(w, r, "reconnecting", func(c Controller) error {
+		return c.Reconnect()
+	})
+}
+
+// handleLogLevel handles the /log-level endpoint
+func (s *HTTPServer) handleLogLevel(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req LogLevelRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.handleControlAction(w, r, "log level set to "+strings.ToUpper(req.Level), func(c Controller) error {
+		return c.SetLogLevel(req.Level)
+	})
+}
+
+// handleUpgrade handles the /upgrade endpoint
+func (s *HTTPServer) handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	// Starting a binary is only allowed locally, whatever the HTTP server is bound to
+	if !s.fromControlSocket(r) {
+		http.Error(w, "Upgrades are only accepted on the control socket", http.StatusForbidden)
+		return
+	}
+
+	var req UpgradeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	s.handleControlAction(w, r, "upgrading to "+req.Binary, func(c Controller) error {
+		return c.Upgrade(req.Binary)
+	})
+}
+
+// fromControlSocket reports whether a request came in on the control socket
+func (s *HTTPServer) fromControlSocket(r *http.Request) bool {
+	addr, ok := r.Context().Value(http.LocalAddrContextKey).(net.Addr)
+	return ok && s.controlPath != "" && addr.Network() == "unix" && addr.String() == s.controlPath
+}
+
+// controlAllowed reports whether a request may change the session. Without a
+// token any local user could reach the TCP listener, so it has to come in on
+// the control socket; with one, authenticate already checked it.
+func (s *HTTPServer) controlAllowed(r *http.Request) bool {
+	return s.fromControlSocket(r) || s.authToken != ""
+}
+
+// handleTestPeer handles the /peers/{id}/test endpoint
+func (s *HTTPServer) handleTestPeer(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	siteID, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid site ID: %v", r.PathValue("id")), http.StatusBadRequest)
+		return
+	}
+
+	if s.controller == nil {
+		http.Error(w, "Control requests are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	result, err := s.controller.TestPeer(siteID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// handleTestAllPeers handles the /peers/test endpoint
+func (s *HTTPServer) handleTestAllPeers(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if s.controller == nil {
+		http.Error(w, "Control requests are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	results, err := s.controller.TestAllPeers()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(results)
+}
+
+// handleControlAction runs a POST-only controller action and writes the result
+func (s *HTTPServer) handleControlAction(w http.ResponseWriter, r *http.Request, status string, action func(Controller) error) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if !s.controlAllowed(r) {
+		http.Error(w, "Control requests need the control socket or a bearer token", http.StatusForbidden)
+		return
+	}
+
+	if s.controller == nil {
+		http.Error(w, "Control requests are not available", http.StatusServiceUnavailable)
+		return
+	}
+
+	if err := action(s.controller); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": status,
+	})
+}
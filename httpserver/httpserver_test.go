@@ -0,0 +1,239 @@
+package httpserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testToken = "secret-token"
+
+// fakeController records the control requests it receives
+type fakeController struct {
+	disconnects int
+	reconnects  int
+	level       string
+	upgrades    []string
+}
+
+func (c *fakeController) Disconnect() error              { c.disconnects++; return nil }
+func (c *fakeController) Reconnect() error               { c.reconnects++; return nil }
+func (c *fakeController) SetLogLevel(level string) error { c.level = level; return nil }
+func (c *fakeController) Routes() []RouteInfo            { return nil }
+func (c *fakeController) TestPeer(siteID int) (PeerTestResult, error) {
+	return PeerTestResult{SiteID: siteID}, nil
+}
+func (c *fakeController) TestAllPeers() ([]PeerTestResult, error) { return nil, nil }
+func (c *fakeController) PeerQuality() map[int][]PeerQuality      { return nil }
+func (c *fakeController) Upgrade(binary string) error {
+	c.upgrades = append(c.upgrades, binary)
+	return nil
+}
+
+// newTestServer returns a server with a fake controller and the handler the
+// TCP listener serves
+func newTestServer(t *testing.T, token string) (*HTTPServer, *fakeController, http.Handler) {
+	t.Helper()
+
+	s := NewHTTPServer("127.0.0.1:0")
+	controller := &fakeController{}
+	s.SetController(controller)
+	s.SetAuthToken(token)
+	return s, controller, s.authenticate(s.mux)
+}
+
+// serve runs a request through handler and returns the response status
+func serve(handler http.Handler, r *http.Request) int {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w.Code
+}
+
+// onControlSocket marks a request as received on the control socket at path
+func onControlSocket(r *http.Request, path string) *http.Request {
+	addr := &net.UnixAddr{Name: path, Net: "unix"}
+	return r.WithContext(context.WithValue(r.Context(), http.LocalAddrContextKey, addr))
+}
+
+func TestAuthenticate(t *testing.T) {
+	_, _, handler := newTestServer(t, testToken)
+
+	tests := map[string]struct {
+		header string
+		want   int
+	}{
+		"no header":    {"", http.StatusUnauthorized},
+		"wrong token":  {"Bearer other-token", http.StatusUnauthorized},
+		"wrong scheme": {"Basic " + testToken, http.StatusUnauthorized},
+		"valid token":  {"Bearer " + testToken, http.StatusOK},
+	}
+	for name, tt := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/status", nil)
+		if tt.header != "" {
+			r.Header.Set("Authorization", tt.header)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s: status = %d, want %d", name, w.Code, tt.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", name)
+		}
+	}
+}
+
+func TestConnectPlainRemote(t *testing.T) {
+	s, _, handler := newTestServer(t, "")
+	s.plainRemote = true
+
+	body := `{"id":"olm-1","secret":"s3cret","endpoint":"https://pangolin.example.com"}`
+	if code := serve(handler, httptest.NewRequest(http.MethodPost, "/connect", strings.NewReader(body))); code != http.StatusForbidden {
+		t.Fatalf("plain remote /connect: status = %d, want %d", code, http.StatusForbidden)
+	}
+	select {
+	case req := <-s.GetConnectionChannel():
+		t.Fatalf("refused request was queued: %+v", req)
+	default:
+	}
+
+	s.SetAllowRemoteConnect(true)
+	if code := serve(handler, httptest.NewRequest(http.MethodPost, "/connect", strings.NewReader(body))); code != http.StatusAccepted {
+		t.Fatalf("allowed /connect: status = %d, want %d", code, http.StatusAccepted)
+	}
+	select {
+	case req := <-s.GetConnectionChannel():
+		if req.ID != "olm-1" {
+			t.Errorf("queued ID = %q, want olm-1", req.ID)
+		}
+	default:
+		t.Fatalf("accepted request was not queued")
+	}
+}
+
+func TestControlActionGating(t *testing.T) {
+	const controlPath = "/run/olm/control.sock"
+
+	tests := []struct {
+		name    string
+		token   string
+		path    string
+		body    string
+		control bool
+		want    int
+	}{
+		{"disconnect over TCP without token", "", "/disconnect", "", false, http.StatusForbidden},
+		{"reconnect over TCP without token", "", "/reconnect", "", false, http.StatusForbidden},
+		{"log level over TCP without token", "", "/log-level", `{"level":"debug"}`, false, http.StatusForbidden},
+		{"disconnect over TCP with token", testToken, "/disconnect", "", false, http.StatusOK},
+		{"log level over TCP with token", testToken, "/log-level", `{"level":"debug"}`, false, http.StatusOK},
+		{"disconnect on control socket", "", "/disconnect", "", true, http.StatusOK},
+		{"reconnect on control socket", "", "/reconnect", "", true, http.StatusOK},
+		{"upgrade over TCP with token", testToken, "/upgrade", `{"binary":"/usr/bin/olm"}`, false, http.StatusForbidden},
+		{"upgrade on control socket", "", "/upgrade", `{"binary":"/usr/bin/olm"}`, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		s, controller, handler := newTestServer(t, tt.token)
+		s.controlPath = controlPath
+
+		r := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body))
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		if tt.control {
+			// The control socket serves the mux without authenticate
+			handler = s.mux
+			r = onControlSocket(r, controlPath)
+		}
+
+		if code := serve(handler, r); code != tt.want {
+			t.Errorf("%s: status = %d, want %d", tt.name, code, tt.want)
+		}
+		called := controller.disconnects+controller.reconnects+len(controller.upgrades) > 0 || controller.level != ""
+		if called != (tt.want == http.StatusOK) {
+			t.Errorf("%s: controller called = %v", tt.name, called)
+		}
+	}
+}
+
+func TestControlSocketOtherPath(t *testing.T) {
+	s, controller, _ := newTestServer(t, "")
+	s.controlPath = "/run/olm/control.sock"
+
+	// A Unix socket other than the control socket, e.g. --http-addr unix:...
+	r := onControlSocket(httptest.NewRequest(http.MethodPost, "/disconnect", nil), "/run/olm/http.sock")
+	if code := serve(s.mux, r); code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d", code, http.StatusForbidden)
+	}
+	if controller.disconnects != 0 {
+		t.Errorf("controller called %d times", controller.disconnects)
+	}
+}
+
+func TestStartControlSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "olm", "control.sock")
+
+	s, controller, _ := newTestServer(t, "")
+	if err := s.StartControlSocket(path); err != nil {
+		t.Fatalf("failed to start control socket: %v", err)
+	}
+	t.Cleanup(func() { s.Stop() })
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("failed to stat socket: %v", err)
+	}
+	if perm := info.Mode().Perm(); perm != 0600 {
+		t.Errorf("socket permissions = %o, want 600", perm)
+	}
+	dir, err := os.Stat(filepath.Dir(path))
+	if err != nil {
+		t.Fatalf("failed to stat socket directory: %v", err)
+	}
+	if perm := dir.Mode().Perm(); perm != 0700 {
+		t.Errorf("socket directory permissions = %o, want 700", perm)
+	}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Post("http://olm/disconnect", "application/json", nil)
+	if err != nil {
+		t.Fatalf("request over control socket failed: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if controller.disconnects != 1 {
+		t.Errorf("controller called %d times, want 1", controller.disconnects)
+	}
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want bool
+	}{
+		{&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}, true},
+		{&net.TCPAddr{IP: net.IPv6loopback}, true},
+		{&net.TCPAddr{IP: net.IPv4zero}, false},
+		{&net.TCPAddr{IP: net.IPv4(192, 168, 1, 10)}, false},
+		{&net.UnixAddr{Name: "/run/olm/http.sock", Net: "unix"}, false},
+	}
+	for _, tt := range tests {
+		if got := isLoopbackAddr(tt.addr); got != tt.want {
+			t.Errorf("isLoopbackAddr(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package httpserver
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+)
+
+// handleMetrics handles the /metrics endpoint in the Prometheus text format
+func (s *HTTPServer) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	peers := s.snapshotPeers()
+
+	s.statusMu.RLock()
+	connected := s.isConnected
+	s.statusMu.RUnlock()
+	malformed := s.MalformedMessages()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	writeMetricHeader(w, "olm_connected", "Whether olm is connected to Pangolin")
+	fmt.Fprintf(w, "olm_connected %d\n", boolValue(connected))
+
+	fmt.Fprintf(w, "# HELP olm_malformed_messages_total Control messages rejected as malformed\n# TYPE olm_malformed_messages_total counter\n")
+	msgTypes := make([]string, 0, len(malformed))
+	for msgType := range malformed {
+		msgTypes = append(msgTypes, msgType)
+	}
+	sort.Strings(msgTypes)
+	for _, msgType := range msgTypes {
+		fmt.Fprintf(w, "olm_malformed_messages_total{type=%q} %d\n", msgType, malformed[msgType])
+	}
+
+	writeMetricHeader(w, "olm_peer_connected", "Whether the peer is connected")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "olm_peer_connected{site=\"%d\"} %d\n", peer.SiteID, boolValue(peer.Connected))
+	}
+
+	writeMetricHeader(w, "olm_peer_relayed", "Whether the peer is reached through a relay")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "olm_peer_relayed{site=\"%d\"} %d\n", peer.SiteID, boolValue(peer.Path == "relay"))
+	}
+
+	writeMetricHeader(w, "olm_peer_rtt_seconds", "RTT of the last state change of the peer")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "olm_peer_rtt_seconds{site=\"%d\"} %s\n", peer.SiteID, formatFloat(peer.RTT.Seconds()))
+	}
+
+	writeMetricHeader(w, "olm_peer_probe_samples", "Monitor probes in the window")
+	writeQuality(w, peers, "olm_peer_probe_samples", func(q PeerQuality) float64 { return float64(q.Samples) })
+
+	writeMetricHeader(w, "olm_peer_loss_ratio", "Fraction of monitor probes lost in the window")
+	writeQuality(w, peers, "olm_peer_loss_ratio", func(q PeerQuality) float64 { return q.Loss })
+
+	writeMetricHeader(w, "olm_peer_uptime_ratio", "Fraction of the window the peer was up")
+	writeQuality(w, peers, "olm_peer_uptime_ratio", func(q PeerQuality) float64 { return q.Uptime })
+
+	writeMetricHeader(w, "olm_peer_jitter_seconds", "Mean difference between consecutive probe RTTs in the window")
+	writeQuality(w, peers, "olm_peer_jitter_seconds", func(q PeerQuality) float64 { return q.Jitter.Seconds() })
+
+	writeMetricHeader(w, "olm_peer_rtt_quantile_seconds", "Probe RTT quantiles in the window")
+	for _, peer := range peers {
+		for _, q := range peer.Quality {
+			for _, quantile := range []struct {
+				label string
+				value float64
+			}{
+				{"0.5", q.P50.Seconds()},
+				{"0.95", q.P95.Seconds()},
+				{"0.99", q.P99.Seconds()},
+			} {
+				fmt.Fprintf(w, "olm_peer_rtt_quantile_seconds{site=\"%d\",window=\"%s\",quantile=\"%s\"} %s\n",
+					peer.SiteID, q.Window, quantile.label, formatFloat(quantile.value))
+			}
+		}
+	}
+}
+
+// writeMetricHeader writes the HELP and TYPE lines of a gauge
+func writeMetricHeader(w io.Writer, name, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+}
+
+// writeQuality writes one gauge per peer and window
+func writeQuality(w io.Writer, peers []PeerStatus, name string, value func(PeerQuality) float64) {
+	for _, peer := range peers {
+		for _, q := range peer.Quality {
+			fmt.Fprintf(w, "%s{site=\"%d\",window=\"%s\"} %s\n", name, peer.SiteID, q.Window, formatFloat(value(q)))
+		}
+	}
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
@@ -2,27 +2,18 @@ package main
 
 import (
 	"context"
-	"encoding/json"
 	"flag"
 	"fmt"
-	"net"
 	"os"
 	"os/signal"
 	"runtime"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/fosrl/newt/logger"
-	"github.com/fosrl/newt/websocket"
 	"github.com/fosrl/olm/httpserver"
-	"github.com/fosrl/olm/peermonitor"
-	"github.com/fosrl/olm/wgtester"
-
-	"golang.zx2c4.com/wireguard/device"
-	"golang.zx2c4.com/wireguard/tun"
-
-	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
 )
 
 func main() {
@@ -33,6 +24,23 @@ func main() {
 		return
 	}
 
+	// Subcommands available on every platform
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "ctl":
+			os.Exit(runCtl(os.Args[2:]))
+		case "probe":
+			os.Exit(runProbe(os.Args[2:]))
+		case "probe-serve":
+			os.Exit(runProbeServe(os.Args[2:]))
+		case "stun-serve":
+			os.Exit(runStunServe(os.Args[2:]))
+		case "version":
+			fmt.Println(olmVersion)
+			return
+		}
+	}
+
 	// Handle service management commands on Windows
 	if runtime.GOOS == "windows" && len(os.Args) > 1 {
 		switch os.Args[1] {
@@ -118,6 +126,10 @@ func main() {
 			fmt.Println("  stop        Stop the service")
 			fmt.Println("  status      Show service status")
 			fmt.Println("  debug       Run service in debug mode")
+			fmt.Println("\nControl Commands:")
+			fmt.Println("  ctl <cmd>   Control a running olm (status, peers, disconnect, reconnect, set, routes, test, events, stats)")
+			fmt.Println("  probe       Probe a wgtester responder (olm probe <host:port>)")
+			fmt.Println("  probe-serve Run a wgtester responder")
 			fmt.Println("\nFor console mode, run without arguments or with standard flags.")
 			return
 		default:
@@ -147,15 +159,21 @@ func main() {
 		}
 	}
 
+	// Talk to a running olm over the control socket
+	if len(os.Args) > 1 && runtime.GOOS != "windows" && isCtlCommand(os.Args[1]) {
+		os.Exit(runCtl(os.Args[1:]))
+	}
+
 	// Run in console mode
-	runOlmMain(context.Background())
+	os.Exit(runOlmMain(context.Background()))
 }
 
-func runOlmMain(ctx context.Context) {
-	runOlmMainWithArgs(ctx, os.Args[1:])
+func runOlmMain(ctx context.Context) int {
+	return runOlmMainWithArgs(ctx, os.Args[1:])
 }
 
-func runOlmMainWithArgs(ctx context.Context, args []string) {
+// runOlmMainWithArgs runs olm until it is stopped and returns its exit code
+func runOlmMainWithArgs(ctx context.Context, args []string) int {
 	// Log that we've entered the main function
 	// fmt.Printf("runOlmMainWithArgs() called with args: %v\n", args)
 
@@ -169,23 +187,30 @@ func runOlmMainWithArgs(ctx context.Context, args []string) {
 		mtu           string
 		mtuInt        int
 		dns           string
-		privateKey    wgtypes.Key
 		err           error
 		logLevel      string
 		interfaceName string
 		enableHTTP    bool
 		httpAddr      string
-		testMode      bool   // Add this var for the test flag
-		testTarget    string // Add this var for test target
+		httpTokenFile string
+		httpTLSCert   string
+		httpTLSKey    string
+		httpClientCA  string
+		allowRemote   bool
+		controlSocket string
+		responderPort int
+		failbackAfter time.Duration
 		pingInterval  time.Duration
 		pingTimeout   time.Duration
 		doHolepunch   bool
-		connected     bool
+		offlineCache  bool
+		cacheDir      string
+		onTerminate   string
+		leaveTunnelUp bool
+		stateDirPath  string
+		stunServers   string
 	)
 
-	stopHolepunch = make(chan struct{})
-	stopPing = make(chan struct{})
-
 	// if PANGOLIN_ENDPOINT, OLM_ID, and OLM_SECRET are set as environment variables, they will be used as default values
 	endpoint = os.Getenv("PANGOLIN_ENDPOINT")
 	id = os.Getenv("OLM_ID")
@@ -195,9 +220,24 @@ func runOlmMainWithArgs(ctx context.Context, args []string) {
 	logLevel = os.Getenv("LOG_LEVEL")
 	interfaceName = os.Getenv("INTERFACE")
 	httpAddr = os.Getenv("HTTP_ADDR")
+	httpTokenFile = os.Getenv("HTTP_TOKEN_FILE")
+	httpTLSCert = os.Getenv("HTTP_TLS_CERT")
+	httpTLSKey = os.Getenv("HTTP_TLS_KEY")
+	httpClientCA = os.Getenv("HTTP_CLIENT_CA")
+	allowRemote = os.Getenv("HTTP_ALLOW_REMOTE_CONNECT") == "true"
+	controlSocket = os.Getenv("CONTROL_SOCKET")
+	responderPortStr := os.Getenv("PROBE_RESPONDER_PORT")
+	failbackAfterStr := os.Getenv("FAILBACK_AFTER")
 	pingIntervalStr := os.Getenv("PING_INTERVAL")
 	pingTimeoutStr := os.Getenv("PING_TIMEOUT")
 	doHolepunch = os.Getenv("HOLEPUNCH") == "true" // Default to true, can be overridden by flag
+	offlineCache = os.Getenv("OFFLINE_CACHE") == "true"
+	cacheDir = os.Getenv("CACHE_DIR")
+	stateDirPath = os.Getenv("STATE_DIR")
+	onTerminate = os.Getenv("ON_TERMINATE")
+	leaveTunnelUp = os.Getenv("LEAVE_TUNNEL_UP") == "true"
+	shutdownTimeoutStr := os.Getenv("SHUTDOWN_TIMEOUT")
+	stunServers = os.Getenv("STUN_SERVERS")
 
 	if endpoint == "" {
 		serviceFlags.StringVar(&endpoint, "endpoint", "", "Endpoint of your Pangolin server")
@@ -221,7 +261,43 @@ func runOlmMainWithArgs(ctx context.Context, args []string) {
 		serviceFlags.StringVar(&interfaceName, "interface", "olm", "Name of the WireGuard interface")
 	}
 	if httpAddr == "" {
-		serviceFlags.StringVar(&httpAddr, "http-addr", ":9452", "HTTP server address (e.g., ':9452')")
+		serviceFlags.StringVar(&httpAddr, "http-addr", "127.0.0.1:9452", "HTTP server address (e.g., '127.0.0.1:9452' or 'unix:/var/run/olm/http.sock')")
+	}
+	if httpTokenFile == "" {
+		serviceFlags.StringVar(&httpTokenFile, "http-token-file", "", "File holding the bearer token for the HTTP server (created if missing)")
+	}
+	if httpTLSCert == "" {
+		serviceFlags.StringVar(&httpTLSCert, "http-tls-cert", "", "TLS certificate file for the HTTP server")
+	}
+	if httpTLSKey == "" {
+		serviceFlags.StringVar(&httpTLSKey, "http-tls-key", "", "TLS key file for the HTTP server")
+	}
+	if httpClientCA == "" {
+		serviceFlags.StringVar(&httpClientCA, "http-client-ca", "", "CA file used to verify client certificates (enables mTLS)")
+	}
+	if controlSocket == "" {
+		serviceFlags.StringVar(&controlSocket, "control-socket", defaultControlSocket(), "Path of the control socket used by the olm CLI (empty to disable)")
+	}
+	if responderPortStr == "" {
+		serviceFlags.StringVar(&responderPortStr, "probe-responder-port", "0", "Answer wgtester probes on this port of the tunnel IP (0 to disable)")
+	}
+	if failbackAfterStr == "" {
+		serviceFlags.StringVar(&failbackAfterStr, "failback-after", "60s", "How long a relayed peer's direct path must answer before switching back (0 to disable)")
+	}
+	if stateDirPath == "" {
+		serviceFlags.StringVar(&stateDirPath, "state-dir", defaultStateDir(), "Directory of the state and lock files")
+	}
+	if cacheDir == "" {
+		serviceFlags.StringVar(&cacheDir, "cache-dir", "", "Directory of the encrypted configuration cache (default: the state directory)")
+	}
+	if onTerminate == "" {
+		serviceFlags.StringVar(&onTerminate, "on-terminate", "", "What to do when Pangolin terminates olm: exit or idle (default idle with --enable-http, exit otherwise)")
+	}
+	if shutdownTimeoutStr == "" {
+		serviceFlags.StringVar(&shutdownTimeoutStr, "shutdown-timeout", "10s", "How long shutdown may take before olm exits anyway")
+	}
+	if stunServers == "" {
+		serviceFlags.StringVar(&stunServers, "stun-servers", "", "Comma-separated STUN servers used to classify the NAT before registering (empty to disable)")
 	}
 	if pingIntervalStr == "" {
 		serviceFlags.StringVar(&pingIntervalStr, "ping-interval", "3s", "Interval for pinging the server (default 3s)")
@@ -231,11 +307,14 @@ func runOlmMainWithArgs(ctx context.Context, args []string) {
 	}
 	serviceFlags.BoolVar(&enableHTTP, "enable-http", false, "Enable HTT server for receiving connection requests")
 	serviceFlags.BoolVar(&doHolepunch, "holepunch", false, "Enable hole punching (default false)")
+	serviceFlags.BoolVar(&allowRemote, "http-allow-remote-connect", allowRemote, "Allow /connect over plain TCP on non-loopback addresses")
+	serviceFlags.BoolVar(&offlineCache, "offline-cache", offlineCache, "Cache the last configuration and bring it up while Pangolin is unreachable")
+	serviceFlags.BoolVar(&leaveTunnelUp, "leave-tunnel-up", leaveTunnelUp, "Leave the interface, address and routes in place on shutdown for a fast restart (Linux only)")
 
 	// Parse the service arguments
 	if err := serviceFlags.Parse(args); err != nil {
 		fmt.Printf("Error parsing service arguments: %v\n", err)
-		return
+		return 2
 	}
 
 	// Debug: Print final values after flag parsing
@@ -281,648 +360,233 @@ func runOlmMainWithArgs(ctx context.Context, args []string) {
 		logger.Warn("Hole punching is enabled. This is EXPERIMENTAL and may not work in all environments.")
 	}
 
-	// Handle test mode
-	if testMode {
-		if testTarget == "" {
-			logger.Fatal("Test mode requires -test-target to be set to a server:port")
-		}
-
-		logger.Info("Running in test mode, connecting to %s", testTarget)
-
-		// Create a new tester client
-		tester, err := wgtester.NewClient(testTarget)
-		if err != nil {
-			logger.Fatal("Failed to create tester client: %v", err)
-		}
-		defer tester.Close()
-
-		// Test connection with a 2-second timeout
-		connected, rtt := tester.TestConnectionWithTimeout(2 * time.Second)
-
-		if connected {
-			logger.Info("Connection test successful! RTT: %v", rtt)
-			fmt.Printf("Connection test successful! RTT: %v\n", rtt)
-			os.Exit(0)
-		} else {
-			logger.Error("Connection test failed - no response received")
-			fmt.Println("Connection test failed - no response received")
-			os.Exit(1)
-		}
-	}
-
-	var httpServer *httpserver.HTTPServer
-	if enableHTTP {
-		httpServer = httpserver.NewHTTPServer(httpAddr)
-		if err := httpServer.Start(); err != nil {
-			logger.Fatal("Failed to start HTTP server: %v", err)
-		}
-
-		// Use a goroutine to handle connection requests
-		go func() {
-			for req := range httpServer.GetConnectionChannel() {
-				logger.Info("Received connection request via HTTP: id=%s, endpoint=%s", req.ID, req.Endpoint)
-
-				// Set the connection parameters
-				id = req.ID
-				secret = req.Secret
-				endpoint = req.Endpoint
-			}
-		}()
+	shutdownTimeout, err := time.ParseDuration(shutdownTimeoutStr)
+	if err != nil || shutdownTimeout <= 0 {
+		logger.Fatal("Invalid shutdown timeout: %s", shutdownTimeoutStr)
 	}
 
-	// // Check if required parameters are missing and provide helpful guidance
-	// missingParams := []string{}
-	// if id == "" {
-	// 	missingParams = append(missingParams, "id (use -id flag or OLM_ID env var)")
-	// }
-	// if secret == "" {
-	// 	missingParams = append(missingParams, "secret (use -secret flag or OLM_SECRET env var)")
-	// }
-	// if endpoint == "" {
-	// 	missingParams = append(missingParams, "endpoint (use -endpoint flag or PANGOLIN_ENDPOINT env var)")
-	// }
-
-	// if len(missingParams) > 0 {
-	// 	logger.Error("Missing required parameters: %v", missingParams)
-	// 	logger.Error("Either provide them as command line flags or set as environment variables")
-	// 	fmt.Printf("ERROR: Missing required parameters: %v\n", missingParams)
-	// 	fmt.Printf("Please provide them as command line flags or set as environment variables\n")
-	// 	if !enableHTTP {
-	// 		logger.Error("HTTP server is disabled, cannot receive parameters via API")
-	// 		fmt.Printf("HTTP server is disabled, cannot receive parameters via API\n")
-	// 		return
-	// 	}
-	// }
-
-	// // wait until we have a client id and secret and endpoint
-	// waitCount := 0
-	// for id == "" || secret == "" || endpoint == "" {
-	// 	select {
-	// 	case <-ctx.Done():
-	// 		logger.Info("Context cancelled while waiting for credentials")
-	// 		return
-	// 	default:
-	// 		missing := []string{}
-	// 		if id == "" {
-	// 			missing = append(missing, "id")
-	// 		}
-	// 		if secret == "" {
-	// 			missing = append(missing, "secret")
-	// 		}
-	// 		if endpoint == "" {
-	// 			missing = append(missing, "endpoint")
-	// 		}
-	// 		waitCount++
-	// 		if waitCount%10 == 1 { // Log every 10 seconds instead of every second
-	// 			logger.Debug("Waiting for missing parameters: %v (waiting %d seconds)", missing, waitCount)
-	// 		}
-	// 		time.Sleep(1 * time.Second)
-	// 	}
-	// }
+	// Cleanup is registered as things start and runs in reverse on exit
+	sd := newShutdown("Olm")
 
-	// parse the mtu string into an int
-	mtuInt, err = strconv.Atoi(mtu)
+	// An upgraded olm takes over the tunnel and credentials of the one it replaced
+	handoff, err := loadHandoff()
 	if err != nil {
-		logger.Fatal("Failed to parse MTU: %v", err)
+		logger.Error("Ignoring handoff from the previous olm: %v", err)
 	}
-
-	privateKey, err = wgtypes.GeneratePrivateKey()
-	if err != nil {
-		logger.Fatal("Failed to generate private key: %v", err)
+	if handoff != nil {
+		id, secret, endpoint = handoff.OlmID, handoff.Secret, handoff.Endpoint
 	}
 
-	// Create a new olm
-	olm, err := websocket.NewClient(
-		"olm",
-		id,     // CLI arg takes precedence
-		secret, // CLI arg takes precedence
-		endpoint,
-		pingInterval,
-		pingTimeout,
-	)
-	if err != nil {
-		logger.Fatal("Failed to create olm: %v", err)
+	// Only one olm may use the interface, and a crashed one may have left routes behind
+	state, previous, err := openStateDir(stateDirPath, interfaceName)
+	if _, inUse := err.(*interfaceInUseError); inUse {
+		logger.Fatal("%v", err)
+	} else if err != nil {
+		// The tunnel does not need the state directory, e.g. /var/lib/olm is not writable for this user
+		logger.Warn("Running without a state directory: %v", err)
 	}
-	endpoint = olm.GetConfig().Endpoint // Update endpoint from config
-	id = olm.GetConfig().ID             // Update ID from config
-
-	// Create TUN device and network stack
-	var dev *device.Device
-	var wgData WgData
-	var holePunchData HolePunchData
-	var uapiListener net.Listener
-	var tdev tun.Device
-
-	sourcePort, err := FindAvailableUDPPort(49152, 65535)
-	if err != nil {
-		fmt.Printf("Error finding available port: %v\n", err)
-		os.Exit(1)
+	// The routes of a handed off tunnel are still in use, and so are those of
+	// an interface the previous olm left up
+	leftUp := handoff == nil && os.Getenv(ENV_WG_TUN_FD) == "" && tunnelLeftUp(previous)
+	if handoff == nil && !leftUp {
+		cleanupLeftovers(previous)
 	}
 
-	olm.RegisterHandler("olm/wg/holepunch", func(msg websocket.WSMessage) {
-		logger.Debug("Received message: %v", msg.Data)
-
-		jsonData, err := json.Marshal(msg.Data)
-		if err != nil {
-			logger.Info("Error marshaling data: %v", err)
-			return
-		}
-
-		if err := json.Unmarshal(jsonData, &holePunchData); err != nil {
-			logger.Info("Error unmarshaling target data: %v", err)
-			return
-		}
-
-		gerbilServerPubKey = holePunchData.ServerPubKey
-
-		go keepSendingUDPHolePunch(holePunchData.Endpoint, id, sourcePort)
-	})
-
-	// Register handlers for different message types
-	olm.RegisterHandler("olm/wg/connect", func(msg websocket.WSMessage) {
-		logger.Debug("Received message: %v", msg.Data)
-
-		if connected {
-			logger.Info("Already connected. Ignoring new connection request.")
-			return
-		}
-
-		if stopRegister != nil {
-			stopRegister()
-			stopRegister = nil
-		}
-
-		close(stopHolepunch)
-
-		// wait 10 milliseconds to ensure the previous connection is closed
-		time.Sleep(10 * time.Millisecond)
-
-		// if there is an existing tunnel then close it
-		if dev != nil {
-			logger.Info("Got new message. Closing existing tunnel!")
-			dev.Close()
-		}
-
-		jsonData, err := json.Marshal(msg.Data)
-		if err != nil {
-			logger.Info("Error marshaling data: %v", err)
-			return
-		}
-
-		if err := json.Unmarshal(jsonData, &wgData); err != nil {
-			logger.Info("Error unmarshaling target data: %v", err)
-			return
-		}
-
-		tdev, err = func() (tun.Device, error) {
-			tunFdStr := os.Getenv(ENV_WG_TUN_FD)
-
-			// if on macOS, call findUnusedUTUN to get a new utun device
-			if runtime.GOOS == "darwin" {
-				interfaceName, err := findUnusedUTUN()
-				if err != nil {
-					return nil, err
-				}
-				return tun.CreateTUN(interfaceName, mtuInt)
-			}
-
-			if tunFdStr == "" {
-				return tun.CreateTUN(interfaceName, mtuInt)
-			}
-
-			return createTUNFromFD(tunFdStr, mtuInt)
-		}()
+	if cacheDir == "" {
+		cacheDir = stateDirPath
+	}
 
-		if err != nil {
-			logger.Error("Failed to create TUN device: %v", err)
-			return
-		}
+	var httpServer *httpserver.HTTPServer
+	if enableHTTP || controlSocket != "" {
+		httpServer = httpserver.NewHTTPServer(httpAddr)
+		sd.Register("stop HTTP server and control socket", httpServer.Stop)
+	}
 
-		realInterfaceName, err2 := tdev.Name()
-		if err2 == nil {
-			interfaceName = realInterfaceName
+	if controlSocket != "" {
+		if err := httpServer.StartControlSocket(controlSocket); err != nil {
+			// The tunnel does not need the CLI, e.g. /var/run/olm is not writable for this user
+			logger.Warn("Running without the control socket: %v", err)
 		}
+	}
 
-		// open UAPI file (or use supplied fd)
-		fileUAPI, err := func() (*os.File, error) {
-			uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
-			if uapiFdStr == "" {
-				return uapiOpen(interfaceName)
-			}
-
-			// use supplied fd
-
-			fd, err := strconv.ParseUint(uapiFdStr, 10, 32)
+	if enableHTTP {
+		if httpTokenFile != "" {
+			token, err := httpserver.LoadOrCreateToken(httpTokenFile)
 			if err != nil {
-				return nil, err
+				logger.Fatal("Failed to load HTTP token: %v", err)
 			}
-
-			return os.NewFile(uintptr(fd), ""), nil
-		}()
-		if err != nil {
-			logger.Error("UAPI listen error: %v", err)
-			os.Exit(1)
-			return
+			httpServer.SetAuthToken(token)
 		}
-
-		dev = device.NewDevice(tdev, NewFixedPortBind(uint16(sourcePort)), device.NewLogger(
-			mapToWireGuardLogLevel(loggerLevel),
-			"wireguard: ",
-		))
-
-		errs := make(chan error)
-
-		uapiListener, err = uapiListen(interfaceName, fileUAPI)
-		if err != nil {
-			logger.Error("Failed to listen on uapi socket: %v", err)
-			os.Exit(1)
-		}
-
-		go func() {
-			for {
-				conn, err := uapiListener.Accept()
-				if err != nil {
-					errs <- err
-					return
-				}
-				go dev.IpcHandle(conn)
+		if httpTLSCert != "" || httpTLSKey != "" {
+			if httpTLSCert == "" || httpTLSKey == "" {
+				logger.Fatal("Both --http-tls-cert and --http-tls-key must be set to enable TLS")
 			}
-		}()
-
-		logger.Info("UAPI listener started")
-
-		// Bring up the device
-		err = dev.Up()
-		if err != nil {
-			logger.Error("Failed to bring up WireGuard device: %v", err)
+			httpServer.SetTLS(httpTLSCert, httpTLSKey, httpClientCA)
+		} else if httpClientCA != "" {
+			logger.Fatal("--http-client-ca requires --http-tls-cert and --http-tls-key")
 		}
-
-		// configure the interface
-		err = ConfigureInterface(realInterfaceName, wgData)
-		if err != nil {
-			logger.Error("Failed to configure interface: %v", err)
-		}
-
-		peerMonitor = peermonitor.NewPeerMonitor(
-			func(siteID int, connected bool, rtt time.Duration) {
-				if httpServer != nil {
-					httpServer.UpdatePeerStatus(siteID, connected, rtt)
-				}
-				if connected {
-					logger.Info("Peer %d is now connected (RTT: %v)", siteID, rtt)
-				} else {
-					logger.Warn("Peer %d is disconnected", siteID)
-				}
-			},
-			fixKey(privateKey.String()),
-			olm,
-			dev,
-			doHolepunch,
-		)
-
-		// loop over the sites and call ConfigurePeer for each one
-		for _, site := range wgData.Sites {
-			if httpServer != nil {
-				httpServer.UpdatePeerStatus(site.SiteId, false, 0)
-			}
-			err = ConfigurePeer(dev, site, privateKey, endpoint)
-			if err != nil {
-				logger.Error("Failed to configure peer: %v", err)
-				return
-			}
-
-			err = addRouteForServerIP(site.ServerIP, interfaceName)
-			if err != nil {
-				logger.Error("Failed to add route for peer: %v", err)
-				return
-			}
-
-			// Add routes for remote subnets
-			if err := addRoutesForRemoteSubnets(site.RemoteSubnets, interfaceName); err != nil {
-				logger.Error("Failed to add routes for remote subnets: %v", err)
-				return
-			}
-
-			logger.Info("Configured peer %s", site.PublicKey)
+		httpServer.SetAllowRemoteConnect(allowRemote)
+		if err := httpServer.Start(); err != nil {
+			logger.Fatal("Failed to start HTTP server: %v", err)
 		}
+	}
 
-		peerMonitor.Start()
+	// Check if required parameters are missing and provide helpful guidance
+	missingParams := []string{}
+	if id == "" {
+		missingParams = append(missingParams, "id (use -id flag or OLM_ID env var)")
+	}
+	if secret == "" {
+		missingParams = append(missingParams, "secret (use -secret flag or OLM_SECRET env var)")
+	}
+	if endpoint == "" {
+		missingParams = append(missingParams, "endpoint (use -endpoint flag or PANGOLIN_ENDPOINT env var)")
+	}
 
-		connected = true
+	// Only the HTTP API can deliver credentials later, the control socket cannot
+	if len(missingParams) > 0 && !enableHTTP {
+		logger.Error("Missing required parameters: %v", missingParams)
+		logger.Error("Either provide them as command line flags or set as environment variables")
+		fmt.Printf("ERROR: Missing required parameters: %v\n", missingParams)
+		fmt.Printf("Please provide them as command line flags or set as environment variables\n")
+		return 1
+	}
 
-		logger.Info("WireGuard device created.")
-	})
+	// parse the mtu string into an int
+	mtuInt, err = strconv.Atoi(mtu)
+	if err != nil {
+		logger.Fatal("Failed to parse MTU: %v", err)
+	}
 
-	olm.RegisterHandler("olm/wg/peer/update", func(msg websocket.WSMessage) {
-		logger.Debug("Received update-peer message: %v", msg.Data)
+	responderPort, err = strconv.Atoi(responderPortStr)
+	if err != nil || responderPort < 0 || responderPort > 65535 {
+		logger.Fatal("Invalid probe responder port: %s", responderPortStr)
+	}
 
-		jsonData, err := json.Marshal(msg.Data)
-		if err != nil {
-			logger.Error("Error marshaling data: %v", err)
-			return
-		}
+	failbackAfter, err = time.ParseDuration(failbackAfterStr)
+	if err != nil || failbackAfter < 0 {
+		logger.Fatal("Invalid failback delay: %s", failbackAfterStr)
+	}
 
-		var updateData UpdatePeerData
-		if err := json.Unmarshal(jsonData, &updateData); err != nil {
-			logger.Error("Error unmarshaling update data: %v", err)
-			return
+	if onTerminate == "" {
+		onTerminate = TerminateExit
+		if enableHTTP {
+			onTerminate = TerminateIdle
 		}
+	}
+	if onTerminate != TerminateExit && onTerminate != TerminateIdle {
+		logger.Fatal("Invalid terminate action: %s (exit or idle)", onTerminate)
+	}
 
-		// Convert to SiteConfig
-		siteConfig := SiteConfig{
-			SiteId:        updateData.SiteId,
-			Endpoint:      updateData.Endpoint,
-			PublicKey:     updateData.PublicKey,
-			ServerIP:      updateData.ServerIP,
-			ServerPort:    updateData.ServerPort,
-			RemoteSubnets: updateData.RemoteSubnets,
+	var stunServerList []string
+	for _, server := range strings.Split(stunServers, ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			stunServerList = append(stunServerList, server)
 		}
+	}
 
-		// Update the peer in WireGuard
-		if dev != nil {
-			// Find the existing peer to get old RemoteSubnets
-			var oldRemoteSubnets string
-			for _, site := range wgData.Sites {
-				if site.SiteId == updateData.SiteId {
-					oldRemoteSubnets = site.RemoteSubnets
-					break
-				}
-			}
-
-			if err := ConfigurePeer(dev, siteConfig, privateKey, endpoint); err != nil {
-				logger.Error("Failed to update peer: %v", err)
-				// Send error response if needed
-				return
-			}
-
-			// Remove old remote subnet routes if they changed
-			if oldRemoteSubnets != siteConfig.RemoteSubnets {
-				if err := removeRoutesForRemoteSubnets(oldRemoteSubnets); err != nil {
-					logger.Error("Failed to remove old remote subnet routes: %v", err)
-					// Continue anyway to add new routes
-				}
-
-				// Add new remote subnet routes
-				if err := addRoutesForRemoteSubnets(siteConfig.RemoteSubnets, interfaceName); err != nil {
-					logger.Error("Failed to add new remote subnet routes: %v", err)
-					return
-				}
-			}
+	config := &olmConfig{
+		mtu:           mtuInt,
+		interfaceName: interfaceName,
+		doHolepunch:   doHolepunch,
+		loggerLevel:   loggerLevel,
+		pingInterval:  pingInterval,
+		pingTimeout:   pingTimeout,
+		responderPort: responderPort,
+		failbackAfter: failbackAfter,
+		offlineCache:  offlineCache,
+		cacheDir:      cacheDir,
+		onTerminate:   onTerminate,
+		stunServers:   stunServerList,
+	}
 
-			// Update successful
-			logger.Info("Successfully updated peer for site %d", updateData.SiteId)
-			// If this is part of a WgData structure, update it
-			for i, site := range wgData.Sites {
-				if site.SiteId == updateData.SiteId {
-					wgData.Sites[i] = siteConfig
-					break
-				}
-			}
-		} else {
-			logger.Error("WireGuard device not initialized")
-		}
+	manager := newSessionManager(config, httpServer)
+	terminated := false
+	if state != nil {
+		manager.SetStateDir(state)
+		// Runs after the session is closed, so it knows whether the tunnel is gone
+		sd.Register("release state directory", func() error {
+			return state.Close(!manager.TunnelLeftUp())
+		})
+	}
+	sd.Register("close session", func() error {
+		// After a terminate the tunnel is already gone
+		manager.Shutdown(leaveTunnelUp && !terminated)
+		return nil
 	})
+	if httpServer != nil {
+		httpServer.SetController(manager)
+	}
 
-	// Handler for adding a new peer
-	olm.RegisterHandler("olm/wg/peer/add", func(msg websocket.WSMessage) {
-		logger.Debug("Received add-peer message: %v", msg.Data)
-
-		jsonData, err := json.Marshal(msg.Data)
+	if leftUp {
+		adopted, err := adoptTunnel(previous, mtuInt)
 		if err != nil {
-			logger.Error("Error marshaling data: %v", err)
-			return
-		}
-
-		var addData AddPeerData
-		if err := json.Unmarshal(jsonData, &addData); err != nil {
-			logger.Error("Error unmarshaling add data: %v", err)
-			return
-		}
-
-		// Convert to SiteConfig
-		siteConfig := SiteConfig{
-			SiteId:        addData.SiteId,
-			Endpoint:      addData.Endpoint,
-			PublicKey:     addData.PublicKey,
-			ServerIP:      addData.ServerIP,
-			ServerPort:    addData.ServerPort,
-			RemoteSubnets: addData.RemoteSubnets,
-		}
-
-		// Add the peer to WireGuard
-		if dev != nil {
-			if err := ConfigurePeer(dev, siteConfig, privateKey, endpoint); err != nil {
-				logger.Error("Failed to add peer: %v", err)
-				return
-			}
-
-			// Add route for the new peer
-			err = addRouteForServerIP(siteConfig.ServerIP, interfaceName)
-			if err != nil {
-				logger.Error("Failed to add route for new peer: %v", err)
-				return
-			}
-
-			// Add routes for remote subnets
-			if err := addRoutesForRemoteSubnets(siteConfig.RemoteSubnets, interfaceName); err != nil {
-				logger.Error("Failed to add routes for remote subnets: %v", err)
-				return
-			}
-
-			// Add successful
-			logger.Info("Successfully added peer for site %d", addData.SiteId)
-
-			// Update WgData with the new peer
-			wgData.Sites = append(wgData.Sites, siteConfig)
+			logger.Warn("Failed to adopt interface %s left up by the previous olm: %v", previous.InterfaceName, err)
+			cleanupLeftovers(previous)
 		} else {
-			logger.Error("WireGuard device not initialized")
-		}
-	})
-
-	// Handler for removing a peer
-	olm.RegisterHandler("olm/wg/peer/remove", func(msg websocket.WSMessage) {
-		logger.Debug("Received remove-peer message: %v", msg.Data)
-
-		jsonData, err := json.Marshal(msg.Data)
-		if err != nil {
-			logger.Error("Error marshaling data: %v", err)
-			return
+			manager.SetAdopted(adopted)
 		}
+	}
 
-		var removeData RemovePeerData
-		if err := json.Unmarshal(jsonData, &removeData); err != nil {
-			logger.Error("Error unmarshaling remove data: %v", err)
-			return
-		}
-
-		// Find the peer to remove
-		var peerToRemove *SiteConfig
-		var newSites []SiteConfig
-
-		for _, site := range wgData.Sites {
-			if site.SiteId == removeData.SiteId {
-				peerToRemove = &site
-			} else {
-				newSites = append(newSites, site)
+	if len(missingParams) > 0 {
+		// Start idle and wait for credentials from /connect
+		logger.Info("Missing %v, waiting for credentials via /connect", missingParams)
+		httpServer.SetState(httpserver.StateIdle)
+	} else if handoff != nil {
+		if err := manager.Resume(handoff); err != nil {
+			logger.Error("Failed to resume handed off tunnel, connecting again: %v", err)
+			if err := manager.Connect(id, secret, endpoint); err != nil {
+				logger.Fatal("%v", err)
 			}
 		}
+	} else if err := manager.Connect(id, secret, endpoint); err != nil {
+		logger.Fatal("%v", err)
+	}
 
-		if peerToRemove == nil {
-			logger.Error("Peer with site ID %d not found", removeData.SiteId)
-			return
-		}
-
-		// Remove the peer from WireGuard
-		if dev != nil {
-			if err := RemovePeer(dev, removeData.SiteId, peerToRemove.PublicKey); err != nil {
-				logger.Error("Failed to remove peer: %v", err)
-				// Send error response if needed
-				return
-			}
-
-			// Remove route for the peer
-			err = removeRouteForServerIP(peerToRemove.ServerIP)
-			if err != nil {
-				logger.Error("Failed to remove route for peer: %v", err)
-				return
-			}
+	if httpServer != nil {
+		// Use a goroutine to handle connection requests
+		go func() {
+			for req := range httpServer.GetConnectionChannel() {
+				logger.Info("Received connection request via HTTP: id=%s, endpoint=%s", req.ID, req.Endpoint)
 
-			// Remove routes for remote subnets
-			if err := removeRoutesForRemoteSubnets(peerToRemove.RemoteSubnets); err != nil {
-				logger.Error("Failed to remove routes for remote subnets: %v", err)
-				return
+				if err := manager.Connect(req.ID, req.Secret, req.Endpoint); err != nil {
+					logger.Error("Failed to connect with new credentials: %v", err)
+					httpServer.SetState(httpserver.StateDisconnected)
+				}
 			}
-
-			// Remove successful
-			logger.Info("Successfully removed peer for site %d", removeData.SiteId)
-
-			// Update WgData to remove the peer
-			wgData.Sites = newSites
-		} else {
-			logger.Error("WireGuard device not initialized")
-		}
-	})
-
-	olm.RegisterHandler("olm/wg/peer/relay", func(msg websocket.WSMessage) {
-		logger.Debug("Received relay-peer message: %v", msg.Data)
-
-		jsonData, err := json.Marshal(msg.Data)
-		if err != nil {
-			logger.Error("Error marshaling data: %v", err)
-			return
-		}
-
-		var removeData RelayPeerData
-		if err := json.Unmarshal(jsonData, &removeData); err != nil {
-			logger.Error("Error unmarshaling remove data: %v", err)
-			return
-		}
-
-		primaryRelay, err := resolveDomain(removeData.Endpoint)
-		if err != nil {
-			logger.Warn("Failed to resolve primary relay endpoint: %v", err)
-		}
-
-		peerMonitor.HandleFailover(removeData.SiteId, primaryRelay)
-	})
-
-	olm.RegisterHandler("olm/register/no-sites", func(msg websocket.WSMessage) {
-		logger.Info("Received no-sites message - no sites available for connection")
-
-		// if stopRegister != nil {
-		// 	stopRegister()
-		// 	stopRegister = nil
-		// }
-
-		// select {
-		// case <-stopHolepunch:
-		// 	// Channel already closed, do nothing
-		// default:
-		// 	close(stopHolepunch)
-		// }
-
-		logger.Info("No sites available - stopped registration and holepunch processes")
-	})
-
-	olm.RegisterHandler("olm/terminate", func(msg websocket.WSMessage) {
-		logger.Info("Received terminate message")
-		olm.Close()
-	})
-
-	olm.OnConnect(func() error {
-		logger.Info("Websocket Connected")
-
-		if httpServer != nil {
-			httpServer.SetConnectionStatus(true)
-		}
-
-		if connected {
-			logger.Debug("Already connected, skipping registration")
-			return nil
-		}
-
-		publicKey := privateKey.PublicKey()
-
-		logger.Debug("Sending registration message to server with public key: %s and relay: %v", publicKey, !doHolepunch)
-
-		stopRegister = olm.SendMessageInterval("olm/wg/register", map[string]interface{}{
-			"publicKey": publicKey.String(),
-			"relay":     !doHolepunch,
-		}, 1*time.Second)
-
-		go keepSendingPing(olm)
-
-		logger.Info("Sent registration message")
-		return nil
-	})
-
-	olm.OnTokenUpdate(func(token string) {
-		olmToken = token
-	})
-
-	// Connect to the WebSocket server
-	if err := olm.Connect(); err != nil {
-		logger.Fatal("Failed to connect to server: %v", err)
+		}()
 	}
-	defer olm.Close()
 
 	// Wait for interrupt signal or context cancellation
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 
-	select {
-	case <-sigCh:
-		logger.Info("Received interrupt signal")
-	case <-ctx.Done():
-		logger.Info("Context cancelled")
+	for {
+		select {
+		case <-sigCh:
+			logger.Info("Received interrupt signal")
+		case <-ctx.Done():
+			logger.Info("Context cancelled")
+		case <-manager.Terminated():
+			terminated = true
+		case binary := <-manager.Upgrades():
+			// Only returns if the upgrade failed and the tunnel was resumed
+			upgradeTo(manager, binary)
+			continue
+		}
+		break
 	}
 
-	select {
-	case <-stopHolepunch:
-		// Channel already closed, do nothing
-	default:
-		close(stopHolepunch)
+	if err := sd.Run(shutdownTimeout); err != nil {
+		logger.Error("%v", err)
 	}
 
-	if stopRegister != nil {
-		stopRegister()
-		stopRegister = nil
-	}
-
-	select {
-	case <-stopPing:
-		// Channel already closed
-	default:
-		close(stopPing)
-	}
+	logger.Info("runOlmMain() exiting")
+	fmt.Printf("runOlmMain() exiting\n")
 
-	if uapiListener != nil {
-		uapiListener.Close()
-	}
-	if dev != nil {
-		dev.Close()
+	if terminated {
+		return exitTerminated
 	}
 
-	logger.Info("runOlmMain() exiting")
-	fmt.Printf("runOlmMain() exiting\n")
+	return 0
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/stun"
+)
+
+// discoverNAT runs the STUN behaviour tests from the WireGuard source port, so
+// the result describes the mapping the peers will see
+func discoverNAT(servers []string, sourcePort uint16) (*stun.Result, error) {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero, Port: int(sourcePort)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to bind source port: %v", err)
+	}
+	defer conn.Close()
+
+	return stun.NewClient(conn).Discover(servers)
+}
+
+// detectNAT classifies the NAT in front of the source port before the session
+// registers, so Pangolin can choose between punching and relaying
+func (s *session) detectNAT() {
+	if len(s.config.stunServers) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	inUse := s.dev != nil
+	s.mu.Unlock()
+	if inUse {
+		// A resumed tunnel already owns the port, keep what the NAT does unknown
+		return
+	}
+
+	result, err := discoverNAT(s.config.stunServers, s.sourcePort)
+	if err != nil {
+		logger.Warn("NAT discovery failed: %v", err)
+		return
+	}
+	logger.Info("NAT type %s (mapping %s, filtering %s), public address %s",
+		result.NATType, result.Mapping, result.Filtering, result.PublicAddr)
+
+	s.mu.Lock()
+	s.nat = result
+	s.mu.Unlock()
+}
+
+// runStunServe implements "olm stun-serve", a local STUN server to test NAT discovery against
+func runStunServe(args []string) int {
+	flags := flag.NewFlagSet("stun-serve", flag.ContinueOnError)
+	primary := flags.String("primary", "127.0.0.1:3478", "Primary address of the server")
+	alternate := flags.String("alternate", "127.0.0.2:3479", "Alternate address, differing from the primary in IP and port")
+	logLevel := flags.String("log-level", "INFO", "Log level (DEBUG, INFO, WARN, ERROR, FATAL)")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+
+	logger.Init()
+	logger.GetLogger().SetLevel(parseLogLevel(*logLevel))
+
+	server, err := stun.NewServer(*primary, *alternate)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 2
+	}
+	if err := server.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer server.Stop()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+	<-sigCh
+	return 0
+}
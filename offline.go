@@ -0,0 +1,223 @@
+package main
+
+import (
+	"reflect"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/httpserver"
+)
+
+// persistUnlocked saves the configuration cache and records the tunnel in the state directory.
+// This function assumes the mutex is already held by the caller
+func (s *session) persistUnlocked() {
+	s.saveCacheUnlocked()
+	s.recordTunnelUnlocked()
+}
+
+// recordTunnelUnlocked records the tunnel IP and the routes olm added in the state directory.
+// This function assumes the mutex is already held by the caller
+func (s *session) recordTunnelUnlocked() {
+	if s.state == nil {
+		return
+	}
+
+	var serverIPs, subnets []string
+	for _, site := range s.wgData.Sites {
+		if _, ok := s.peers[site.SiteId]; !ok {
+			continue
+		}
+		if site.ServerIP != "" {
+			serverIPs = append(serverIPs, site.ServerIP)
+		}
+		subnets = append(subnets, splitSubnets(site.RemoteSubnets)...)
+	}
+
+	tunnelIP := ""
+	if s.dev != nil {
+		tunnelIP = s.wgData.TunnelIP
+	}
+	s.state.Update(func(state *runtimeState) {
+		state.OlmID = s.id
+		state.TunnelIP = tunnelIP
+		state.ServerIPs = serverIPs
+		state.Subnets = subnets
+		if tunnelIP == "" {
+			state.Relays = make(map[int]string)
+		}
+	})
+}
+
+// saveCacheUnlocked stores the configuration in use so it can be brought up offline.
+// This function assumes the mutex is already held by the caller
+func (s *session) saveCacheUnlocked() {
+	if s.cachePath == "" {
+		return
+	}
+
+	state := &cachedState{
+		Version:    cacheVersion,
+		OlmID:      s.id,
+		PrivateKey: s.privateKey.String(),
+		WgData:     s.wgData,
+		SavedAt:    time.Now(),
+	}
+	if err := writeCache(s.cachePath, s.cacheKey, state); err != nil {
+		logger.Warn("Failed to save configuration cache: %v", err)
+		return
+	}
+	s.cache = state
+}
+
+// bringUpCached brings up the tunnel from the cached configuration if olm has
+// not reached Pangolin within offlineAfter
+func (s *session) bringUpCached() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed || s.connected || s.offline || s.cache == nil || s.dev != nil {
+		return
+	}
+
+	logger.Warn("Pangolin is unreachable, bringing up %d sites from the configuration cached at %s",
+		len(s.cache.WgData.Sites), s.cache.SavedAt.Format(time.RFC3339))
+
+	// Nobody is waiting for an ack, failures are logged by the bring-up
+	if !s.bringUpUnlocked(s.cache.WgData, &ack{}) {
+		return
+	}
+
+	s.offline = true
+	s.recordTunnelUnlocked()
+	s.setState(httpserver.StateOffline)
+	if s.httpServer != nil {
+		s.httpServer.SetCachedAt(s.cache.SavedAt)
+	}
+}
+
+// reconcileUnlocked moves a tunnel brought up from the cache to the configuration
+// Pangolin sent, changing only the sites that differ. It returns false if no
+// tunnel could be created.
+// This function assumes the mutex is already held by the caller
+func (s *session) reconcileUnlocked(wgData WgData, ack *ack) bool {
+	s.offline = false
+	if s.httpServer != nil {
+		s.httpServer.SetCachedAt(time.Time{})
+	}
+
+	// A new tunnel address means a new interface, start over
+	if wgData.TunnelIP != s.wgData.TunnelIP {
+		logger.Info("Tunnel IP changed from %s to %s, recreating the cached tunnel", s.wgData.TunnelIP, wgData.TunnelIP)
+		s.closeTunnelUnlocked()
+		return s.bringUpUnlocked(wgData, ack)
+	}
+
+	wanted := make(map[int]SiteConfig)
+	for _, site := range wgData.Sites {
+		wanted[site.SiteId] = site
+	}
+
+	failed := 0
+	cached := append([]SiteConfig(nil), s.wgData.Sites...)
+	for _, site := range cached {
+		if _, ok := wanted[site.SiteId]; ok {
+			continue
+		}
+		// Nothing of a site without a peer is on the device or in the routes
+		if _, configured := s.peers[site.SiteId]; !configured {
+			s.dropSiteUnlocked(site.SiteId)
+			if s.httpServer != nil {
+				s.httpServer.RemovePeerStatus(site.SiteId)
+			}
+			continue
+		}
+		results, err := s.removePeerUnlocked(site.SiteId)
+		ack.add(results...)
+		if err != nil {
+			logger.Error("Failed to remove cached peer for site %d: %v", site.SiteId, err)
+			failed++
+			continue
+		}
+		if s.httpServer != nil {
+			s.httpServer.RemovePeerStatus(site.SiteId)
+		}
+	}
+
+	current := make(map[int]SiteConfig)
+	for _, site := range s.wgData.Sites {
+		current[site.SiteId] = site
+	}
+
+	for _, site := range wgData.Sites {
+		existing, ok := current[site.SiteId]
+		_, configured := s.peers[site.SiteId]
+		if ok && configured && reflect.DeepEqual(existing, site) {
+			continue
+		}
+
+		// A site that failed to come up offline, e.g. because its endpoint did
+		// not resolve, is set up from scratch
+		retry := ok && !configured
+		if retry {
+			s.dropSiteUnlocked(site.SiteId)
+		}
+
+		var results []AckResult
+		var err error
+		if ok && !retry {
+			results, err = s.updatePeerUnlocked(site)
+		} else {
+			results, err = s.addPeerUnlocked(site)
+		}
+		ack.add(results...)
+		if err != nil {
+			logger.Error("Failed to reconcile peer for site %d: %v", site.SiteId, err)
+			s.addEvent(httpserver.EventPeerFailed, site.SiteId, "Failed to apply configuration: "+err.Error())
+			if retry {
+				s.wgData.Sites = append(s.wgData.Sites, site)
+			}
+			failed++
+			continue
+		}
+		if s.httpServer != nil {
+			s.httpServer.UpdatePeerEndpoint(site.SiteId, site.Endpoint)
+		}
+	}
+
+	if failed > 0 {
+		ack.fail(ackErrorf(AckPartial, "failed to reconcile %d sites", failed))
+	}
+
+	// Keep the order Pangolin sent, sites that failed to apply stay as they were
+	applied := make(map[int]SiteConfig)
+	for _, site := range s.wgData.Sites {
+		applied[site.SiteId] = site
+	}
+	var sites []SiteConfig
+	for _, site := range wgData.Sites {
+		if site, ok := applied[site.SiteId]; ok {
+			sites = append(sites, site)
+			delete(applied, site.SiteId)
+		}
+	}
+	for _, site := range s.wgData.Sites {
+		if _, ok := applied[site.SiteId]; ok {
+			sites = append(sites, site)
+		}
+	}
+	s.wgData.Sites = sites
+
+	logger.Info("Reconciled cached tunnel with the configuration from Pangolin")
+	return true
+}
+
+// dropSiteUnlocked forgets the configuration of a site that has no peer.
+// This function assumes the mutex is already held by the caller
+func (s *session) dropSiteUnlocked(siteID int) {
+	for i, site := range s.wgData.Sites {
+		if site.SiteId == siteID {
+			s.wgData.Sites = append(s.wgData.Sites[:i:i], s.wgData.Sites[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,272 @@
+package peermonitor
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/wgconfig"
+	"github.com/fosrl/olm/wgtester"
+)
+
+const (
+	// PathDirect means the peer is reached on its own (hole punched) endpoint
+	PathDirect = wgconfig.PathDirect
+	// PathRelay means the peer is reached through a relay
+	PathRelay = wgconfig.PathRelay
+
+	// Longest wait between trials of a direct path that keeps failing
+	maxFailbackBackoff = 30 * time.Minute
+)
+
+// PeerPathCallback is called when a peer switches between the direct path and
+// a relay, or between relays. relay is empty on the direct path.
+type PeerPathCallback func(siteID int, path string, relay string)
+
+// SetPathCallback sets the function called when a peer changes path
+func (pm *PeerMonitor) SetPathCallback(callback PeerPathCallback) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.pathCallback = callback
+}
+
+// SetFailbackAfter changes how long the direct path of a relayed peer must
+// answer before the peer is switched back to it. 0 disables failback.
+func (pm *PeerMonitor) SetFailbackAfter(d time.Duration) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.failbackAfter = d
+}
+
+// Path returns the current path of a peer
+func (pm *PeerMonitor) Path(siteID int) string {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if path, exists := pm.paths[siteID]; exists {
+		return path
+	}
+	return PathDirect
+}
+
+// notifyPath reports a path change to the path callback
+func (pm *PeerMonitor) notifyPath(siteID int, path string, relay string) {
+	pm.mutex.Lock()
+	callback := pm.pathCallback
+	pm.mutex.Unlock()
+
+	if callback != nil {
+		callback(siteID, path, relay)
+	}
+}
+
+// directTrial is a running probe of the direct path of a relayed peer
+type directTrial struct {
+	client *wgtester.Client // Own client, the monitor's keeps probing through the tunnel
+	stop   chan struct{}
+}
+
+// startDirectProbeUnlocked starts probing the direct path of a relayed peer in
+// the background. The probes go to the site's monitor on the direct endpoint,
+// one port above WireGuard, while the peer stays on its relay.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) startDirectProbeUnlocked(siteID int, config *WireGuardConfig) {
+	if pm.failbackAfter <= 0 || !config.Spec.Endpoint.IsValid() {
+		return
+	}
+	if _, exists := pm.directTrials[siteID]; exists {
+		return
+	}
+	if _, exists := pm.failbackTimers[siteID]; exists {
+		return // Backing off
+	}
+
+	endpoint := config.Spec.Endpoint
+	addr := netip.AddrPortFrom(endpoint.Addr(), endpoint.Port()+1)
+	client, err := wgtester.NewClient(addr.String())
+	if err != nil {
+		logger.Warn("Not probing direct path to site %d: %v", siteID, err)
+		return
+	}
+	client.SetTimeout(pm.timeout)
+	client.SetMaxAttempts(1)
+	client.SetAuthKey(config.MonitorKey)
+
+	trial := &directTrial{client: client, stop: make(chan struct{})}
+	pm.directTrials[siteID] = trial
+	logger.Debug("Probing direct path to site %d at %s", siteID, addr)
+	go pm.runDirectTrial(siteID, trial, pm.interval, pm.timeout, pm.recoverThreshold, pm.failbackAfter)
+}
+
+// stopDirectProbeUnlocked stops probing the direct path of a peer and forgets its backoff.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) stopDirectProbeUnlocked(siteID int) {
+	if timer, exists := pm.failbackTimers[siteID]; exists {
+		timer.Stop()
+		delete(pm.failbackTimers, siteID)
+	}
+	if trial, exists := pm.directTrials[siteID]; exists {
+		close(trial.stop)
+		delete(pm.directTrials, siteID)
+	}
+	delete(pm.failbackBackoff, siteID)
+}
+
+// runDirectTrial probes the direct path every interval. The peer fails back
+// once successes probes in a row were answered over at least window. A lost
+// probe ends the trial.
+func (pm *PeerMonitor) runDirectTrial(siteID int, trial *directTrial, interval, timeout time.Duration, successes int, window time.Duration) {
+	defer trial.client.Close()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var firstAnswer time.Time
+	answered := 0
+	for {
+		reachable, _ := trial.client.TestConnectionWithTimeout(timeout)
+		if !reachable {
+			break
+		}
+		if answered == 0 {
+			firstAnswer = time.Now()
+		}
+		answered++
+		if answered >= successes && time.Since(firstAnswer) >= window {
+			pm.failback(siteID, trial)
+			return
+		}
+
+		select {
+		case <-trial.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if pm.directTrials[siteID] != trial {
+		return // Stopped
+	}
+	delete(pm.directTrials, siteID)
+	if config, exists := pm.configs[siteID]; exists && pm.paths[siteID] == PathRelay {
+		pm.backOffDirectUnlocked(siteID, config)
+	}
+}
+
+// backOffDirectUnlocked schedules the next trial of the direct path of a peer.
+// The wait starts at failbackAfter and doubles after every failed trial.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) backOffDirectUnlocked(siteID int, config *WireGuardConfig) {
+	backoff := pm.failbackBackoff[siteID] * 2
+	if backoff == 0 {
+		backoff = pm.failbackAfter
+	}
+	if backoff > maxFailbackBackoff {
+		backoff = maxFailbackBackoff
+	}
+	pm.failbackBackoff[siteID] = backoff
+	logger.Debug("Direct path to site %d is unreachable, trying again in %v", siteID, backoff)
+
+	var timer *time.Timer
+	timer = time.AfterFunc(backoff, func() {
+		pm.mutex.Lock()
+		defer pm.mutex.Unlock()
+
+		// timer is assigned under the mutex, so it is set by now
+		if pm.failbackTimers[siteID] != timer {
+			return // Cancelled
+		}
+		delete(pm.failbackTimers, siteID)
+		if pm.configs[siteID] == config && pm.paths[siteID] == PathRelay {
+			pm.startDirectProbeUnlocked(siteID, config)
+		}
+	})
+	pm.failbackTimers[siteID] = timer
+}
+
+// failback points a relayed peer back at its direct endpoint and tells Pangolin
+func (pm *PeerMonitor) failback(siteID int, trial *directTrial) {
+	pm.mutex.Lock()
+	if pm.directTrials[siteID] != trial {
+		pm.mutex.Unlock()
+		return // Stopped
+	}
+	delete(pm.directTrials, siteID)
+
+	config, exists := pm.configs[siteID]
+	if !exists || pm.paths[siteID] != PathRelay {
+		pm.mutex.Unlock()
+		return
+	}
+
+	endpoint := config.Spec.Endpoint
+	spec := config.Spec.WithEndpoint(endpoint, PathDirect)
+	spec.UpdateOnly = true
+	if err := pm.device.IpcSet(spec.UAPI()); err != nil {
+		logger.Error("Failed to point peer %d back at its direct endpoint: %v", siteID, err)
+		pm.backOffDirectUnlocked(siteID, config)
+		pm.mutex.Unlock()
+		return
+	}
+
+	pm.paths[siteID] = PathDirect
+	delete(pm.currentRelays, siteID)
+	delete(pm.failbackBackoff, siteID)
+	pm.mutex.Unlock()
+
+	logger.Info("Failed back peer %d to its direct endpoint %s", siteID, endpoint)
+
+	if err := pm.sendDirect(siteID, endpoint.String()); err != nil {
+		logger.Error("Failed to send direct message for site %d: %v", siteID, err)
+	}
+	pm.notifyPath(siteID, PathDirect, "")
+}
+
+// SetDirectEndpoint makes endpoint the direct path of a peer, such as a NAT
+// mapping found by hole punching, and points the peer at it. A relayed peer
+// is moved back to the direct path.
+func (pm *PeerMonitor) SetDirectEndpoint(siteID int, endpoint netip.AddrPort) error {
+	pm.mutex.Lock()
+	config, exists := pm.configs[siteID]
+	if !exists {
+		pm.mutex.Unlock()
+		return fmt.Errorf("peer %d is not monitored", siteID)
+	}
+
+	spec := config.Spec.WithEndpoint(endpoint, PathDirect)
+	spec.UpdateOnly = true
+	if err := pm.device.IpcSet(spec.UAPI()); err != nil {
+		pm.mutex.Unlock()
+		return fmt.Errorf("failed to point peer %d at %s: %v", siteID, endpoint, err)
+	}
+	config.Spec = config.Spec.WithEndpoint(endpoint, PathDirect)
+
+	wasRelayed := pm.paths[siteID] == PathRelay
+	pm.stopDirectProbeUnlocked(siteID)
+	pm.paths[siteID] = PathDirect
+	delete(pm.currentRelays, siteID)
+	pm.mutex.Unlock()
+
+	if wasRelayed {
+		pm.notifyPath(siteID, PathDirect, "")
+	}
+	return nil
+}
+
+// sendDirect tells the server a peer is back on its direct path
+func (pm *PeerMonitor) sendDirect(siteID int, endpoint string) error {
+	if pm.wsClient == nil {
+		return fmt.Errorf("websocket client is nil")
+	}
+
+	return pm.wsClient.SendMessage("olm/wg/direct", map[string]interface{}{
+		"siteId":   siteID,
+		"endpoint": endpoint,
+	})
+}
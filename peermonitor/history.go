@@ -0,0 +1,195 @@
+package peermonitor
+
+import (
+	"sort"
+	"time"
+
+	"github.com/fosrl/olm/wgtester"
+)
+
+const (
+	// Most probe results kept per site, enough for an hour at the default interval
+	historySize = 4096
+	// Probe results older than the longest window in StatsWindows are dropped
+	historyMaxAge = time.Hour
+)
+
+// StatsWindow is a rolling window over which site quality is computed
+type StatsWindow struct {
+	Name     string
+	Duration time.Duration
+}
+
+// StatsWindows are the windows reported by Stats
+var StatsWindows = []StatsWindow{
+	{Name: "1m", Duration: time.Minute},
+	{Name: "15m", Duration: 15 * time.Minute},
+	{Name: "1h", Duration: time.Hour},
+}
+
+// ProbeResult is one timestamped monitor test of a site
+type ProbeResult struct {
+	Time      time.Time
+	Connected bool          // Whether this probe was answered
+	RTT       time.Duration // RTT of the probe, 0 if it was lost
+	Up        bool          // Whether the site was considered up when the probe ran
+}
+
+// QualityStats summarizes the probes of a site over one window
+type QualityStats struct {
+	Window  string        `json:"window"`
+	Samples int           `json:"samples"`
+	Loss    float64       `json:"loss"`   // Fraction of probes lost, 0 to 1
+	Uptime  float64       `json:"uptime"` // Fraction of probes taken while the site was up, 0 to 1
+	P50     time.Duration `json:"p50"`
+	P95     time.Duration `json:"p95"`
+	P99     time.Duration `json:"p99"`
+	Jitter  time.Duration `json:"jitter"`
+}
+
+// SiteStats holds the quality of a site over every window in StatsWindows
+type SiteStats struct {
+	SiteID  int            `json:"siteId"`
+	Windows []QualityStats `json:"windows"`
+}
+
+// probeHistory is a bounded ring buffer of probe results, oldest first. It
+// grows as results arrive and forgets results older than maxAge.
+type probeHistory struct {
+	results []ProbeResult
+	size    int
+	maxAge  time.Duration
+	next    int
+	count   int
+}
+
+func newProbeHistory(size int, maxAge time.Duration) *probeHistory {
+	return &probeHistory{size: size, maxAge: maxAge}
+}
+
+func (h *probeHistory) add(result ProbeResult) {
+	if len(h.results) < h.size {
+		h.results = append(h.results, result)
+	} else {
+		h.results[h.next] = result
+	}
+	h.next = (h.next + 1) % h.size
+	if h.count < h.size {
+		h.count++
+	}
+	h.prune(result.Time)
+}
+
+// prune forgets the results older than maxAge at now
+func (h *probeHistory) prune(now time.Time) {
+	cutoff := now.Add(-h.maxAge)
+	start := (h.next - h.count + len(h.results)) % len(h.results)
+	for h.count > 0 && h.results[start].Time.Before(cutoff) {
+		start = (start + 1) % len(h.results)
+		h.count--
+	}
+}
+
+// since returns the results newer than t, oldest first
+func (h *probeHistory) since(t time.Time) []ProbeResult {
+	if h.count == 0 {
+		return nil
+	}
+	start := (h.next - h.count + len(h.results)) % len(h.results)
+	var results []ProbeResult
+	for i := 0; i < h.count; i++ {
+		result := h.results[(start+i)%len(h.results)]
+		if result.Time.After(t) {
+			results = append(results, result)
+		}
+	}
+	return results
+}
+
+// recordProbe adds a monitor test result to the history of a site
+func (pm *PeerMonitor) recordProbe(siteID int, connected bool, rtt time.Duration) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if _, exists := pm.monitors[siteID]; !exists {
+		return
+	}
+
+	history, exists := pm.histories[siteID]
+	if !exists {
+		history = newProbeHistory(historySize, historyMaxAge)
+		pm.histories[siteID] = history
+	}
+
+	if !connected {
+		rtt = 0
+	}
+	history.add(ProbeResult{
+		Time:      time.Now(),
+		Connected: connected,
+		RTT:       rtt,
+		Up:        !pm.down[siteID],
+	})
+}
+
+// History returns the probe results of a site newer than since, oldest first
+func (pm *PeerMonitor) History(siteID int, since time.Time) []ProbeResult {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	history, exists := pm.histories[siteID]
+	if !exists {
+		return nil
+	}
+	return history.since(since)
+}
+
+// Stats returns the quality of every monitored site over StatsWindows, ordered by site ID
+func (pm *PeerMonitor) Stats() []SiteStats {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	now := time.Now()
+	stats := make([]SiteStats, 0, len(pm.histories))
+	for siteID, history := range pm.histories {
+		site := SiteStats{SiteID: siteID}
+		for _, window := range StatsWindows {
+			site.Windows = append(site.Windows, summarizeProbes(window.Name, history.since(now.Add(-window.Duration))))
+		}
+		stats = append(stats, site)
+	}
+
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].SiteID < stats[j].SiteID
+	})
+	return stats
+}
+
+// summarizeProbes computes the quality of a series of probe results
+func summarizeProbes(window string, results []ProbeResult) QualityStats {
+	var rtts []time.Duration
+	up := 0
+	for _, result := range results {
+		if result.Connected {
+			rtts = append(rtts, result.RTT)
+		}
+		if result.Up {
+			up++
+		}
+	}
+
+	summary := wgtester.Summarize(len(results), rtts)
+	stats := QualityStats{
+		Window:  window,
+		Samples: len(results),
+		Loss:    summary.Loss,
+		P50:     summary.P50,
+		P95:     summary.P95,
+		P99:     summary.P99,
+		Jitter:  summary.Jitter,
+	}
+	if len(results) > 0 {
+		stats.Uptime = float64(up) / float64(len(results))
+	}
+	return stats
+}
@@ -0,0 +1,57 @@
+package peermonitor
+
+import (
+	"testing"
+	"time"
+)
+
+func TestProbeHistoryCapsSize(t *testing.T) {
+	h := newProbeHistory(4, time.Hour)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		h.add(ProbeResult{Time: start.Add(time.Duration(i) * time.Second), Connected: true})
+	}
+
+	results := h.since(time.Time{})
+	if len(results) != 4 || len(h.results) != 4 {
+		t.Fatalf("kept %d results in %d slots, want 4", len(results), len(h.results))
+	}
+	for i, result := range results {
+		if want := start.Add(time.Duration(6+i) * time.Second); !result.Time.Equal(want) {
+			t.Errorf("result %d at %v, want %v", i, result.Time, want)
+		}
+	}
+}
+
+func TestProbeHistoryDropsOldResults(t *testing.T) {
+	h := newProbeHistory(100, time.Minute)
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		h.add(ProbeResult{Time: start.Add(time.Duration(i) * 10 * time.Second)})
+	}
+	if len(h.results) != 10 {
+		t.Errorf("allocated %d slots for 10 results, want 10", len(h.results))
+	}
+
+	// The newest result is at 90s, so only those from 30s on are kept
+	results := h.since(time.Time{})
+	if len(results) != 7 {
+		t.Fatalf("kept %d results, want 7", len(results))
+	}
+	if want := start.Add(30 * time.Second); !results[0].Time.Equal(want) {
+		t.Errorf("oldest result at %v, want %v", results[0].Time, want)
+	}
+}
+
+func TestRemovePeerDropsHistory(t *testing.T) {
+	mt := newMonitorTest(t, 0, testDirect)
+	mt.pm.recordProbe(1, true, time.Millisecond)
+	if len(mt.pm.History(1, time.Time{})) != 1 {
+		t.Fatalf("probe was not recorded")
+	}
+
+	mt.pm.RemovePeer(1)
+	if history := mt.pm.History(1, time.Time{}); history != nil {
+		t.Errorf("history of a removed peer = %v, want none", history)
+	}
+}
@@ -3,11 +3,13 @@ package peermonitor
 import (
 	"context"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/fosrl/newt/logger"
 	"github.com/fosrl/newt/websocket"
+	"github.com/fosrl/olm/wgconfig"
 	"github.com/fosrl/olm/wgtester"
 	"golang.zx2c4.com/wireguard/device"
 )
@@ -15,44 +17,93 @@ import (
 // PeerMonitorCallback is the function type for connection status change callbacks
 type PeerMonitorCallback func(siteID int, connected bool, rtt time.Duration)
 
+// PeerTestResult is the outcome of an on-demand connectivity test of one peer
+type PeerTestResult struct {
+	SiteID    int
+	Connected bool
+	RTT       time.Duration
+	Attempts  int
+}
+
 // WireGuardConfig holds the WireGuard configuration for a peer
 type WireGuardConfig struct {
 	SiteID       int
 	PublicKey    string
 	ServerIP     string
 	Endpoint     string
-	PrimaryRelay string // The primary relay endpoint
+	PrimaryRelay string            // The primary relay endpoint
+	Relays       []string          // Relay endpoints (host:port) advertised for the site, probed and ranked on failover
+	Spec         wgconfig.PeerSpec // WireGuard configuration of the peer on its direct path
+	MonitorKey   []byte            // Key material for authenticated probes, nil for unauthenticated v1/v2
 }
 
 // PeerMonitor handles monitoring the connection status to multiple WireGuard peers
 type PeerMonitor struct {
-	monitors          map[int]*wgtester.Client
-	configs           map[int]*WireGuardConfig
-	callback          PeerMonitorCallback
-	mutex             sync.Mutex
-	running           bool
-	interval          time.Duration
-	timeout           time.Duration
-	maxAttempts       int
-	privateKey        string
-	wsClient          *websocket.Client
-	device            *device.Device
-	handleRelaySwitch bool // Whether to handle relay switching
+	monitors           map[int]*wgtester.Client
+	configs            map[int]*WireGuardConfig
+	callback           PeerMonitorCallback
+	mutex              sync.Mutex
+	running            bool
+	interval           time.Duration
+	timeout            time.Duration
+	maxAttempts        int
+	maxParallelTests   int // Number of peers tested at once by TestAllPeers
+	failThreshold      int
+	failWindow         int
+	recoverThreshold   int
+	minDwell           time.Duration
+	relayCooldown      time.Duration         // Minimum time between relay requests for a site
+	lastRelay          map[int]time.Time     // When a relay was last requested for each site
+	relayTimers        map[int]*time.Timer   // Relay requests deferred by the cooldown
+	down               map[int]bool          // Sites currently reported disconnected
+	failbackAfter      time.Duration         // How long the direct path must answer before a relayed peer fails back
+	paths              map[int]string        // Current path of each relayed or failed back site
+	directTrials       map[int]*directTrial  // Running probes of the direct path
+	failbackTimers     map[int]*time.Timer   // Trials of the direct path waiting for their backoff
+	failbackBackoff    map[int]time.Duration // Wait after the last failed trial of each site
+	pathCallback       PeerPathCallback
+	relays             map[string]*relayProbe // Probes of every advertised relay, by endpoint
+	currentRelays      map[int]string         // Relay each relayed site is using
+	relayProbeInterval time.Duration
+	stopRelayProbes    chan struct{}
+	histories          map[int]*probeHistory // Recent probe results of each site
+	privateKey         string
+	wsClient           *websocket.Client
+	device             *device.Device
+	handleRelaySwitch  bool // Whether to handle relay switching
 }
 
 // NewPeerMonitor creates a new peer monitor with the given callback
 func NewPeerMonitor(callback PeerMonitorCallback, privateKey string, wsClient *websocket.Client, device *device.Device, handleRelaySwitch bool) *PeerMonitor {
 	return &PeerMonitor{
-		monitors:          make(map[int]*wgtester.Client),
-		configs:           make(map[int]*WireGuardConfig),
-		callback:          callback,
-		interval:          1 * time.Second, // Default check interval
-		timeout:           2500 * time.Millisecond,
-		maxAttempts:       8,
-		privateKey:        privateKey,
-		wsClient:          wsClient,
-		device:            device,
-		handleRelaySwitch: handleRelaySwitch,
+		monitors:           make(map[int]*wgtester.Client),
+		configs:            make(map[int]*WireGuardConfig),
+		callback:           callback,
+		interval:           1 * time.Second, // Default check interval
+		timeout:            2500 * time.Millisecond,
+		maxAttempts:        8,
+		maxParallelTests:   16,
+		failThreshold:      3,
+		failWindow:         5,
+		recoverThreshold:   5,
+		minDwell:           5 * time.Second,
+		relayCooldown:      30 * time.Second,
+		lastRelay:          make(map[int]time.Time),
+		relayTimers:        make(map[int]*time.Timer),
+		down:               make(map[int]bool),
+		failbackAfter:      60 * time.Second,
+		paths:              make(map[int]string),
+		directTrials:       make(map[int]*directTrial),
+		failbackTimers:     make(map[int]*time.Timer),
+		failbackBackoff:    make(map[int]time.Duration),
+		relays:             make(map[string]*relayProbe),
+		currentRelays:      make(map[int]string),
+		relayProbeInterval: defaultRelayProbeInterval,
+		histories:          make(map[int]*probeHistory),
+		privateKey:         privateKey,
+		wsClient:           wsClient,
+		device:             device,
+		handleRelaySwitch:  handleRelaySwitch,
 	}
 }
 
@@ -95,6 +146,62 @@ func (pm *PeerMonitor) SetMaxAttempts(attempts int) {
 	}
 }
 
+// SetHandleRelaySwitch changes whether peers that go down are moved to a relay
+func (pm *PeerMonitor) SetHandleRelaySwitch(handle bool) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.handleRelaySwitch = handle
+}
+
+// SetThresholds changes when a peer is considered down (failures of the last
+// window tests failed) and up again (recoveries successful tests in a row)
+func (pm *PeerMonitor) SetThresholds(failures, window, recoveries int) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.failThreshold = failures
+	pm.failWindow = window
+	pm.recoverThreshold = recoveries
+
+	// Update thresholds for all existing monitors
+	for _, client := range pm.monitors {
+		client.SetThresholds(failures, window, recoveries)
+	}
+}
+
+// SetMinDwell changes the minimum time a peer stays up or down before a change is reported
+func (pm *PeerMonitor) SetMinDwell(d time.Duration) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.minDwell = d
+
+	// Update dwell time for all existing monitors
+	for _, client := range pm.monitors {
+		client.SetMinDwell(d)
+	}
+}
+
+// SetRelayCooldown changes the minimum time between relay requests for the same site
+func (pm *PeerMonitor) SetRelayCooldown(cooldown time.Duration) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.relayCooldown = cooldown
+}
+
+// SetMaxParallelTests changes how many peers TestAllPeers tests at once
+func (pm *PeerMonitor) SetMaxParallelTests(n int) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if n < 1 {
+		n = 1
+	}
+	pm.maxParallelTests = n
+}
+
 // AddPeer adds a new peer to monitor
 func (pm *PeerMonitor) AddPeer(siteID int, endpoint string, wgConfig *WireGuardConfig) error {
 	pm.mutex.Lock()
@@ -115,6 +222,14 @@ func (pm *PeerMonitor) AddPeer(siteID int, endpoint string, wgConfig *WireGuardC
 	client.SetPacketInterval(pm.interval)
 	client.SetTimeout(pm.timeout)
 	client.SetMaxAttempts(pm.maxAttempts)
+	client.SetThresholds(pm.failThreshold, pm.failWindow, pm.recoverThreshold)
+	client.SetMinDwell(pm.minDwell)
+	client.SetProbeCallback(func(connected bool, rtt time.Duration) {
+		pm.recordProbe(siteID, connected, rtt)
+	})
+	if wgConfig != nil {
+		client.SetAuthKey(wgConfig.MonitorKey)
+	}
 
 	// Store the client and config
 	pm.monitors[siteID] = client
@@ -143,6 +258,21 @@ func (pm *PeerMonitor) removePeerUnlocked(siteID int) {
 	client.Close()
 	delete(pm.monitors, siteID)
 	delete(pm.configs, siteID)
+	pm.clearRelayUnlocked(siteID)
+}
+
+// clearRelayUnlocked forgets the relay state of a site and cancels any deferred relay request.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) clearRelayUnlocked(siteID int) {
+	if timer, exists := pm.relayTimers[siteID]; exists {
+		timer.Stop()
+		delete(pm.relayTimers, siteID)
+	}
+	delete(pm.lastRelay, siteID)
+	delete(pm.down, siteID)
+	delete(pm.paths, siteID)
+	delete(pm.currentRelays, siteID)
+	pm.stopDirectProbeUnlocked(siteID)
 }
 
 // RemovePeer stops monitoring a peer and removes it from the monitor
@@ -151,6 +281,7 @@ func (pm *PeerMonitor) RemovePeer(siteID int) {
 	defer pm.mutex.Unlock()
 
 	pm.removePeerUnlocked(siteID)
+	delete(pm.histories, siteID)
 }
 
 // Start begins monitoring all peers
@@ -163,6 +294,7 @@ func (pm *PeerMonitor) Start() {
 	}
 
 	pm.running = true
+	pm.startRelayProbesUnlocked()
 
 	// Start monitoring all peers
 	for siteID, client := range pm.monitors {
@@ -185,39 +317,92 @@ func (pm *PeerMonitor) handleConnectionStatusChange(siteID int, status wgtester.
 		pm.callback(siteID, status.Connected, status.RTT)
 	}
 
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	if _, exists := pm.monitors[siteID]; !exists {
+		return // Removed while the test was running
+	}
+
+	pm.down[siteID] = !status.Connected
+
 	// If disconnected, handle failover
-	if !status.Connected {
-		// Send relay message to the server
-		if pm.wsClient != nil {
-			pm.sendRelay(siteID)
-		}
+	if !status.Connected && pm.wsClient != nil {
+		pm.requestRelayUnlocked(siteID)
 	}
 }
 
+// requestRelayUnlocked sends a relay message for a site unless one was sent
+// within the cooldown, in which case it is deferred until the cooldown ends.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) requestRelayUnlocked(siteID int) {
+	if _, pending := pm.relayTimers[siteID]; pending {
+		return
+	}
+
+	wait := pm.relayCooldown - time.Since(pm.lastRelay[siteID])
+	if wait <= 0 {
+		pm.lastRelay[siteID] = time.Now()
+		go pm.sendRelay(siteID)
+		return
+	}
+
+	logger.Info("Deferring relay for site %d for %v (cooldown)", siteID, wait.Round(time.Second))
+	pm.relayTimers[siteID] = time.AfterFunc(wait, func() {
+		pm.mutex.Lock()
+		defer pm.mutex.Unlock()
+
+		delete(pm.relayTimers, siteID)
+		if !pm.down[siteID] {
+			return // Recovered during the cooldown
+		}
+		pm.lastRelay[siteID] = time.Now()
+		go pm.sendRelay(siteID)
+	})
+}
+
 // handleFailover handles failover to the relay server when a peer is disconnected
 func (pm *PeerMonitor) HandleFailover(siteID int, relayEndpoint string) {
 	pm.mutex.Lock()
 	config, exists := pm.configs[siteID]
-	pm.mutex.Unlock()
-
 	if !exists {
+		pm.mutex.Unlock()
 		return
 	}
 
-	// Configure WireGuard to use the relay
-	wgConfig := fmt.Sprintf(`private_key=%s
-public_key=%s
-allowed_ip=%s/32
-endpoint=%s:21820
-persistent_keepalive_interval=1`, pm.privateKey, config.PublicKey, config.ServerIP, relayEndpoint)
+	// Prefer the best probed relay the site advertises over the one offered
+	suggested := ""
+	if relayEndpoint != "" {
+		suggested = relayEndpointWithPort(relayEndpoint)
+	}
+	relay := pm.bestRelayUnlocked(config.Relays, suggested)
+	if relay == "" {
+		pm.mutex.Unlock()
+		logger.Error("No relay available for peer %d", siteID)
+		return
+	}
 
-	err := pm.device.IpcSet(wgConfig)
-	if err != nil {
+	// Configure WireGuard to use the relay
+	if err := pm.pointAtRelayUnlocked(config, relay); err != nil {
+		pm.mutex.Unlock()
 		logger.Error("Failed to configure WireGuard device: %v\n", err)
 		return
 	}
 
-	logger.Info("Adjusted peer %d to point to relay!\n", siteID)
+	logger.Info("Adjusted peer %d to point to relay %s!\n", siteID, relay)
+
+	// Keep probing the direct path so the peer can fail back once it is stable
+	pm.paths[siteID] = PathRelay
+	pm.currentRelays[siteID] = relay
+	pm.startDirectProbeUnlocked(siteID, config)
+	pm.mutex.Unlock()
+
+	if relay != suggested {
+		if err := pm.sendRelaySelected(siteID, relay); err != nil {
+			logger.Error("Failed to send relay selection for site %d: %v", siteID, err)
+		}
+	}
+	pm.notifyPath(siteID, PathRelay, relay)
 }
 
 // sendRelay sends a relay message to the server
@@ -251,6 +436,7 @@ func (pm *PeerMonitor) Stop() {
 	}
 
 	pm.running = false
+	pm.stopRelayProbesUnlocked()
 
 	// Stop all monitors
 	for _, client := range pm.monitors {
@@ -268,57 +454,86 @@ func (pm *PeerMonitor) Close() {
 		client.StopMonitor()
 		client.Close()
 		delete(pm.monitors, siteID)
+		delete(pm.histories, siteID)
+		pm.clearRelayUnlocked(siteID)
 	}
+	pm.stopRelayProbesUnlocked()
 
 	pm.running = false
 }
 
 // TestPeer tests connectivity to a specific peer
-func (pm *PeerMonitor) TestPeer(siteID int) (bool, time.Duration, error) {
+func (pm *PeerMonitor) TestPeer(siteID int) (PeerTestResult, error) {
 	pm.mutex.Lock()
 	client, exists := pm.monitors[siteID]
+	testTimeout := pm.testTimeout()
 	pm.mutex.Unlock()
 
 	if !exists {
-		return false, 0, fmt.Errorf("peer with siteID %d not found", siteID)
+		return PeerTestResult{SiteID: siteID}, fmt.Errorf("peer with siteID %d not found", siteID)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), pm.timeout*time.Duration(pm.maxAttempts))
-	defer cancel()
-
-	connected, rtt := client.TestConnection(ctx)
-	return connected, rtt, nil
+	return testClient(siteID, client, testTimeout), nil
 }
 
-// TestAllPeers tests connectivity to all peers
-func (pm *PeerMonitor) TestAllPeers() map[int]struct {
-	Connected bool
-	RTT       time.Duration
-} {
+// TestAllPeers tests connectivity to all peers using a bounded pool of workers
+// and returns the results ordered by site ID
+func (pm *PeerMonitor) TestAllPeers() []PeerTestResult {
 	pm.mutex.Lock()
+	siteIDs := make([]int, 0, len(pm.monitors))
 	peers := make(map[int]*wgtester.Client, len(pm.monitors))
 	for siteID, client := range pm.monitors {
+		siteIDs = append(siteIDs, siteID)
 		peers[siteID] = client
 	}
+	testTimeout := pm.testTimeout()
+	workers := pm.maxParallelTests
 	pm.mutex.Unlock()
 
-	results := make(map[int]struct {
-		Connected bool
-		RTT       time.Duration
-	})
-	for siteID, client := range peers {
-		ctx, cancel := context.WithTimeout(context.Background(), pm.timeout*time.Duration(pm.maxAttempts))
-		connected, rtt := client.TestConnection(ctx)
-		cancel()
-
-		results[siteID] = struct {
-			Connected bool
-			RTT       time.Duration
-		}{
-			Connected: connected,
-			RTT:       rtt,
-		}
+	sort.Ints(siteIDs)
+	results := make([]PeerTestResult, len(siteIDs))
+
+	if workers > len(siteIDs) {
+		workers = len(siteIDs)
 	}
 
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range jobs {
+				results[i] = testClient(siteIDs[i], peers[siteIDs[i]], testTimeout)
+			}
+		}()
+	}
+
+	for i := range siteIDs {
+		jobs <- i
+	}
+	close(jobs)
+	wg.Wait()
+
 	return results
 }
+
+// testTimeout is the overall deadline of one peer test.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) testTimeout() time.Duration {
+	return pm.timeout * time.Duration(pm.maxAttempts)
+}
+
+// testClient runs a single connectivity test against a monitor client
+func testClient(siteID int, client *wgtester.Client, timeout time.Duration) PeerTestResult {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	connected, rtt, attempts := client.TestConnectionAttempts(ctx)
+	return PeerTestResult{
+		SiteID:    siteID,
+		Connected: connected,
+		RTT:       rtt,
+		Attempts:  attempts,
+	}
+}
@@ -0,0 +1,266 @@
+package peermonitor
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/fosrl/olm/wgconfig"
+	"github.com/fosrl/olm/wgtester"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// newTestDevice creates a WireGuard device on an in-memory TUN with one peer
+func newTestDevice(t *testing.T, peer wgconfig.PeerSpec) *device.Device {
+	t.Helper()
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+
+	config := wgconfig.Config{PrivateKey: &privateKey, Peers: []wgconfig.PeerSpec{peer}}
+	if err := dev.IpcSet(config.UAPI()); err != nil {
+		t.Fatalf("failed to configure device: %v", err)
+	}
+	return dev
+}
+
+// peerEndpoint returns the endpoint WireGuard has for the only peer of dev
+func peerEndpoint(t *testing.T, dev *device.Device) string {
+	t.Helper()
+
+	uapi, err := dev.IpcGet()
+	if err != nil {
+		t.Fatalf("failed to read device: %v", err)
+	}
+	for _, line := range strings.Split(uapi, "\n") {
+		if endpoint, ok := strings.CutPrefix(line, "endpoint="); ok {
+			return endpoint
+		}
+	}
+	return ""
+}
+
+// waitStatus waits for the next status reported for a site
+func waitStatus(t *testing.T, statuses <-chan bool, want bool) {
+	t.Helper()
+
+	select {
+	case connected := <-statuses:
+		if connected != want {
+			t.Fatalf("connected = %v, want %v", connected, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no status change to connected = %v", want)
+	}
+}
+
+// Direct endpoint and relay of the site used by the tests
+const (
+	testDirect = "127.0.0.1:51820"
+	testRelay  = "127.0.0.1:21820"
+)
+
+// monitorTest is a peer monitor of site 1, whose monitor is an in-process server
+type monitorTest struct {
+	server   *wgtester.Server
+	dev      *device.Device
+	pm       *PeerMonitor
+	statuses chan bool
+	paths    chan string
+}
+
+// newMonitorTest creates the monitor of site 1 with its direct path at direct
+func newMonitorTest(t *testing.T, failbackAfter time.Duration, direct string) *monitorTest {
+	t.Helper()
+
+	server := wgtester.NewServer("127.0.0.1:0")
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+
+	peerKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	spec := wgconfig.PeerSpec{
+		PublicKey:  peerKey.PublicKey(),
+		Endpoint:   netip.MustParseAddrPort(direct),
+		Path:       PathDirect,
+		AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.90.128.1/32")},
+	}
+	mt := &monitorTest{
+		server:   server,
+		dev:      newTestDevice(t, spec),
+		statuses: make(chan bool, 10),
+		paths:    make(chan string, 10),
+	}
+
+	mt.pm = NewPeerMonitor(func(siteID int, connected bool, rtt time.Duration) {
+		mt.statuses <- connected
+	}, "", nil, mt.dev, true)
+	t.Cleanup(mt.pm.Close)
+
+	mt.pm.SetInterval(50 * time.Millisecond)
+	mt.pm.SetTimeout(100 * time.Millisecond)
+	mt.pm.SetMaxAttempts(1)
+	mt.pm.SetThresholds(2, 3, 2)
+	mt.pm.SetMinDwell(0)
+	mt.pm.SetFailbackAfter(failbackAfter)
+	mt.pm.SetPathCallback(func(siteID int, path string, relay string) {
+		mt.paths <- fmt.Sprintf("%s %s", path, relay)
+	})
+
+	config := &WireGuardConfig{SiteID: 1, Endpoint: direct, Spec: spec}
+	if err := mt.pm.AddPeer(1, server.Addr().String(), config); err != nil {
+		t.Fatalf("failed to add peer: %v", err)
+	}
+	return mt
+}
+
+// waitPath waits for the next path change reported for the site
+func waitPath(t *testing.T, paths <-chan string, want string) {
+	t.Helper()
+
+	select {
+	case path := <-paths:
+		if path != want {
+			t.Fatalf("path callback = %q, want %q", path, want)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("no path change to %q", want)
+	}
+}
+
+func TestPeerMonitorFailover(t *testing.T) {
+	mt := newMonitorTest(t, 0, testDirect)
+	pm, dev, server, statuses := mt.pm, mt.dev, mt.server, mt.statuses
+	pm.Start()
+
+	waitStatus(t, statuses, true)
+
+	// Two failed probes of the last three take the peer down
+	server.Stop()
+	waitStatus(t, statuses, false)
+
+	failures := 0
+	for _, result := range pm.History(1, time.Time{}) {
+		if !result.Connected {
+			failures++
+		}
+	}
+	if failures < 2 {
+		t.Errorf("peer went down after %d failed probes, want at least 2", failures)
+	}
+
+	pm.HandleFailover(1, "127.0.0.1")
+
+	if path := pm.Path(1); path != PathRelay {
+		t.Errorf("path = %q, want %q", path, PathRelay)
+	}
+	if got := pm.Relay(1); got != testRelay {
+		t.Errorf("relay = %q, want %q", got, testRelay)
+	}
+	if got := peerEndpoint(t, dev); got != testRelay {
+		t.Errorf("device endpoint = %q, want %q", got, testRelay)
+	}
+	waitPath(t, mt.paths, PathRelay+" "+testRelay)
+}
+
+// startDirectMonitor starts a monitor like the one a site runs one port above
+// WireGuard and returns the direct endpoint it belongs to
+func startDirectMonitor(t *testing.T) (*wgtester.Server, string) {
+	t.Helper()
+
+	server := wgtester.NewServer("127.0.0.1:0")
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start direct monitor: %v", err)
+	}
+	t.Cleanup(server.Stop)
+
+	addr := server.Addr().(*net.UDPAddr).AddrPort()
+	return server, netip.AddrPortFrom(addr.Addr(), addr.Port()-1).String()
+}
+
+func TestPeerMonitorFailback(t *testing.T) {
+	const window = 300 * time.Millisecond
+	_, direct := startDirectMonitor(t)
+	mt := newMonitorTest(t, window, direct)
+
+	start := time.Now()
+	mt.pm.HandleFailover(1, testRelay)
+	waitPath(t, mt.paths, PathRelay+" "+testRelay)
+
+	// The direct path is probed on its own, the peer stays on the relay meanwhile
+	time.Sleep(window / 2)
+	if got := peerEndpoint(t, mt.dev); got != testRelay {
+		t.Errorf("device endpoint during the trial = %q, want %q", got, testRelay)
+	}
+
+	waitPath(t, mt.paths, PathDirect+" ")
+	if elapsed := time.Since(start); elapsed < window {
+		t.Errorf("failed back after %v, before the stable window of %v", elapsed, window)
+	}
+	if got := peerEndpoint(t, mt.dev); got != direct {
+		t.Errorf("device endpoint = %q, want %q", got, direct)
+	}
+	if got := mt.pm.Relay(1); got != "" {
+		t.Errorf("relay = %q, want none", got)
+	}
+}
+
+func TestPeerMonitorFailbackBacksOff(t *testing.T) {
+	const failbackAfter = 50 * time.Millisecond
+	server, direct := startDirectMonitor(t)
+	server.Stop()
+	mt := newMonitorTest(t, failbackAfter, direct)
+
+	mt.pm.HandleFailover(1, testRelay)
+	waitPath(t, mt.paths, PathRelay+" "+testRelay)
+
+	// Trials fail after one lost probe, each waits twice as long as the last
+	time.Sleep(600 * time.Millisecond)
+	mt.pm.mutex.Lock()
+	backoff := mt.pm.failbackBackoff[1]
+	mt.pm.mutex.Unlock()
+	if backoff < 2*failbackAfter {
+		t.Errorf("backoff = %v after several failed trials, want at least %v", backoff, 2*failbackAfter)
+	}
+
+	if path := mt.pm.Path(1); path != PathRelay {
+		t.Errorf("path = %q, want %q", path, PathRelay)
+	}
+	if got := peerEndpoint(t, mt.dev); got != testRelay {
+		t.Errorf("device endpoint = %q, want %q", got, testRelay)
+	}
+	select {
+	case path := <-mt.paths:
+		t.Errorf("unexpected path change to %q", path)
+	default:
+	}
+}
+
+func TestPeerMonitorFailbackStops(t *testing.T) {
+	_, direct := startDirectMonitor(t)
+	mt := newMonitorTest(t, time.Hour, direct)
+
+	mt.pm.HandleFailover(1, testRelay)
+	waitPath(t, mt.paths, PathRelay+" "+testRelay)
+
+	mt.pm.RemovePeer(1)
+	mt.pm.mutex.Lock()
+	defer mt.pm.mutex.Unlock()
+	if len(mt.pm.directTrials) != 0 || len(mt.pm.failbackTimers) != 0 {
+		t.Errorf("trials of a removed peer are still running")
+	}
+}
@@ -0,0 +1,366 @@
+package peermonitor
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/wgconfig"
+	"github.com/fosrl/olm/wgtester"
+)
+
+const (
+	// DefaultRelayPort is the WireGuard port of a relay when none is given
+	DefaultRelayPort = 21820
+
+	// How often every known relay is probed
+	defaultRelayProbeInterval = 10 * time.Second
+	// A relay losing more than this fraction of probes is not used
+	maxRelayLoss = 0.5
+	// Another relay must be at least this much faster before a relayed peer moves to it
+	relaySwitchMargin = 20 * time.Millisecond
+)
+
+// RelayStatus is the probed quality of one relay
+type RelayStatus struct {
+	Endpoint  string        `json:"endpoint"`
+	RTT       time.Duration `json:"rtt"`
+	Loss      float64       `json:"loss"`
+	Available bool          `json:"available"`
+}
+
+// relayProbe is the probe client and latest measurements of one relay
+type relayProbe struct {
+	client *wgtester.Client
+	status RelayStatus
+	probed bool // Whether the relay has been probed at least once
+}
+
+// relayEndpointWithPort adds the default relay port to a host without one
+func relayEndpointWithPort(relay string) string {
+	if _, _, err := net.SplitHostPort(relay); err == nil {
+		return relay
+	}
+	return net.JoinHostPort(relay, strconv.Itoa(DefaultRelayPort))
+}
+
+// SetRelayProbeInterval changes how often the advertised relays are probed
+func (pm *PeerMonitor) SetRelayProbeInterval(interval time.Duration) {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	pm.relayProbeInterval = interval
+}
+
+// Relays returns the probed relays, best first
+func (pm *PeerMonitor) Relays() []RelayStatus {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	relays := make([]RelayStatus, 0, len(pm.relays))
+	for _, probe := range pm.relays {
+		relays = append(relays, probe.status)
+	}
+	sortRelays(relays)
+	return relays
+}
+
+// Relay returns the relay a site is currently using, or "" if it is not relayed
+func (pm *PeerMonitor) Relay(siteID int) string {
+	pm.mutex.Lock()
+	defer pm.mutex.Unlock()
+
+	return pm.currentRelays[siteID]
+}
+
+// sortRelays orders relays by availability, then loss, then RTT
+func sortRelays(relays []RelayStatus) {
+	sort.SliceStable(relays, func(i, j int) bool {
+		a, b := relays[i], relays[j]
+		if a.Available != b.Available {
+			return a.Available
+		}
+		if a.Loss != b.Loss {
+			return a.Loss < b.Loss
+		}
+		return a.RTT < b.RTT
+	})
+}
+
+// bestRelayUnlocked returns the best probed relay among candidates, or
+// fallback if none of them is known to be available.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) bestRelayUnlocked(candidates []string, fallback string) string {
+	var statuses []RelayStatus
+	for _, candidate := range candidates {
+		if probe, exists := pm.relays[candidate]; exists && probe.probed {
+			statuses = append(statuses, probe.status)
+		}
+	}
+	sortRelays(statuses)
+
+	if len(statuses) == 0 || !statuses[0].Available {
+		return fallback
+	}
+	return statuses[0].Endpoint
+}
+
+// syncRelaysUnlocked creates probes for newly advertised relays and closes
+// probes of relays no site advertises anymore.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) syncRelaysUnlocked() {
+	wanted := make(map[string]bool)
+	for _, config := range pm.configs {
+		if config == nil {
+			continue
+		}
+		for _, relay := range config.Relays {
+			wanted[relay] = true
+		}
+	}
+
+	for endpoint, probe := range pm.relays {
+		if !wanted[endpoint] {
+			probe.client.Close()
+			delete(pm.relays, endpoint)
+		}
+	}
+
+	for endpoint := range wanted {
+		if _, exists := pm.relays[endpoint]; exists {
+			continue
+		}
+
+		// Like sites, relays answer monitor probes one port above WireGuard
+		host, portStr, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			logger.Warn("Invalid relay endpoint %s: %v", endpoint, err)
+			continue
+		}
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			logger.Warn("Invalid relay endpoint %s: %v", endpoint, err)
+			continue
+		}
+
+		client, err := wgtester.NewClient(net.JoinHostPort(host, strconv.Itoa(port+1)))
+		if err != nil {
+			logger.Warn("Failed to create probe for relay %s: %v", endpoint, err)
+			continue
+		}
+		client.SetTimeout(pm.timeout)
+		client.SetMaxAttempts(1)
+		client.SetWindowSize(10)
+
+		pm.relays[endpoint] = &relayProbe{
+			client: client,
+			status: RelayStatus{Endpoint: endpoint},
+		}
+	}
+}
+
+// startRelayProbesUnlocked starts probing the advertised relays in the background.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) startRelayProbesUnlocked() {
+	if pm.stopRelayProbes != nil {
+		return
+	}
+
+	stop := make(chan struct{})
+	pm.stopRelayProbes = stop
+	interval := pm.relayProbeInterval
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			pm.probeRelays()
+
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// stopRelayProbesUnlocked stops probing relays and closes their clients.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) stopRelayProbesUnlocked() {
+	if pm.stopRelayProbes != nil {
+		close(pm.stopRelayProbes)
+		pm.stopRelayProbes = nil
+	}
+	for endpoint, probe := range pm.relays {
+		probe.client.Close()
+		delete(pm.relays, endpoint)
+	}
+}
+
+// probeRelays measures every advertised relay once and moves relayed peers
+// off relays that degraded
+func (pm *PeerMonitor) probeRelays() {
+	pm.mutex.Lock()
+	pm.syncRelaysUnlocked()
+	probes := make(map[string]*wgtester.Client, len(pm.relays))
+	for endpoint, probe := range pm.relays {
+		probes[endpoint] = probe.client
+	}
+	timeout := pm.timeout
+	pm.mutex.Unlock()
+
+	if len(probes) == 0 {
+		return
+	}
+
+	type measurement struct {
+		connected bool
+		rtt       time.Duration
+		stats     wgtester.WindowStats
+	}
+	results := make(map[string]measurement, len(probes))
+	var resultsLock sync.Mutex
+	var wg sync.WaitGroup
+
+	for endpoint, client := range probes {
+		wg.Add(1)
+		go func(endpoint string, client *wgtester.Client) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			connected, rtt := client.TestConnection(ctx)
+			cancel()
+
+			resultsLock.Lock()
+			results[endpoint] = measurement{connected, rtt, client.WindowStats()}
+			resultsLock.Unlock()
+		}(endpoint, client)
+	}
+	wg.Wait()
+
+	pm.mutex.Lock()
+	for endpoint, result := range results {
+		probe, exists := pm.relays[endpoint]
+		if !exists || probe.client != probes[endpoint] {
+			continue
+		}
+
+		if result.connected {
+			if probe.status.RTT == 0 {
+				probe.status.RTT = result.rtt
+			} else {
+				// Smooth the RTT so a single slow probe does not reorder relays
+				probe.status.RTT = (probe.status.RTT*3 + result.rtt) / 4
+			}
+		}
+		probe.status.Loss = result.stats.Loss
+		probe.status.Available = result.stats.Received > 0 && result.stats.Loss <= maxRelayLoss
+		probe.probed = true
+	}
+	switches := pm.relaySwitchesUnlocked()
+	pm.mutex.Unlock()
+
+	for siteID, relay := range switches {
+		pm.switchRelay(siteID, relay)
+	}
+}
+
+// relaySwitchesUnlocked returns the relayed sites whose relay degraded or was
+// clearly beaten by another advertised relay, with the relay to move to.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) relaySwitchesUnlocked() map[int]string {
+	switches := make(map[int]string)
+	for siteID, current := range pm.currentRelays {
+		config, exists := pm.configs[siteID]
+		if !exists || len(config.Relays) < 2 {
+			continue
+		}
+
+		best := pm.bestRelayUnlocked(config.Relays, current)
+		if best == current {
+			continue
+		}
+
+		currentProbe, probed := pm.relays[current]
+		bestStatus := pm.relays[best].status
+		switch {
+		case !probed || !currentProbe.status.Available:
+			switches[siteID] = best
+		case bestStatus.Loss < currentProbe.status.Loss:
+			switches[siteID] = best
+		case bestStatus.Loss == currentProbe.status.Loss && currentProbe.status.RTT-bestStatus.RTT > relaySwitchMargin:
+			switches[siteID] = best
+		}
+	}
+	return switches
+}
+
+// switchRelay moves a relayed peer to another relay and tells the server
+func (pm *PeerMonitor) switchRelay(siteID int, relay string) {
+	pm.mutex.Lock()
+	config, exists := pm.configs[siteID]
+	previous, relayed := pm.currentRelays[siteID]
+	if !exists || !relayed {
+		pm.mutex.Unlock()
+		return
+	}
+
+	if err := pm.pointAtRelayUnlocked(config, relay); err != nil {
+		pm.mutex.Unlock()
+		logger.Error("Failed to move peer %d to relay %s: %v", siteID, relay, err)
+		return
+	}
+	pm.currentRelays[siteID] = relay
+	pm.mutex.Unlock()
+
+	logger.Info("Moved peer %d from relay %s to %s", siteID, previous, relay)
+
+	if err := pm.sendRelaySelected(siteID, relay); err != nil {
+		logger.Error("Failed to send relay selection for site %d: %v", siteID, err)
+	}
+	pm.notifyPath(siteID, PathRelay, relay)
+}
+
+// RelayEndpoints normalizes advertised relays to host:port, adding the default
+// relay port where none is given
+func RelayEndpoints(relays []string) []string {
+	endpoints := make([]string, 0, len(relays))
+	for _, relay := range relays {
+		if relay != "" {
+			endpoints = append(endpoints, relayEndpointWithPort(relay))
+		}
+	}
+	return endpoints
+}
+
+// pointAtRelayUnlocked configures WireGuard to reach a peer through a relay.
+// This function assumes the mutex is already held by the caller
+func (pm *PeerMonitor) pointAtRelayUnlocked(config *WireGuardConfig, relay string) error {
+	endpoint, err := wgconfig.ParseEndpoint(relay)
+	if err != nil {
+		return err
+	}
+
+	// Only the endpoint changes, allowed IPs including remote subnets are kept
+	spec := config.Spec.WithEndpoint(endpoint, PathRelay)
+	spec.UpdateOnly = true
+	return pm.device.IpcSet(spec.UAPI())
+}
+
+// sendRelaySelected tells the server which relay a peer is using
+func (pm *PeerMonitor) sendRelaySelected(siteID int, relay string) error {
+	if pm.wsClient == nil {
+		return fmt.Errorf("websocket client is nil")
+	}
+
+	return pm.wsClient.SendMessage("olm/wg/relay/selected", map[string]interface{}{
+		"siteId": siteID,
+		"relay":  relay,
+	})
+}
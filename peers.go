@@ -0,0 +1,305 @@
+package main
+
+import (
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/wgconfig"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// peerTx is a peer mutation spanning the WireGuard device, OS routes and the
+// peer monitor. Every completed step records how to undo it, so a failed step
+// can restore the state from before the mutation.
+type peerTx struct {
+	siteID  int
+	undo    []txStep
+	results []AckResult
+}
+
+type txStep struct {
+	name   string
+	undo   func() error
+	result int // Index of the step in results
+}
+
+// do runs a step and remembers its compensating action, which may be nil. A
+// failure is returned with code, the olm/ack code of the step.
+func (tx *peerTx) do(code string, name string, apply func() error, undo func() error) error {
+	if err := apply(); err != nil {
+		tx.results = append(tx.results, AckResult{SiteID: tx.siteID, Step: name, Error: err.Error()})
+		return ackErrorf(code, "failed to %s: %v", name, err)
+	}
+
+	tx.results = append(tx.results, AckResult{SiteID: tx.siteID, Step: name, Success: true})
+	if undo != nil {
+		tx.undo = append(tx.undo, txStep{name: name, undo: undo, result: len(tx.results) - 1})
+	}
+	return nil
+}
+
+// rollback undoes the completed steps, newest first
+func (tx *peerTx) rollback() {
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		step := tx.undo[i]
+		if err := step.undo(); err != nil {
+			logger.Error("Failed to undo %s for site %d: %v", step.name, tx.siteID, err)
+			continue
+		}
+		tx.results[step.result].RolledBack = true
+	}
+	tx.undo = nil
+}
+
+// addRoutes adds the server IP route and the remote subnet routes of a site
+func (tx *peerTx) addRoutes(serverIP string, subnets []string, interfaceName string) error {
+	if serverIP != "" {
+		if err := tx.do(AckRouteFailed, "add route for server IP "+serverIP,
+			func() error { return addRouteForServerIP(serverIP, interfaceName) },
+			func() error { return removeRouteForServerIP(serverIP) }); err != nil {
+			return err
+		}
+	}
+
+	for _, subnet := range subnets {
+		subnet := subnet
+		if err := tx.do(AckRouteFailed, "add route for remote subnet "+subnet,
+			func() error { return addRouteForSubnet(subnet, interfaceName) },
+			func() error { return removeRouteForSubnet(subnet) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeRoutes removes the server IP route and the remote subnet routes of a site
+func (tx *peerTx) removeRoutes(serverIP string, subnets []string, interfaceName string) error {
+	if serverIP != "" {
+		if err := tx.do(AckRouteFailed, "remove route for server IP "+serverIP,
+			func() error { return removeRouteForServerIP(serverIP) },
+			func() error { return addRouteForServerIP(serverIP, interfaceName) }); err != nil {
+			return err
+		}
+	}
+
+	for _, subnet := range subnets {
+		subnet := subnet
+		if err := tx.do(AckRouteFailed, "remove route for remote subnet "+subnet,
+			func() error { return removeRouteForSubnet(subnet) },
+			func() error { return addRouteForSubnet(subnet, interfaceName) }); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// subnetDiff returns the subnets only in a and the subnets only in b
+func subnetDiff(a, b string) (onlyA, onlyB []string) {
+	inA := make(map[string]bool)
+	for _, subnet := range splitSubnets(a) {
+		inA[subnet] = true
+	}
+	inB := make(map[string]bool)
+	for _, subnet := range splitSubnets(b) {
+		inB[subnet] = true
+		if !inA[subnet] {
+			onlyB = append(onlyB, subnet)
+		}
+	}
+	for _, subnet := range splitSubnets(a) {
+		if !inB[subnet] {
+			onlyA = append(onlyA, subnet)
+		}
+	}
+	return onlyA, onlyB
+}
+
+// addPeerUnlocked adds a site to the device, routes and monitor, rolling back on failure.
+// A site that is already configured is rejected, it has to be updated instead.
+// This function assumes the mutex is already held by the caller
+func (s *session) addPeerUnlocked(site SiteConfig) ([]AckResult, error) {
+	if _, exists := s.peers[site.SiteId]; exists {
+		return nil, ackErrorf(AckConflict, "peer with site ID %d already exists", site.SiteId)
+	}
+
+	peer, err := preparePeer(site, s.monitor != nil)
+	if err != nil {
+		return nil, err
+	}
+	primaryRelay := resolvePrimaryRelay(s.monitor, s.endpoint)
+
+	tx := &peerTx{siteID: site.SiteId}
+	err = s.runPeerTx(tx, func() error {
+		if err := tx.do(AckWireGuardFailed, "configure WireGuard peer",
+			func() error { return applyPeer(s.dev, peer, s.privateKey) },
+			func() error { return removeDevicePeer(s.dev, peer.spec.PublicKey) }); err != nil {
+			return err
+		}
+
+		if err := tx.addRoutes(site.ServerIP, splitSubnets(site.RemoteSubnets), s.interfaceName); err != nil {
+			return err
+		}
+
+		return tx.do(AckMonitorFailed, "start monitoring",
+			func() error { return monitorPeer(s.monitor, peer, primaryRelay) },
+			func() error { return stopMonitoringPeer(s.monitor, site.SiteId) })
+	})
+	if err != nil {
+		return tx.results, err
+	}
+
+	s.peers[site.SiteId] = peer
+	s.wgData.Sites = append(s.wgData.Sites, site)
+	return tx.results, nil
+}
+
+// updatePeerUnlocked moves a site to a new configuration, rolling back on failure.
+// This function assumes the mutex is already held by the caller
+func (s *session) updatePeerUnlocked(site SiteConfig) ([]AckResult, error) {
+	peer, err := preparePeer(site, s.monitor != nil)
+	if err != nil {
+		return nil, err
+	}
+	primaryRelay := resolvePrimaryRelay(s.monitor, s.endpoint)
+
+	index := -1
+	var old SiteConfig
+	for i, existing := range s.wgData.Sites {
+		if existing.SiteId == site.SiteId {
+			index = i
+			old = existing
+			break
+		}
+	}
+	previous := s.peers[site.SiteId]
+
+	tx := &peerTx{siteID: site.SiteId}
+	err = s.runPeerTx(tx, func() error {
+		if err := tx.do(AckWireGuardFailed, "configure WireGuard peer",
+			func() error { return applyPeer(s.dev, peer, s.privateKey) },
+			func() error { return s.restoreDevicePeer(peer.spec.PublicKey, previous) }); err != nil {
+			return err
+		}
+
+		// A new public key makes a new WireGuard peer, so the old one has to go
+		if previous != nil && previous.spec.PublicKey != peer.spec.PublicKey {
+			if err := tx.do(AckWireGuardFailed, "remove previous WireGuard peer",
+				func() error { return removeDevicePeer(s.dev, previous.spec.PublicKey) },
+				func() error { return applyPeer(s.dev, previous, s.privateKey) }); err != nil {
+				return err
+			}
+		}
+
+		// Add the new routes before removing the old ones so traffic keeps flowing
+		removedSubnets, addedSubnets := subnetDiff(old.RemoteSubnets, site.RemoteSubnets)
+		addedServerIP, removedServerIP := site.ServerIP, old.ServerIP
+		if index >= 0 && old.ServerIP == site.ServerIP {
+			addedServerIP, removedServerIP = "", ""
+		}
+		if err := tx.addRoutes(addedServerIP, addedSubnets, s.interfaceName); err != nil {
+			return err
+		}
+		if err := tx.removeRoutes(removedServerIP, removedSubnets, s.interfaceName); err != nil {
+			return err
+		}
+
+		return tx.do(AckMonitorFailed, "update monitoring",
+			func() error { return monitorPeer(s.monitor, peer, primaryRelay) },
+			func() error {
+				if previous == nil {
+					return stopMonitoringPeer(s.monitor, site.SiteId)
+				}
+				return monitorPeer(s.monitor, previous, primaryRelay)
+			})
+	})
+	if err != nil {
+		return tx.results, err
+	}
+
+	s.peers[site.SiteId] = peer
+	if index >= 0 {
+		s.wgData.Sites[index] = site
+	} else {
+		s.wgData.Sites = append(s.wgData.Sites, site)
+	}
+	return tx.results, nil
+}
+
+// removePeerUnlocked removes a site from the device, routes and monitor, rolling back on failure.
+// This function assumes the mutex is already held by the caller
+func (s *session) removePeerUnlocked(siteID int) ([]AckResult, error) {
+	index := -1
+	var site SiteConfig
+	for i, existing := range s.wgData.Sites {
+		if existing.SiteId == siteID {
+			index = i
+			site = existing
+			break
+		}
+	}
+	if index < 0 {
+		return nil, ackErrorf(AckNotFound, "peer with site ID %d not found", siteID)
+	}
+
+	publicKey, err := wgconfig.ParseKey(site.PublicKey)
+	if err != nil {
+		return nil, ackErrorf(AckInvalidConfig, "invalid public key for site %d: %v", siteID, err)
+	}
+	previous := s.peers[siteID]
+	primaryRelay := resolvePrimaryRelay(s.monitor, s.endpoint)
+
+	tx := &peerTx{siteID: siteID}
+	err = s.runPeerTx(tx, func() error {
+		if err := tx.do(AckWireGuardFailed, "remove WireGuard peer",
+			func() error { return removeDevicePeer(s.dev, publicKey) },
+			func() error { return s.restoreDevicePeer(publicKey, previous) }); err != nil {
+			return err
+		}
+
+		if err := tx.removeRoutes(site.ServerIP, splitSubnets(site.RemoteSubnets), s.interfaceName); err != nil {
+			return err
+		}
+
+		return tx.do(AckMonitorFailed, "stop monitoring",
+			func() error { return stopMonitoringPeer(s.monitor, siteID) },
+			func() error {
+				if previous == nil {
+					return nil
+				}
+				return monitorPeer(s.monitor, previous, primaryRelay)
+			})
+	})
+	if err != nil {
+		return tx.results, err
+	}
+
+	delete(s.peers, siteID)
+	if remote, ok := s.punched[siteID]; ok {
+		s.bind.RemoveSocket(remote)
+		delete(s.punched, siteID)
+	}
+	s.wgData.Sites = append(s.wgData.Sites[:index:index], s.wgData.Sites[index+1:]...)
+	return tx.results, nil
+}
+
+// runPeerTx runs the steps of a peer mutation and rolls them back if one fails
+func (s *session) runPeerTx(tx *peerTx, steps func() error) error {
+	if err := steps(); err != nil {
+		logger.Warn("Peer change for site %d failed, rolling back: %v", tx.siteID, err)
+		tx.rollback()
+		return err
+	}
+	return nil
+}
+
+// restoreDevicePeer undoes configuring publicKey on the device: the peer is
+// removed unless it is the previous peer, which is put back as it was
+func (s *session) restoreDevicePeer(publicKey wgtypes.Key, previous *preparedPeer) error {
+	if previous == nil || previous.spec.PublicKey != publicKey {
+		if err := removeDevicePeer(s.dev, publicKey); err != nil {
+			return err
+		}
+	}
+	if previous == nil {
+		return nil
+	}
+	return applyPeer(s.dev, previous, s.privateKey)
+}
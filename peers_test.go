@@ -0,0 +1,222 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun/tuntest"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// newTestSession returns a session whose tunnel is a WireGuard device on an in-memory TUN
+func newTestSession(t *testing.T) *session {
+	t.Helper()
+
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	dev := device.NewDevice(tuntest.NewChannelTUN().TUN(), conn.NewDefaultBind(), device.NewLogger(device.LogLevelSilent, ""))
+	t.Cleanup(dev.Close)
+
+	return &session{
+		dev:        dev,
+		privateKey: privateKey,
+		peers:      make(map[int]*preparedPeer),
+	}
+}
+
+// testSite returns the configuration of a site with a fresh key
+func testSite(t *testing.T, siteID int, remoteSubnets string) SiteConfig {
+	t.Helper()
+
+	key, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	return SiteConfig{
+		SiteId:        siteID,
+		Endpoint:      "127.0.0.1:51820",
+		PublicKey:     key.PublicKey().String(),
+		ServerIP:      "100.90.128.1",
+		ServerPort:    51820,
+		RemoteSubnets: remoteSubnets,
+	}
+}
+
+// prepare builds the peer of a site, failing the test on error
+func prepare(t *testing.T, site SiteConfig) *preparedPeer {
+	t.Helper()
+
+	peer, err := preparePeer(site, false)
+	if err != nil {
+		t.Fatalf("failed to prepare site %d: %v", site.SiteId, err)
+	}
+	return peer
+}
+
+// devicePeers returns the allowed IPs of every peer on the device, by public key
+func devicePeers(t *testing.T, dev *device.Device) map[string][]string {
+	t.Helper()
+
+	uapi, err := dev.IpcGet()
+	if err != nil {
+		t.Fatalf("failed to read device: %v", err)
+	}
+	peers := make(map[string][]string)
+	current := ""
+	for _, line := range strings.Split(uapi, "\n") {
+		key, value, _ := strings.Cut(line, "=")
+		switch key {
+		case "public_key":
+			current = value
+			peers[current] = nil
+		case "allowed_ip":
+			peers[current] = append(peers[current], value)
+		}
+	}
+	for _, allowedIPs := range peers {
+		sort.Strings(allowedIPs)
+	}
+	return peers
+}
+
+// routeTable stands in for the OS routing table in route steps
+type routeTable map[string]bool
+
+func (r routeTable) add(tx *peerTx, subnet string, fail error) error {
+	return tx.do(AckRouteFailed, "add route for remote subnet "+subnet,
+		func() error {
+			if fail != nil {
+				return fail
+			}
+			r[subnet] = true
+			return nil
+		},
+		func() error {
+			delete(r, subnet)
+			return nil
+		})
+}
+
+func TestPeerTxRollbackRouteFailure(t *testing.T) {
+	s := newTestSession(t)
+	peer := prepare(t, testSite(t, 1, "10.1.0.0/24,10.2.0.0/24"))
+	routes := routeTable{"192.168.0.0/24": true}
+
+	// A new peer is applied, then the second of its routes fails
+	tx := &peerTx{siteID: 1}
+	err := s.runPeerTx(tx, func() error {
+		if err := tx.do(AckWireGuardFailed, "configure WireGuard peer",
+			func() error { return applyPeer(s.dev, peer, s.privateKey) },
+			func() error { return s.restoreDevicePeer(peer.spec.PublicKey, nil) }); err != nil {
+			return err
+		}
+		if err := routes.add(tx, "10.1.0.0/24", nil); err != nil {
+			return err
+		}
+		return routes.add(tx, "10.2.0.0/24", errors.New("no such device"))
+	})
+
+	if code := ackCode(err); code != AckRouteFailed {
+		t.Fatalf("error code = %q (%v), want %q", code, err, AckRouteFailed)
+	}
+	if peers := devicePeers(t, s.dev); len(peers) != 0 {
+		t.Errorf("device peers after rollback = %v, want none", peers)
+	}
+	if len(routes) != 1 || !routes["192.168.0.0/24"] {
+		t.Errorf("routes after rollback = %v, want only 192.168.0.0/24", routes)
+	}
+
+	want := []AckResult{
+		{SiteID: 1, Step: "configure WireGuard peer", Success: true, RolledBack: true},
+		{SiteID: 1, Step: "add route for remote subnet 10.1.0.0/24", Success: true, RolledBack: true},
+		{SiteID: 1, Step: "add route for remote subnet 10.2.0.0/24", Error: "no such device"},
+	}
+	if len(tx.results) != len(want) {
+		t.Fatalf("results = %+v, want %+v", tx.results, want)
+	}
+	for i := range want {
+		if tx.results[i] != want[i] {
+			t.Errorf("result %d = %+v, want %+v", i, tx.results[i], want[i])
+		}
+	}
+}
+
+func TestPeerTxRollbackUAPIFailure(t *testing.T) {
+	s := newTestSession(t)
+	site := testSite(t, 1, "10.1.0.0/24")
+	previous := prepare(t, site)
+	if err := applyPeer(s.dev, previous, s.privateKey); err != nil {
+		t.Fatalf("failed to apply peer: %v", err)
+	}
+	s.peers[1] = previous
+	before := devicePeers(t, s.dev)
+
+	// The site moves to new subnets, then a later WireGuard step fails
+	site.RemoteSubnets = "10.1.0.0/24,10.3.0.0/24"
+	updated := prepare(t, site)
+	routes := routeTable{"10.1.0.0/24": true}
+
+	tx := &peerTx{siteID: 1}
+	err := s.runPeerTx(tx, func() error {
+		if err := tx.do(AckWireGuardFailed, "configure WireGuard peer",
+			func() error { return applyPeer(s.dev, updated, s.privateKey) },
+			func() error { return s.restoreDevicePeer(updated.spec.PublicKey, previous) }); err != nil {
+			return err
+		}
+		if err := routes.add(tx, "10.3.0.0/24", nil); err != nil {
+			return err
+		}
+		return tx.do(AckWireGuardFailed, "configure endpoint",
+			func() error { return s.dev.IpcSet("public_key=not-a-key\n") },
+			nil)
+	})
+
+	if code := ackCode(err); code != AckWireGuardFailed {
+		t.Fatalf("error code = %q (%v), want %q", code, err, AckWireGuardFailed)
+	}
+	if after := devicePeers(t, s.dev); !reflect.DeepEqual(after, before) {
+		t.Errorf("device peers after rollback = %v, want %v", after, before)
+	}
+	if len(routes) != 1 || !routes["10.1.0.0/24"] {
+		t.Errorf("routes after rollback = %v, want only 10.1.0.0/24", routes)
+	}
+	for _, result := range tx.results[:2] {
+		if !result.RolledBack {
+			t.Errorf("step %q was not rolled back", result.Step)
+		}
+	}
+}
+
+func TestAddPeerRejectsDuplicate(t *testing.T) {
+	s := newTestSession(t)
+	site := testSite(t, 1, "10.1.0.0/24")
+	peer := prepare(t, site)
+	if err := applyPeer(s.dev, peer, s.privateKey); err != nil {
+		t.Fatalf("failed to apply peer: %v", err)
+	}
+	s.peers[1] = peer
+	s.wgData.Sites = []SiteConfig{site}
+	before := devicePeers(t, s.dev)
+
+	// Same site ID with another key and subnets
+	results, err := s.addPeerUnlocked(testSite(t, 1, "10.9.0.0/24"))
+	if code := ackCode(err); code != AckConflict {
+		t.Fatalf("error code = %q (%v), want %q", code, err, AckConflict)
+	}
+	if len(results) != 0 {
+		t.Errorf("results = %+v, want none", results)
+	}
+	if s.peers[1] != peer || len(s.wgData.Sites) != 1 || !reflect.DeepEqual(s.wgData.Sites[0], site) {
+		t.Errorf("site 1 was changed by the duplicate add")
+	}
+	if after := devicePeers(t, s.dev); !reflect.DeepEqual(after, before) {
+		t.Errorf("device peers = %v, want %v", after, before)
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/base64"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/wgtester"
+)
+
+// probeResult is the outcome of a single probe sent by olm probe
+type probeResult struct {
+	Seq      int           `json:"seq"`
+	Received bool          `json:"received"`
+	RTT      time.Duration `json:"rtt,omitempty"`
+}
+
+// probeReport is the JSON output of olm probe
+type probeReport struct {
+	Target  string               `json:"target"`
+	Probes  []probeResult        `json:"probes"`
+	Summary wgtester.Summary     `json:"summary"`
+	Window  wgtester.WindowStats `json:"window"`
+	Passed  bool                 `json:"passed"`
+}
+
+// runProbe implements "olm probe <host:port>" and returns the process exit code.
+// It exits non-zero when no probe is answered or the loss exceeds --max-loss.
+func runProbe(args []string) int {
+	flags := flag.NewFlagSet("probe", flag.ContinueOnError)
+	count := flags.Int("c", 10, "Number of probes to send (0 sends until interrupted)")
+	interval := flags.Duration("i", time.Second, "Interval between probes")
+	timeout := flags.Duration("t", time.Second, "Time to wait for each response")
+	maxLoss := flags.Float64("max-loss", 100, "Fail if more than this percentage of probes is lost")
+	jsonOutput := flags.Bool("json", false, "Print JSON instead of text")
+	protocol := flags.Int("protocol", 0, "Protocol version to use (1 or 2, 0 negotiates)")
+	key := flags.String("key", "", "Base64 key material for authenticated probes")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: olm probe <host:port> [-c count] [-i interval] [-t timeout] [--max-loss pct] [--protocol n] [--key base64] [--json]")
+		flags.PrintDefaults()
+	}
+
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return 2
+	}
+	if len(positional) != 1 {
+		flags.Usage()
+		return 2
+	}
+	target := positional[0]
+	if *protocol < 0 || *protocol > int(wgtester.ProtocolV2) {
+		fmt.Fprintf(os.Stderr, "Error: invalid protocol version %d\n", *protocol)
+		return 2
+	}
+	authKey, err := base64.StdEncoding.DecodeString(*key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid key: %v\n", err)
+		return 2
+	}
+
+	// Probe results are printed directly, keep the library quiet
+	logger.GetLogger().SetLevel(logger.FATAL)
+
+	client, err := wgtester.NewClient(target)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer client.Close()
+	client.SetTimeout(*timeout)
+	client.SetMaxAttempts(1)
+	client.SetProtocolVersion(uint8(*protocol))
+	client.SetAuthKey(authKey)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	if !*jsonOutput {
+		fmt.Printf("PROBE %s\n", target)
+	}
+
+	var results []probeResult
+	var rtts []time.Duration
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+
+probeLoop:
+	for seq := 1; *count == 0 || seq <= *count; seq++ {
+		connected, rtt := client.TestConnectionWithTimeout(*timeout)
+		result := probeResult{Seq: seq, Received: connected}
+		if connected {
+			result.RTT = rtt
+			rtts = append(rtts, rtt)
+		}
+		results = append(results, result)
+
+		if !*jsonOutput {
+			if connected {
+				fmt.Printf("seq=%d rtt=%v\n", seq, rtt.Round(time.Microsecond))
+			} else {
+				fmt.Printf("seq=%d timeout\n", seq)
+			}
+		}
+
+		if *count != 0 && seq == *count {
+			break
+		}
+
+		select {
+		case <-sigCh:
+			break probeLoop
+		case <-ticker.C:
+		}
+	}
+
+	summary := wgtester.Summarize(len(results), rtts)
+	window := client.WindowStats()
+	passed := summary.Received > 0 && summary.Loss*100 <= *maxLoss
+
+	if *jsonOutput {
+		if err := printJSON(probeReport{
+			Target:  target,
+			Probes:  results,
+			Summary: summary,
+			Window:  window,
+			Passed:  passed,
+		}); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			return 1
+		}
+	} else {
+		fmt.Printf("\n--- %s probe statistics ---\n", target)
+		fmt.Printf("%d probes sent, %d received, %.1f%% loss\n", summary.Sent, summary.Received, summary.Loss*100)
+		if summary.Received > 0 {
+			fmt.Printf("rtt min/avg/max = %v/%v/%v, jitter %v\n",
+				summary.Min.Round(time.Microsecond), summary.Avg.Round(time.Microsecond),
+				summary.Max.Round(time.Microsecond), summary.Jitter.Round(time.Microsecond))
+			fmt.Printf("rtt p50/p90/p95/p99 = %v/%v/%v/%v\n",
+				summary.P50.Round(time.Microsecond), summary.P90.Round(time.Microsecond),
+				summary.P95.Round(time.Microsecond), summary.P99.Round(time.Microsecond))
+		}
+		if window.Version != 0 {
+			fmt.Printf("protocol v%d, %d late responses\n", window.Version, window.Late)
+		}
+		if window.Authenticated {
+			fmt.Printf("authenticated, %d unauthenticated responses rejected\n", window.Unauthenticated)
+		}
+	}
+
+	if !passed {
+		return 1
+	}
+	return 0
+}
+
+// runProbeServe implements "olm probe-serve", a standalone wgtester responder
+func runProbeServe(args []string) int {
+	flags := flag.NewFlagSet("probe-serve", flag.ContinueOnError)
+	listen := flags.String("listen", ":51821", "Address to answer probes on")
+	rate := flags.Float64("rate", 50, "Requests per second answered for each source IP (0 for no limit)")
+	burst := flags.Int("burst", 100, "Requests allowed above the rate for each source IP")
+	statsInterval := flags.Duration("stats-interval", 0, "Print per-source stats at this interval (0 only prints on exit)")
+	jsonOutput := flags.Bool("json", false, "Print stats as JSON")
+	logLevel := flags.String("log-level", "INFO", "Log level (DEBUG, INFO, WARN, ERROR, FATAL)")
+	key := flags.String("key", "", "Base64 key material; when set only authenticated probes are answered")
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	authKey, err := base64.StdEncoding.DecodeString(*key)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid key: %v\n", err)
+		return 2
+	}
+
+	logger.Init()
+	logger.GetLogger().SetLevel(parseLogLevel(*logLevel))
+
+	server := wgtester.NewServer(*listen)
+	server.SetRateLimit(*rate, *burst)
+	server.SetAuthKey(authKey)
+	if err := server.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		return 1
+	}
+	defer server.Stop()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	var tick <-chan time.Time
+	if *statsInterval > 0 {
+		ticker := time.NewTicker(*statsInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-sigCh:
+			printResponderStats(server.Stats(), *jsonOutput)
+			return 0
+		case <-tick:
+			printResponderStats(server.Stats(), *jsonOutput)
+		}
+	}
+}
+
+// printResponderStats prints the per-source counters of a responder
+func printResponderStats(stats map[string]wgtester.SourceStats, jsonOutput bool) {
+	if jsonOutput {
+		printJSON(stats)
+		return
+	}
+
+	sources := make([]string, 0, len(stats))
+	for ip := range stats {
+		sources = append(sources, ip)
+	}
+	sort.Strings(sources)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "SOURCE\tREQUESTS\tRESPONSES\tLIMITED\tMALFORMED\tUNAUTHENTICATED\tLAST SEEN")
+	for _, ip := range sources {
+		s := stats[ip]
+		fmt.Fprintf(w, "%s\t%d\t%d\t%d\t%d\t%d\t%s\n", ip, s.Requests, s.Responses, s.Limited, s.Malformed, s.Unauthenticated, s.LastSeen.Format(time.RFC3339))
+	}
+	w.Flush()
+}
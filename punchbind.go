@@ -0,0 +1,158 @@
+package main
+
+import (
+	"net"
+	"net/netip"
+	"sync"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// Packets read from punched sockets that may wait for WireGuard, more are dropped
+const punchQueueSize = 128
+
+// punchedPacket is a packet read from a punched socket
+type punchedPacket struct {
+	data []byte
+	from netip.AddrPort
+}
+
+// punchBind adds sockets won by hole punching to a bind. Traffic with the
+// remote address a socket was punched to goes through that socket, so it keeps
+// the NAT mapping the punch opened; everything else uses the wrapped bind.
+type punchBind struct {
+	conn.Bind
+
+	mu      sync.Mutex
+	sockets map[netip.AddrPort]*net.UDPConn
+	packets chan punchedPacket
+	closed  chan struct{} // Closed when WireGuard closes the bind, nil while closed
+}
+
+func newPunchBind(bind conn.Bind) *punchBind {
+	return &punchBind{
+		Bind:    bind,
+		sockets: make(map[netip.AddrPort]*net.UDPConn),
+		packets: make(chan punchedPacket, punchQueueSize),
+	}
+}
+
+func (b *punchBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	fns, actualPort, err := b.Bind.Open(port)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = make(chan struct{})
+	return append(fns, b.receivePunched(b.closed)), actualPort, nil
+}
+
+func (b *punchBind) Close() error {
+	b.mu.Lock()
+	if b.closed != nil {
+		close(b.closed)
+		b.closed = nil
+	}
+	b.mu.Unlock()
+
+	return b.Bind.Close()
+}
+
+func (b *punchBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	stdEp, ok := ep.(*conn.StdNetEndpoint)
+	if !ok {
+		return b.Bind.Send(bufs, ep)
+	}
+
+	b.mu.Lock()
+	udpConn := b.sockets[normalizeAddrPort(stdEp.AddrPort)]
+	b.mu.Unlock()
+	if udpConn == nil {
+		return b.Bind.Send(bufs, ep)
+	}
+
+	for _, buf := range bufs {
+		if _, err := udpConn.WriteToUDPAddrPort(buf, stdEp.AddrPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddSocket hands a punched socket to the bind for traffic with remote. A
+// socket already added for remote is closed.
+func (b *punchBind) AddSocket(remote netip.AddrPort, udpConn *net.UDPConn) {
+	remote = normalizeAddrPort(remote)
+
+	b.mu.Lock()
+	if previous, ok := b.sockets[remote]; ok {
+		previous.Close()
+	}
+	b.sockets[remote] = udpConn
+	b.mu.Unlock()
+
+	go b.readPunched(udpConn)
+}
+
+// RemoveSocket closes the punched socket used for remote, if any
+func (b *punchBind) RemoveSocket(remote netip.AddrPort) {
+	remote = normalizeAddrPort(remote)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if udpConn, ok := b.sockets[remote]; ok {
+		udpConn.Close()
+		delete(b.sockets, remote)
+	}
+}
+
+// CloseSockets closes every punched socket
+func (b *punchBind) CloseSockets() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for remote, udpConn := range b.sockets {
+		udpConn.Close()
+		delete(b.sockets, remote)
+	}
+	return nil
+}
+
+// readPunched queues the packets of a punched socket until it is closed
+func (b *punchBind) readPunched(udpConn *net.UDPConn) {
+	buf := make([]byte, 65535)
+	for {
+		n, from, err := udpConn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+		packet := punchedPacket{data: append([]byte(nil), buf[:n]...), from: normalizeAddrPort(from)}
+		select {
+		case b.packets <- packet:
+		default:
+			// WireGuard is not keeping up or the bind is closed, drop like the network would
+		}
+	}
+}
+
+// receivePunched hands queued packets of the punched sockets to WireGuard
+func (b *punchBind) receivePunched(closed chan struct{}) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		select {
+		case packet := <-b.packets:
+			sizes[0] = copy(packets[0], packet.data)
+			eps[0] = &conn.StdNetEndpoint{AddrPort: packet.from}
+			return 1, nil
+		case <-closed:
+			return 0, net.ErrClosed
+		}
+	}
+}
+
+func normalizeAddrPort(addr netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"strings"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/newt/websocket"
+	"github.com/fosrl/olm/wgconfig"
+)
+
+// payload is the typed data of a websocket message, able to check its own fields
+type payload interface {
+	Validate() error
+}
+
+// handleMessage registers a handler for msgType that receives the message data
+// decoded into T. Data that does not decode or validate is rejected with an
+// invalid_message ack and counted, and never reaches the handler.
+func handleMessage[T payload](s *session, msgType string, handler func(data T, ack *ack)) {
+	s.olm.RegisterHandler(msgType, messageHandler(s, s.olm, msgType, handler))
+}
+
+// messageHandler returns the websocket handler of msgType, acking through sender
+func messageHandler[T payload](s *session, sender messageSender, msgType string, handler func(data T, ack *ack)) websocket.MessageHandler {
+	return func(msg websocket.WSMessage) {
+		logger.Debug("Received %s message: %v", msgType, msg.Data)
+
+		ack := newAck(sender, msg)
+		ack.enabled = s.featureEnabled(CapAck)
+		defer ack.send()
+
+		data, err := decodePayload[T](msg.Data)
+		if err != nil {
+			logger.Error("Rejected malformed %s message: %v", msgType, err)
+			if s.httpServer != nil {
+				s.httpServer.RecordMalformedMessage(msgType)
+			}
+			ack.fail(ackErrorf(AckInvalidMessage, "%v", err))
+			return
+		}
+
+		handler(data, ack)
+	}
+}
+
+// decodePayload decodes message data into T and validates it
+func decodePayload[T payload](raw interface{}) (T, error) {
+	var data T
+
+	jsonData, err := json.Marshal(raw)
+	if err != nil {
+		return data, fmt.Errorf("invalid message data: %v", err)
+	}
+	if err := json.Unmarshal(jsonData, &data); err != nil {
+		return data, fmt.Errorf("invalid message data: %v", err)
+	}
+	if err := data.Validate(); err != nil {
+		return data, err
+	}
+	return data, nil
+}
+
+// Validate checks the fields Pangolin must send for a site
+func (c SiteConfig) Validate() error {
+	if c.SiteId <= 0 {
+		return fmt.Errorf("invalid site ID %d", c.SiteId)
+	}
+	if strings.TrimSpace(c.Endpoint) == "" {
+		return fmt.Errorf("missing endpoint for site %d", c.SiteId)
+	}
+	if _, err := wgconfig.ParseKey(c.PublicKey); err != nil {
+		return fmt.Errorf("invalid public key for site %d: %v", c.SiteId, err)
+	}
+	if c.ServerPort == 0 {
+		return fmt.Errorf("missing server port for site %d", c.SiteId)
+	}
+	// Checks the server IP and every remote subnet
+	if _, err := wgconfig.SiteAllowedIPs(c.ServerIP, c.RemoteSubnets); err != nil {
+		return fmt.Errorf("site %d: %v", c.SiteId, err)
+	}
+	if c.MonitorKey != "" {
+		if _, err := base64.StdEncoding.DecodeString(c.MonitorKey); err != nil {
+			return fmt.Errorf("invalid monitor key for site %d: %v", c.SiteId, err)
+		}
+	}
+	for _, relay := range c.Relays {
+		if strings.TrimSpace(relay) == "" {
+			return fmt.Errorf("empty relay for site %d", c.SiteId)
+		}
+	}
+	return nil
+}
+
+// Validate checks the tunnel IP and every site
+func (d WgData) Validate() error {
+	if _, err := netip.ParsePrefix(d.TunnelIP); err != nil {
+		return fmt.Errorf("invalid tunnel IP %q: %v", d.TunnelIP, err)
+	}
+
+	seen := make(map[int]bool)
+	for _, site := range d.Sites {
+		if err := site.Validate(); err != nil {
+			return err
+		}
+		if seen[site.SiteId] {
+			return fmt.Errorf("duplicate site ID %d", site.SiteId)
+		}
+		seen[site.SiteId] = true
+	}
+	return nil
+}
+
+// Validate checks the server key and endpoint to punch towards
+func (d HolePunchData) Validate() error {
+	if _, err := wgconfig.ParseKey(d.ServerPubKey); err != nil {
+		return fmt.Errorf("invalid server public key: %v", err)
+	}
+	if strings.TrimSpace(d.Endpoint) == "" {
+		return fmt.Errorf("missing endpoint")
+	}
+	return nil
+}
+
+// Validate checks the peer configuration
+func (d UpdatePeerData) Validate() error {
+	return d.siteConfig().Validate()
+}
+
+// Validate checks the peer configuration
+func (d AddPeerData) Validate() error {
+	return d.siteConfig().Validate()
+}
+
+// Validate checks the site ID
+func (d RemovePeerData) Validate() error {
+	if d.SiteId <= 0 {
+		return fmt.Errorf("invalid site ID %d", d.SiteId)
+	}
+	return nil
+}
+
+// Validate checks the site ID and relay endpoint
+func (d RelayPeerData) Validate() error {
+	if d.SiteId <= 0 {
+		return fmt.Errorf("invalid site ID %d", d.SiteId)
+	}
+	if strings.TrimSpace(d.Endpoint) == "" {
+		return fmt.Errorf("missing relay endpoint for site %d", d.SiteId)
+	}
+	return nil
+}
+
+// siteConfig converts the update to the site it describes
+func (d UpdatePeerData) siteConfig() SiteConfig {
+	return SiteConfig(d)
+}
+
+// siteConfig converts the addition to the site it describes
+func (d AddPeerData) siteConfig() SiteConfig {
+	return SiteConfig(d)
+}
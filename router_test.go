@@ -0,0 +1,221 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/fosrl/newt/websocket"
+	"github.com/fosrl/olm/httpserver"
+)
+
+// newRouterTest returns a session with acks on, a handler for olm/wg/peer/add
+// recording the data it receives, and the sender its acks go through
+func newRouterTest(t *testing.T) (*session, websocket.MessageHandler, *[]AddPeerData, *fakeSender) {
+	t.Helper()
+
+	s := &session{
+		httpServer: httpserver.NewHTTPServer("127.0.0.1:0"),
+		features:   map[string]bool{CapAck: true},
+	}
+	sender := &fakeSender{}
+	var handled []AddPeerData
+	handler := messageHandler(s, sender, "olm/wg/peer/add", func(data AddPeerData, ack *ack) {
+		handled = append(handled, data)
+	})
+	return s, handler, &handled, sender
+}
+
+// addPeerMessage returns an olm/wg/peer/add message for site with a request ID
+func addPeerMessage(site SiteConfig) websocket.WSMessage {
+	return websocket.WSMessage{Type: "olm/wg/peer/add", Data: map[string]interface{}{
+		"requestId":     "req-1",
+		"siteId":        site.SiteId,
+		"endpoint":      site.Endpoint,
+		"publicKey":     site.PublicKey,
+		"serverIP":      site.ServerIP,
+		"serverPort":    site.ServerPort,
+		"remoteSubnets": site.RemoteSubnets,
+	}}
+}
+
+func TestMessageHandlerValid(t *testing.T) {
+	s, handler, handled, sender := newRouterTest(t)
+	site := testSite(t, 1, "10.1.0.0/24")
+
+	handler(addPeerMessage(site))
+
+	if len(*handled) != 1 {
+		t.Fatalf("handler called %d times, want 1", len(*handled))
+	}
+	if got := (*handled)[0]; got.SiteId != 1 || got.PublicKey != site.PublicKey || got.RemoteSubnets != "10.1.0.0/24" {
+		t.Errorf("handler data = %+v", got)
+	}
+	acks := sender.acks(t)
+	if len(acks) != 1 || acks[0]["success"] != true {
+		t.Errorf("acks = %v, want one successful ack", acks)
+	}
+	if malformed := s.httpServer.MalformedMessages(); len(malformed) != 0 {
+		t.Errorf("malformed messages = %v, want none", malformed)
+	}
+}
+
+func TestMessageHandlerRejects(t *testing.T) {
+	tests := map[string]struct {
+		data    interface{}
+		wantErr string
+	}{
+		"data is not an object": {"not an object", "invalid message data"},
+		"site ID is a string":   {map[string]interface{}{"requestId": "req-1", "siteId": "one"}, "invalid message data"},
+		"missing public key": {map[string]interface{}{
+			"requestId": "req-1", "siteId": 1, "endpoint": "127.0.0.1:51820", "serverIP": "100.90.128.1", "serverPort": 51820,
+		}, "invalid public key for site 1"},
+		"invalid remote subnet": {map[string]interface{}{
+			"requestId": "req-1", "siteId": 1, "endpoint": "127.0.0.1:51820", "publicKey": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA=",
+			"serverIP": "100.90.128.1", "serverPort": 51820, "remoteSubnets": "10.1.0.0/33",
+		}, "invalid remote subnet"},
+	}
+	for name, tt := range tests {
+		s, handler, handled, sender := newRouterTest(t)
+
+		handler(websocket.WSMessage{Type: "olm/wg/peer/add", Data: tt.data})
+
+		if len(*handled) != 0 {
+			t.Errorf("%s: handler called with %+v", name, *handled)
+		}
+		if got := s.httpServer.MalformedMessages()["olm/wg/peer/add"]; got != 1 {
+			t.Errorf("%s: malformed count = %d, want 1", name, got)
+		}
+
+		acks := sender.acks(t)
+		if _, isObject := tt.data.(map[string]interface{}); !isObject {
+			// Without a requestId the rejection is only logged and counted
+			if len(acks) != 0 {
+				t.Errorf("%s: acks = %v, want none", name, acks)
+			}
+			continue
+		}
+		if len(acks) != 1 {
+			t.Fatalf("%s: sent %d acks, want 1", name, len(acks))
+		}
+		if acks[0]["success"] != false || acks[0]["code"] != AckInvalidMessage {
+			t.Errorf("%s: ack = %v", name, acks[0])
+		}
+		if errText, _ := acks[0]["error"].(string); !strings.Contains(errText, tt.wantErr) {
+			t.Errorf("%s: ack error = %q, want it to contain %q", name, errText, tt.wantErr)
+		}
+	}
+}
+
+func TestMessageHandlerAckDisabled(t *testing.T) {
+	s, handler, handled, sender := newRouterTest(t)
+	s.features[CapAck] = false
+
+	handler(websocket.WSMessage{Type: "olm/wg/peer/add", Data: map[string]interface{}{"requestId": "req-1", "siteId": 0}})
+	handler(addPeerMessage(testSite(t, 1, "")))
+
+	if len(*handled) != 1 {
+		t.Errorf("handler called %d times, want 1", len(*handled))
+	}
+	if len(sender.sent) != 0 {
+		t.Errorf("sent %d messages with acks turned off, want none", len(sender.sent))
+	}
+	if got := s.httpServer.MalformedMessages()["olm/wg/peer/add"]; got != 1 {
+		t.Errorf("malformed count = %d, want 1", got)
+	}
+}
+
+func TestSiteConfigValidate(t *testing.T) {
+	valid := testSite(t, 1, "10.1.0.0/24, 10.2.0.0/16")
+
+	tests := map[string]struct {
+		change  func(c *SiteConfig)
+		wantErr bool
+	}{
+		"valid":                  {func(c *SiteConfig) {}, false},
+		"server IP with prefix":  {func(c *SiteConfig) { c.ServerIP = "100.90.128.1/32" }, false},
+		"no remote subnets":      {func(c *SiteConfig) { c.RemoteSubnets = "" }, false},
+		"monitor key and relays": {func(c *SiteConfig) { c.MonitorKey = "c2VjcmV0"; c.Relays = []string{"relay.example.com:21820"} }, false},
+		"zero site ID":           {func(c *SiteConfig) { c.SiteId = 0 }, true},
+		"negative site ID":       {func(c *SiteConfig) { c.SiteId = -1 }, true},
+		"missing endpoint":       {func(c *SiteConfig) { c.Endpoint = " " }, true},
+		"missing public key":     {func(c *SiteConfig) { c.PublicKey = "" }, true},
+		"invalid public key":     {func(c *SiteConfig) { c.PublicKey = "not-a-key" }, true},
+		"missing server port":    {func(c *SiteConfig) { c.ServerPort = 0 }, true},
+		"invalid server IP":      {func(c *SiteConfig) { c.ServerIP = "100.90.128" }, true},
+		"invalid remote subnet":  {func(c *SiteConfig) { c.RemoteSubnets = "10.1.0.0/24,10.2.0.0" }, true},
+		"invalid monitor key":    {func(c *SiteConfig) { c.MonitorKey = "not base64!" }, true},
+		"empty relay":            {func(c *SiteConfig) { c.Relays = []string{"relay.example.com:21820", ""} }, true},
+	}
+	for name, tt := range tests {
+		c := valid
+		tt.change(&c)
+		if err := c.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, want error %v", name, err, tt.wantErr)
+		}
+		// Peer additions and updates carry the same fields
+		if err := AddPeerData(c).Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: AddPeerData.Validate() = %v, want error %v", name, err, tt.wantErr)
+		}
+		if err := UpdatePeerData(c).Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: UpdatePeerData.Validate() = %v, want error %v", name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestWgDataValidate(t *testing.T) {
+	site1 := testSite(t, 1, "10.1.0.0/24")
+	site2 := testSite(t, 2, "")
+	invalid := site2
+	invalid.ServerPort = 0
+
+	tests := map[string]struct {
+		data    WgData
+		wantErr bool
+	}{
+		"valid":              {WgData{TunnelIP: "100.90.128.5/24", Sites: []SiteConfig{site1, site2}}, false},
+		"no sites":           {WgData{TunnelIP: "100.90.128.5/24"}, false},
+		"missing tunnel IP":  {WgData{Sites: []SiteConfig{site1}}, true},
+		"tunnel IP no mask":  {WgData{TunnelIP: "100.90.128.5", Sites: []SiteConfig{site1}}, true},
+		"invalid site":       {WgData{TunnelIP: "100.90.128.5/24", Sites: []SiteConfig{site1, invalid}}, true},
+		"duplicate site IDs": {WgData{TunnelIP: "100.90.128.5/24", Sites: []SiteConfig{site1, site1}}, true},
+	}
+	for name, tt := range tests {
+		if err := tt.data.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, want error %v", name, err, tt.wantErr)
+		}
+	}
+}
+
+func TestPayloadValidate(t *testing.T) {
+	serverKey := testSite(t, 1, "").PublicKey
+
+	tests := map[string]struct {
+		data    payload
+		wantErr bool
+	}{
+		"hole punch":                      {HolePunchData{ServerPubKey: serverKey, Endpoint: "pangolin.example.com"}, false},
+		"hole punch invalid key":          {HolePunchData{ServerPubKey: "not-a-key", Endpoint: "pangolin.example.com"}, true},
+		"hole punch missing endpoint":     {HolePunchData{ServerPubKey: serverKey}, true},
+		"remove peer":                     {RemovePeerData{SiteId: 1}, false},
+		"remove peer zero site ID":        {RemovePeerData{}, true},
+		"relay peer":                      {RelayPeerData{SiteId: 1, Endpoint: "relay.example.com:21820"}, false},
+		"relay peer zero site ID":         {RelayPeerData{Endpoint: "relay.example.com:21820"}, true},
+		"relay peer missing endpoint":     {RelayPeerData{SiteId: 1, Endpoint: "  "}, true},
+		"capabilities":                    {CapabilitiesData{ProtocolVersion: 2, Enabled: []string{CapAck}, Disabled: []string{CapBirthday}}, false},
+		"capabilities unknown names":      {CapabilitiesData{ProtocolVersion: 3, Enabled: []string{"future-feature"}}, false},
+		"capabilities negative version":   {CapabilitiesData{ProtocolVersion: -1}, true},
+		"capabilities empty enabled":      {CapabilitiesData{ProtocolVersion: 2, Enabled: []string{""}}, true},
+		"capabilities empty disabled":     {CapabilitiesData{ProtocolVersion: 2, Disabled: []string{" "}}, true},
+		"birthday punch":                  {BirthdayPunchData{SiteId: 1, Token: "token", Endpoint: "203.0.113.7"}, false},
+		"birthday punch zero site ID":     {BirthdayPunchData{Token: "token", Endpoint: "203.0.113.7"}, true},
+		"birthday punch missing token":    {BirthdayPunchData{SiteId: 1, Endpoint: "203.0.113.7"}, true},
+		"birthday punch token too long":   {BirthdayPunchData{SiteId: 1, Token: strings.Repeat("t", birthdayMaxToken+1), Endpoint: "203.0.113.7"}, true},
+		"birthday punch missing endpoint": {BirthdayPunchData{SiteId: 1, Token: "token"}, true},
+		"birthday punch negative limits":  {BirthdayPunchData{SiteId: 1, Token: "token", Endpoint: "203.0.113.7", Rate: -1}, true},
+	}
+	for name, tt := range tests {
+		if err := tt.data.Validate(); (err != nil) != tt.wantErr {
+			t.Errorf("%s: Validate() = %v, want error %v", name, err, tt.wantErr)
+		}
+	}
+}
@@ -85,10 +85,11 @@ func loadServiceArgs() ([]string, error) {
 }
 
 type olmService struct {
-	elog debug.Log
-	ctx  context.Context
-	stop context.CancelFunc
-	args []string
+	elog     debug.Log
+	ctx      context.Context
+	stop     context.CancelFunc
+	args     []string
+	exitCode int // Exit code of the main olm logic, reported to the service control manager
 }
 
 func (s *olmService) Execute(args []string, r <-chan svc.ChangeRequest, changes chan<- svc.Status) (bool, uint32) {
@@ -132,6 +133,7 @@ func (s *olmService) Execute(args []string, r <-chan svc.ChangeRequest, changes
 				select {
 				case <-olmDone:
 					s.elog.Info(1, "Main logic finished gracefully")
+					return s.serviceExitCode()
 				case <-time.After(10 * time.Second):
 					s.elog.Info(1, "Timeout waiting for main logic to finish")
 				}
@@ -142,11 +144,21 @@ func (s *olmService) Execute(args []string, r <-chan svc.ChangeRequest, changes
 		case <-olmDone:
 			s.elog.Info(1, "Main olm logic completed, stopping service")
 			changes <- svc.Status{State: svc.StopPending}
-			return false, 0
+			return s.serviceExitCode()
 		}
 	}
 }
 
+// serviceExitCode returns the exit code of the main olm logic as a
+// service-specific exit code, so a terminated olm shows as stopped with an error
+func (s *olmService) serviceExitCode() (bool, uint32) {
+	if s.exitCode == 0 {
+		return false, 0
+	}
+	s.elog.Info(1, fmt.Sprintf("Olm exited with code %d", s.exitCode))
+	return true, uint32(s.exitCode)
+}
+
 func (s *olmService) runOlm() {
 	// Create a context that can be cancelled when the service stops
 	s.ctx, s.stop = context.WithCancel(context.Background())
@@ -160,18 +172,21 @@ func (s *olmService) runOlm() {
 		defer func() {
 			if r := recover(); r != nil {
 				s.elog.Error(1, fmt.Sprintf("Olm panic: %v", r))
+				s.exitCode = 1
 			}
 			close(done)
 		}()
 
 		// Call the main olm function with stored arguments
-		runOlmMainWithArgs(s.ctx, s.args)
+		s.exitCode = runOlmMainWithArgs(s.ctx, s.args)
 	}()
 
 	// Wait for either context cancellation or main logic completion
 	select {
 	case <-s.ctx.Done():
 		s.elog.Info(1, "Olm service context cancelled")
+		// The exit code is only known once the main logic has shut down
+		<-done
 	case <-done:
 		s.elog.Info(1, "Olm main logic completed")
 	}
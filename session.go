@@ -0,0 +1,1025 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/newt/websocket"
+	"github.com/fosrl/olm/httpserver"
+	"github.com/fosrl/olm/peermonitor"
+	"github.com/fosrl/olm/stun"
+	"github.com/fosrl/olm/wgtester"
+
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/device"
+	"golang.zx2c4.com/wireguard/tun"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// olmConfig holds the settings that stay the same across websocket sessions
+type olmConfig struct {
+	mtu           int
+	interfaceName string
+	doHolepunch   bool
+	loggerLevel   logger.LogLevel
+	pingInterval  time.Duration
+	pingTimeout   time.Duration
+	responderPort int           // Port of the wgtester responder on the tunnel IP, 0 if disabled
+	failbackAfter time.Duration // How long the direct path of a relayed peer must answer before it fails back, 0 to disable
+	offlineCache  bool          // Cache the configuration and bring it up while Pangolin is unreachable
+	cacheDir      string        // Directory of the configuration cache
+	onTerminate   string        // TerminateExit or TerminateIdle
+	stunServers   []string      // STUN servers used to classify the NAT, none to skip discovery
+}
+
+// session is a single websocket session with Pangolin and the tunnel it manages
+type session struct {
+	config     *olmConfig
+	httpServer *httpserver.HTTPServer
+
+	olm           *websocket.Client
+	id            string
+	endpoint      string
+	privateKey    wgtypes.Key
+	sourcePort    uint16
+	interfaceName string
+
+	// mu protects the tunnel state below, which is touched by websocket handlers
+	mu            sync.Mutex
+	dev           *device.Device
+	tdev          tun.Device
+	uapiListener  net.Listener
+	wgData        WgData
+	holePunchData HolePunchData
+	features      map[string]bool       // Capabilities in use, seeded from localCapabilities and changed by the server
+	peers         map[int]*preparedPeer // Sites applied to the device, by site ID
+	responder     *wgtester.Server
+	nat           *stun.Result // NAT behaviour of the source port, nil if unknown
+	bind          *punchBind
+	punched       map[int]netip.AddrPort // Remote mapping won by birthday punching, by site ID
+	punching      map[int]bool           // Sites a birthday punch is running for
+	cachePath     string                 // Configuration cache file, empty if caching is off
+	cacheKey      []byte                 // Key the cache is sealed with
+	cache         *cachedState           // Last saved configuration, nil if none
+	offline       bool                   // Tunnel is up from the cache and Pangolin has not sent a configuration yet
+	offlineTimer  *time.Timer
+	connected     bool
+	resumed       bool           // Took over a handed off tunnel and has not pinged Pangolin yet
+	adopted       *adoptedTunnel // Interface left up by the previous olm, taken by the first bring-up
+	closed        bool
+	done          chan struct{}            // Closed when the session is closed
+	monitor       *peermonitor.PeerMonitor // Peer monitor of the tunnel, nil while it is down
+	stopRegister  func()                   // Stops the registration messages, nil if none are sent
+	stopHolepunch chan struct{}            // Closed to stop hole punching
+	stopPing      chan struct{}            // Closed to stop the pings
+	holePunching  bool                     // A hole punch loop is running
+
+	// tokenMu protects what hole punches carry, the websocket updates the token at any time
+	tokenMu      sync.Mutex
+	token        string
+	serverPubKey string
+
+	onTerminate func(s *session) // Called after Pangolin terminated the session and it was closed
+	state       *stateDir        // Where the tunnel is recorded for crash recovery, nil if none
+}
+
+// newSession creates the websocket client for the given credentials and registers its handlers
+func newSession(config *olmConfig, httpServer *httpserver.HTTPServer, id, secret, endpoint string) (*session, error) {
+	privateKey, err := wgtypes.GeneratePrivateKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate private key: %v", err)
+	}
+
+	// Create a new olm
+	olm, err := websocket.NewClient(
+		"olm",
+		id,     // CLI arg takes precedence
+		secret, // CLI arg takes precedence
+		endpoint,
+		config.pingInterval,
+		config.pingTimeout,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create olm: %v", err)
+	}
+
+	sourcePort, err := FindAvailableUDPPort(49152, 65535)
+	if err != nil {
+		return nil, fmt.Errorf("error finding available port: %v", err)
+	}
+
+	var cachePath string
+	var cacheKey []byte
+	var cache *cachedState
+	if config.offlineCache {
+		cachePath, cacheKey, cache = openSessionCache(config.cacheDir, id, secret)
+		if cache != nil {
+			// The sites know this client by the cached key, keep using it
+			if cachedKey, err := wgtypes.ParseKey(cache.PrivateKey); err == nil {
+				privateKey = cachedKey
+			} else {
+				logger.Warn("Ignoring cached configuration with an invalid private key: %v", err)
+				cache = nil
+			}
+		}
+	}
+
+	s := &session{
+		config:        config,
+		httpServer:    httpServer,
+		olm:           olm,
+		id:            olm.GetConfig().ID,       // Update ID from config
+		endpoint:      olm.GetConfig().Endpoint, // Update endpoint from config
+		privateKey:    privateKey,
+		sourcePort:    sourcePort,
+		interfaceName: config.interfaceName,
+		features:      make(map[string]bool),
+		punched:       make(map[int]netip.AddrPort),
+		punching:      make(map[int]bool),
+		cachePath:     cachePath,
+		cacheKey:      cacheKey,
+		cache:         cache,
+		done:          make(chan struct{}),
+		stopHolepunch: make(chan struct{}),
+		stopPing:      make(chan struct{}),
+	}
+	for _, name := range localCapabilities(config) {
+		s.features[name] = true
+	}
+
+	handleMessage(s, "olm/wg/holepunch", s.handleHolePunch)
+	handleMessage(s, "olm/wg/connect", s.handleConnect)
+	handleMessage(s, "olm/wg/peer/update", s.handlePeerUpdate)
+	handleMessage(s, "olm/wg/peer/add", s.handlePeerAdd)
+	handleMessage(s, "olm/wg/peer/remove", s.handlePeerRemove)
+	handleMessage(s, "olm/wg/peer/relay", s.handlePeerRelay)
+	handleMessage(s, "olm/wg/holepunch/birthday", s.handleBirthdayPunch)
+	handleMessage(s, "olm/capabilities", s.handleCapabilities)
+	olm.RegisterHandler("olm/register/no-sites", s.handleNoSites)
+	olm.RegisterHandler("olm/terminate", s.handleTerminate)
+	olm.OnConnect(s.onConnect)
+	olm.OnTokenUpdate(func(token string) {
+		s.tokenMu.Lock()
+		s.token = token
+		s.tokenMu.Unlock()
+	})
+
+	return s, nil
+}
+
+// Start connects to the websocket server
+func (s *session) Start() error {
+	if s.httpServer != nil {
+		s.httpServer.SetIdentity(s.id, s.endpoint)
+	}
+	s.setState(httpserver.StateConnecting)
+
+	// Before the hole punch and the device take the source port
+	s.detectNAT()
+
+	// The websocket client keeps retrying in the background and only calls
+	// onConnect once it gets through, which stops the timer. Until then
+	// Pangolin counts as unreachable.
+	if s.cache != nil {
+		s.mu.Lock()
+		s.offlineTimer = time.AfterFunc(offlineAfter, s.bringUpCached)
+		s.mu.Unlock()
+	}
+
+	// Connect to the WebSocket server
+	if err := s.olm.Connect(); err != nil {
+		return fmt.Errorf("failed to connect to server: %v", err)
+	}
+	return nil
+}
+
+// Close stops all background work of the session and tears down the tunnel
+func (s *session) Close() {
+	s.Shutdown(false)
+}
+
+// Shutdown stops all background work of the session. The tunnel is torn down
+// unless leaveTunnel is set, which keeps the peers, routes, address and device
+// in place for a process that takes over.
+func (s *session) Shutdown(leaveTunnel bool) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	close(s.done)
+	if s.offlineTimer != nil {
+		s.offlineTimer.Stop()
+	}
+	s.mu.Unlock()
+
+	// Close the websocket first so no handler runs while the tunnel is torn down
+	s.olm.Close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.stopHolepunchingUnlocked()
+
+	if s.stopRegister != nil {
+		s.stopRegister()
+		s.stopRegister = nil
+	}
+
+	select {
+	case <-s.stopPing:
+		// Channel already closed
+	default:
+		close(s.stopPing)
+	}
+
+	if leaveTunnel {
+		s.detachTunnelUnlocked()
+	} else {
+		s.closeTunnelUnlocked()
+	}
+
+	s.connected = false
+	s.offline = false
+
+	if s.httpServer != nil {
+		s.httpServer.SetConnectionStatus(false)
+		s.httpServer.SetState(httpserver.StateDisconnected)
+	}
+}
+
+// closeTunnelUnlocked tears the tunnel down in order: monitors, peers, the
+// routes olm added, the interface address, and finally the device.
+// This function assumes the mutex is already held by the caller
+func (s *session) closeTunnelUnlocked() {
+	sd := newShutdown("Tunnel")
+	if s.dev != nil {
+		dev := s.dev
+		sd.Register("close WireGuard device", func() error {
+			dev.Close()
+			return nil
+		})
+	}
+	if s.dev == nil && s.tdev != nil {
+		// The device never started and did not take over the TUN device
+		sd.Register("close TUN device", s.tdev.Close)
+	}
+	if s.adopted != nil {
+		// The tunnel never came up, the adopted interface goes away with its routes
+		sd.Register("close adopted TUN device", s.adopted.tdev.Close)
+		s.adopted = nil
+	}
+	if s.bind != nil {
+		sd.Register("close punched sockets", s.bind.CloseSockets)
+	}
+	s.registerUAPIShutdownUnlocked(sd)
+	if s.dev != nil && s.wgData.TunnelIP != "" {
+		interfaceName, tunnelIP := s.interfaceName, s.wgData.TunnelIP
+		sd.Register("remove tunnel IP "+tunnelIP, func() error {
+			return UnconfigureInterface(interfaceName, tunnelIP)
+		})
+	}
+	if s.dev != nil {
+		dev := s.dev
+		for _, site := range s.wgData.Sites {
+			peer, ok := s.peers[site.SiteId]
+			if !ok {
+				continue
+			}
+			site := site
+			sd.Register(fmt.Sprintf("remove routes of site %d", site.SiteId), func() error {
+				if err := removeRouteForServerIP(site.ServerIP); err != nil {
+					return err
+				}
+				return removeRoutesForRemoteSubnets(site.RemoteSubnets)
+			})
+			sd.Register(fmt.Sprintf("remove peer of site %d", site.SiteId), func() error {
+				return removeDevicePeer(dev, peer.spec.PublicKey)
+			})
+		}
+	}
+	s.registerMonitorShutdownUnlocked(sd)
+	sd.Run(0)
+
+	s.peers = nil
+	s.punched = make(map[int]netip.AddrPort)
+	s.bind = nil
+	s.uapiListener = nil
+	s.dev = nil
+	s.tdev = nil
+	s.recordTunnelUnlocked()
+}
+
+// detachTunnelUnlocked stops the monitors and the UAPI listener but leaves the
+// device, peers, routes and address in place.
+// This function assumes the mutex is already held by the caller
+func (s *session) detachTunnelUnlocked() {
+	sd := newShutdown("Tunnel")
+	s.registerUAPIShutdownUnlocked(sd)
+	s.registerMonitorShutdownUnlocked(sd)
+	sd.Run(0)
+
+	if s.dev != nil {
+		logger.Info("Leaving tunnel %s up with %d peers", s.interfaceName, len(s.peers))
+	}
+	s.uapiListener = nil
+}
+
+// leaveUp makes the interface outlive olm with its address and routes, and
+// records that for the next run. It returns false if there is no tunnel or it
+// can't be left up.
+func (s *session) leaveUp() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev == nil {
+		return false
+	}
+	file, ok := s.tdev.(interface{ File() *os.File })
+	if !ok {
+		logger.Warn("Can't leave tunnel %s up, the TUN device has no file", s.interfaceName)
+		return false
+	}
+	if err := setTUNPersist(file.File(), true); err != nil {
+		logger.Warn("Can't leave tunnel %s up: %v", s.interfaceName, err)
+		return false
+	}
+	if s.state != nil {
+		s.state.Update(func(state *runtimeState) {
+			state.LeftUp = true
+		})
+	}
+	return true
+}
+
+// takeAdoptedUnlocked moves the interface left up by the previous olm to
+// wgData. The address and routes wgData does not use are removed, the rest is
+// kept. It returns the TUN device, whether the address was kept and the kept routes.
+// This function assumes the mutex is already held by the caller
+func (s *session) takeAdoptedUnlocked(wgData WgData) (tun.Device, bool, map[string]bool) {
+	adopted := s.adopted
+	s.adopted = nil
+
+	wanted := make(map[string]bool)
+	for _, site := range wgData.Sites {
+		wanted[site.ServerIP] = true
+		for _, subnet := range splitSubnets(site.RemoteSubnets) {
+			wanted[subnet] = true
+		}
+	}
+
+	kept := make(map[string]bool)
+	for _, serverIP := range adopted.serverIPs {
+		if wanted[serverIP] {
+			kept[serverIP] = true
+		} else if err := removeRouteForServerIP(serverIP); err != nil {
+			logger.Warn("Failed to remove route for server IP %s left up by the previous olm: %v", serverIP, err)
+		}
+	}
+	for _, subnet := range adopted.subnets {
+		if wanted[subnet] {
+			kept[subnet] = true
+		} else if err := removeRouteForSubnet(subnet); err != nil {
+			logger.Warn("Failed to remove route for remote subnet %s left up by the previous olm: %v", subnet, err)
+		}
+	}
+
+	if adopted.tunnelIP == wgData.TunnelIP {
+		return adopted.tdev, true, kept
+	}
+	name, err := adopted.tdev.Name()
+	if err == nil {
+		err = UnconfigureInterface(name, adopted.tunnelIP)
+	}
+	if err != nil {
+		logger.Warn("Failed to remove tunnel IP %s left up by the previous olm: %v", adopted.tunnelIP, err)
+	}
+	return adopted.tdev, false, kept
+}
+
+// removeKeptRoutes removes the routes of site kept from an adopted interface
+func removeKeptRoutes(site SiteConfig, kept map[string]bool) {
+	if kept[site.ServerIP] {
+		if err := removeRouteForServerIP(site.ServerIP); err != nil {
+			logger.Warn("Failed to remove route for server IP %s: %v", site.ServerIP, err)
+		}
+	}
+	for _, subnet := range splitSubnets(site.RemoteSubnets) {
+		if !kept[subnet] {
+			continue
+		}
+		if err := removeRouteForSubnet(subnet); err != nil {
+			logger.Warn("Failed to remove route for remote subnet %s: %v", subnet, err)
+		}
+	}
+}
+
+// registerUAPIShutdownUnlocked registers closing the UAPI listener.
+// This function assumes the mutex is already held by the caller
+func (s *session) registerUAPIShutdownUnlocked(sd *shutdown) {
+	if s.uapiListener == nil {
+		return
+	}
+	listener := s.uapiListener
+	sd.Register("close UAPI listener", listener.Close)
+}
+
+// registerMonitorShutdownUnlocked registers stopping the probe responder and the peer monitor.
+// This function assumes the mutex is already held by the caller
+func (s *session) registerMonitorShutdownUnlocked(sd *shutdown) {
+	if s.responder != nil {
+		responder := s.responder
+		s.responder = nil
+		sd.Register("stop probe responder", func() error {
+			responder.Stop()
+			return nil
+		})
+	}
+	if s.monitor != nil {
+		monitor := s.monitor
+		s.monitor = nil
+		sd.Register("stop peer monitor", func() error {
+			monitor.Close()
+			return nil
+		})
+	}
+}
+
+// Monitor returns the peer monitor of the tunnel, nil while the tunnel is down
+func (s *session) Monitor() *peermonitor.PeerMonitor {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.monitor
+}
+
+// isConnected reports whether the tunnel is up with the configuration from Pangolin
+func (s *session) isConnected() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.connected && !s.offline
+}
+
+// addEvent records an event for the /events endpoint
+func (s *session) addEvent(eventType string, siteID int, message string) {
+	if s.httpServer != nil {
+		s.httpServer.AddEvent(eventType, siteID, message)
+	}
+}
+
+// setState reports the progress of the session on the status endpoint
+func (s *session) setState(state string) {
+	if s.httpServer != nil {
+		s.httpServer.SetState(state)
+	}
+}
+
+// Routes returns the routes installed for the sites of this session
+func (s *session) Routes() []httpserver.RouteInfo {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var routes []httpserver.RouteInfo
+	for _, site := range s.wgData.Sites {
+		if runtime.GOOS == "darwin" {
+			routes = append(routes, httpserver.RouteInfo{
+				Destination: site.ServerIP,
+				SiteID:      site.SiteId,
+				Interface:   s.interfaceName,
+			})
+		}
+		for _, subnet := range splitSubnets(site.RemoteSubnets) {
+			routes = append(routes, httpserver.RouteInfo{
+				Destination: subnet,
+				SiteID:      site.SiteId,
+				Interface:   s.interfaceName,
+			})
+		}
+	}
+	return routes
+}
+
+func (s *session) handleHolePunch(data HolePunchData, ack *ack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.holePunchData = data
+	s.tokenMu.Lock()
+	s.serverPubKey = data.ServerPubKey
+	s.tokenMu.Unlock()
+
+	if s.holePunching {
+		logger.Debug("UDP hole punch already running, skipping new request")
+		return
+	}
+	s.holePunching = true
+	go func(endpoint string, stop <-chan struct{}) {
+		keepSendingUDPHolePunch(endpoint, s.id, s.sourcePort, s.holePunchCredentials, stop)
+
+		s.mu.Lock()
+		s.holePunching = false
+		s.mu.Unlock()
+	}(data.Endpoint, s.stopHolepunch)
+}
+
+// holePunchCredentials returns the token and the server key hole punches are sent with
+func (s *session) holePunchCredentials() (token, serverPubKey string) {
+	s.tokenMu.Lock()
+	defer s.tokenMu.Unlock()
+
+	return s.token, s.serverPubKey
+}
+
+func (s *session) handleConnect(wgData WgData, ack *ack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return
+	}
+
+	if s.connected {
+		logger.Info("Already connected. Ignoring new connection request.")
+		ack.fail(ackErrorf(AckAlreadyConnected, "already connected"))
+		return
+	}
+
+	if s.stopRegister != nil {
+		s.stopRegister()
+		s.stopRegister = nil
+	}
+
+	s.stopHolepunchingUnlocked()
+
+	if s.offline {
+		// The cached tunnel is already up, move it to the configuration Pangolin sent
+		if !s.reconcileUnlocked(wgData, ack) {
+			return
+		}
+	} else {
+		// wait 10 milliseconds to ensure the previous connection is closed
+		time.Sleep(10 * time.Millisecond)
+
+		// if there is an existing tunnel then close it
+		if s.dev != nil {
+			logger.Info("Got new message. Closing existing tunnel!")
+			s.dev.Close()
+		}
+
+		if !s.bringUpUnlocked(wgData, ack) {
+			return
+		}
+	}
+
+	s.connected = true
+	s.setState(httpserver.StateConnected)
+	s.persistUnlocked()
+
+	logger.Info("WireGuard device created.")
+}
+
+// bringUpUnlocked creates the WireGuard device for wgData and configures every
+// site, reporting the outcome to ack. It returns false if no tunnel could be created.
+// This function assumes the mutex is already held by the caller
+func (s *session) bringUpUnlocked(wgData WgData, ack *ack) bool {
+	s.wgData = wgData
+
+	// The routes and address of an interface left up by the previous olm stay
+	// in place if this configuration still uses them
+	var keptRoutes map[string]bool
+	keptAddress := false
+
+	var err error
+	s.tdev, err = func() (tun.Device, error) {
+		if s.adopted != nil {
+			var tdev tun.Device
+			tdev, keptAddress, keptRoutes = s.takeAdoptedUnlocked(wgData)
+			return tdev, nil
+		}
+
+		tunFdStr := os.Getenv(ENV_WG_TUN_FD)
+
+		// if on macOS, call findUnusedUTUN to get a new utun device
+		if runtime.GOOS == "darwin" {
+			interfaceName, err := findUnusedUTUN()
+			if err != nil {
+				return nil, err
+			}
+			return tun.CreateTUN(interfaceName, s.config.mtu)
+		}
+
+		if tunFdStr == "" {
+			return tun.CreateTUN(s.interfaceName, s.config.mtu)
+		}
+
+		return createTUNFromFD(tunFdStr, s.config.mtu)
+	}()
+
+	if err != nil {
+		logger.Error("Failed to create TUN device: %v", err)
+		ack.fail(ackErrorf(AckTunnelFailed, "failed to create TUN device: %v", err))
+		return false
+	}
+
+	realInterfaceName, err2 := s.tdev.Name()
+	if err2 == nil {
+		s.interfaceName = realInterfaceName
+	}
+
+	if err := s.startDeviceUnlocked(newTunnelBind(s.sourcePort)); err != nil {
+		logger.Error("Failed to start WireGuard device: %v", err)
+		ack.fail(ackErrorf(AckTunnelFailed, "failed to start WireGuard device: %v", err))
+		s.closeTunnelUnlocked()
+		return false
+	}
+
+	// Bring up the device
+	err = s.dev.Up()
+	if err != nil {
+		logger.Error("Failed to bring up WireGuard device: %v", err)
+		ack.add(AckResult{Step: "bring up WireGuard device", Error: err.Error()})
+		ack.fail(ackErrorf(AckTunnelFailed, "failed to bring up WireGuard device: %v", err))
+	}
+
+	// configure the interface
+	if !keptAddress {
+		err = ConfigureInterface(realInterfaceName, s.wgData)
+		if err != nil {
+			logger.Error("Failed to configure interface: %v", err)
+			ack.add(AckResult{Step: "configure interface", Error: err.Error()})
+			ack.fail(ackErrorf(AckTunnelFailed, "failed to configure interface: %v", err))
+		}
+	}
+
+	if s.httpServer != nil {
+		s.httpServer.SetTunnelIP(s.wgData.TunnelIP)
+	}
+
+	s.startMonitorUnlocked()
+
+	for _, site := range s.wgData.Sites {
+		if s.httpServer != nil {
+			s.httpServer.UpdatePeerStatus(site.SiteId, false, 0)
+			s.httpServer.UpdatePeerPath(site.SiteId, peermonitor.PathDirect, "")
+			s.httpServer.UpdatePeerEndpoint(site.SiteId, site.Endpoint)
+		}
+	}
+
+	// Configure every site at once, a site that fails is reported and skipped
+	peers, failures := ConfigurePeers(s.dev, s.monitor, s.wgData.Sites, s.privateKey, s.endpoint)
+	s.peers = make(map[int]*preparedPeer)
+	for _, peer := range peers {
+		s.peers[peer.site.SiteId] = peer
+	}
+
+	configured := 0
+	for _, site := range s.wgData.Sites {
+		if err := failures[site.SiteId]; err != nil {
+			logger.Error("Failed to configure peer for site %d: %v", site.SiteId, err)
+			ack.add(AckResult{SiteID: site.SiteId, Step: "configure WireGuard peer", Error: err.Error()})
+			s.addEvent(httpserver.EventPeerFailed, site.SiteId, fmt.Sprintf("Failed to configure peer: %v", err))
+			// Routes left up for the site would make adding it later fail
+			removeKeptRoutes(site, keptRoutes)
+			continue
+		}
+		ack.add(AckResult{SiteID: site.SiteId, Step: "configure WireGuard peer", Success: true})
+
+		if !keptRoutes[site.ServerIP] {
+			err = addRouteForServerIP(site.ServerIP, s.interfaceName)
+			if err != nil {
+				logger.Error("Failed to add route for site %d: %v", site.SiteId, err)
+				ack.add(AckResult{SiteID: site.SiteId, Step: "add route for server IP " + site.ServerIP, Error: err.Error()})
+				s.addEvent(httpserver.EventPeerFailed, site.SiteId, fmt.Sprintf("Failed to add route: %v", err))
+				continue
+			}
+		}
+
+		// Add routes for remote subnets
+		if err := addRoutesForRemoteSubnets(unkeptSubnets(site.RemoteSubnets, keptRoutes), s.interfaceName); err != nil {
+			logger.Error("Failed to add routes for remote subnets of site %d: %v", site.SiteId, err)
+			ack.add(AckResult{SiteID: site.SiteId, Step: "add routes for remote subnets", Error: err.Error()})
+			s.addEvent(httpserver.EventPeerFailed, site.SiteId, fmt.Sprintf("Failed to add remote subnet routes: %v", err))
+			continue
+		}
+
+		logger.Info("Configured peer %s", site.PublicKey)
+		ack.add(AckResult{SiteID: site.SiteId, Step: "add routes", Success: true})
+		configured++
+	}
+
+	logger.Info("Configured %d of %d peers", configured, len(s.wgData.Sites))
+	if configured < len(s.wgData.Sites) {
+		ack.fail(ackErrorf(AckPartial, "configured %d of %d sites", configured, len(s.wgData.Sites)))
+	}
+
+	s.monitor.Start()
+	return true
+}
+
+// startDeviceUnlocked creates the WireGuard device on s.tdev and serves UAPI for it.
+// The bind is wrapped so sockets won by birthday punching can be added later.
+// On failure the caller tears down what was started with closeTunnelUnlocked.
+// This function assumes the mutex is already held by the caller
+func (s *session) startDeviceUnlocked(bind conn.Bind) error {
+	// open UAPI file (or use supplied fd)
+	fileUAPI, err := func() (*os.File, error) {
+		uapiFdStr := os.Getenv(ENV_WG_UAPI_FD)
+		if uapiFdStr == "" {
+			return uapiOpen(s.interfaceName)
+		}
+
+		// use supplied fd
+
+		fd, err := strconv.ParseUint(uapiFdStr, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+
+		return os.NewFile(uintptr(fd), ""), nil
+	}()
+	if err != nil {
+		return fmt.Errorf("failed to open UAPI socket: %v", err)
+	}
+
+	s.bind = newPunchBind(bind)
+	s.dev = device.NewDevice(s.tdev, s.bind, device.NewLogger(
+		mapToWireGuardLogLevel(s.config.loggerLevel),
+		"wireguard: ",
+	))
+
+	s.uapiListener, err = uapiListen(s.interfaceName, fileUAPI)
+	if err != nil {
+		fileUAPI.Close()
+		return fmt.Errorf("failed to listen on UAPI socket: %v", err)
+	}
+
+	go func(listener net.Listener, dev *device.Device) {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go dev.IpcHandle(conn)
+		}
+	}(s.uapiListener, s.dev)
+
+	logger.Info("UAPI listener started")
+	return nil
+}
+
+// startMonitorUnlocked starts the probe responder and creates the peer monitor for s.dev.
+// This function assumes the mutex is already held by the caller
+func (s *session) startMonitorUnlocked() {
+	// Answer probes from sites on our own tunnel IP so they can check reachability back to us
+	if s.config.responderPort > 0 {
+		tunnelIP := strings.Split(s.wgData.TunnelIP, "/")[0]
+		s.responder = wgtester.NewServer(net.JoinHostPort(tunnelIP, strconv.Itoa(s.config.responderPort)))
+		if err := s.responder.Start(); err != nil {
+			logger.Error("Failed to start probe responder: %v", err)
+			s.responder = nil
+		}
+	}
+
+	s.monitor = peermonitor.NewPeerMonitor(
+		func(siteID int, connected bool, rtt time.Duration) {
+			if s.httpServer != nil {
+				s.httpServer.UpdatePeerStatus(siteID, connected, rtt)
+			}
+			if connected {
+				logger.Info("Peer %d is now connected (RTT: %v)", siteID, rtt)
+				s.addEvent(httpserver.EventPeerConnected, siteID, fmt.Sprintf("Peer connected (RTT: %v)", rtt))
+			} else {
+				logger.Warn("Peer %d is disconnected", siteID)
+				s.addEvent(httpserver.EventPeerDisconnected, siteID, "Peer disconnected")
+			}
+		},
+		fixKey(s.privateKey.String()),
+		s.olm,
+		s.dev,
+		s.features[CapHolepunch],
+	)
+	s.monitor.SetFailbackAfter(s.config.failbackAfter)
+	s.monitor.SetPathCallback(func(siteID int, path string, relay string) {
+		if s.httpServer != nil {
+			s.httpServer.UpdatePeerPath(siteID, path, relay)
+		}
+		if s.state != nil {
+			s.state.Update(func(state *runtimeState) {
+				if relay == "" {
+					delete(state.Relays, siteID)
+				} else {
+					state.Relays[siteID] = relay
+				}
+			})
+		}
+		if relay != "" {
+			s.addEvent(httpserver.EventPathChanged, siteID, fmt.Sprintf("Peer switched to relay %s", relay))
+		} else {
+			s.addEvent(httpserver.EventPathChanged, siteID, fmt.Sprintf("Peer switched to %s path", path))
+		}
+	})
+}
+
+func (s *session) handlePeerUpdate(updateData UpdatePeerData, ack *ack) {
+	siteConfig := updateData.siteConfig()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev == nil {
+		logger.Error("WireGuard device not initialized")
+		ack.fail(ackErrorf(AckNotReady, "WireGuard device not initialized"))
+		return
+	}
+
+	results, err := s.updatePeerUnlocked(siteConfig)
+	ack.add(results...)
+	if err != nil {
+		logger.Error("Failed to update peer for site %d: %v", siteConfig.SiteId, err)
+		ack.fail(err)
+		return
+	}
+
+	logger.Info("Successfully updated peer for site %d", updateData.SiteId)
+	s.persistUnlocked()
+	if s.httpServer != nil {
+		s.httpServer.UpdatePeerEndpoint(siteConfig.SiteId, siteConfig.Endpoint)
+		s.httpServer.UpdatePeerPath(siteConfig.SiteId, peermonitor.PathDirect, "")
+	}
+}
+
+// handlePeerAdd handles adding a new peer
+func (s *session) handlePeerAdd(addData AddPeerData, ack *ack) {
+	siteConfig := addData.siteConfig()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev == nil {
+		logger.Error("WireGuard device not initialized")
+		ack.fail(ackErrorf(AckNotReady, "WireGuard device not initialized"))
+		return
+	}
+
+	results, err := s.addPeerUnlocked(siteConfig)
+	ack.add(results...)
+	if err != nil {
+		logger.Error("Failed to add peer for site %d: %v", siteConfig.SiteId, err)
+		ack.fail(err)
+		return
+	}
+
+	logger.Info("Successfully added peer for site %d", addData.SiteId)
+	s.persistUnlocked()
+	if s.httpServer != nil {
+		s.httpServer.UpdatePeerEndpoint(siteConfig.SiteId, siteConfig.Endpoint)
+		s.httpServer.UpdatePeerPath(siteConfig.SiteId, peermonitor.PathDirect, "")
+	}
+}
+
+// handlePeerRemove handles removing a peer
+func (s *session) handlePeerRemove(removeData RemovePeerData, ack *ack) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev == nil {
+		logger.Error("WireGuard device not initialized")
+		ack.fail(ackErrorf(AckNotReady, "WireGuard device not initialized"))
+		return
+	}
+
+	results, err := s.removePeerUnlocked(removeData.SiteId)
+	ack.add(results...)
+	if err != nil {
+		logger.Error("Failed to remove peer for site %d: %v", removeData.SiteId, err)
+		ack.fail(err)
+		return
+	}
+
+	logger.Info("Successfully removed peer for site %d", removeData.SiteId)
+	s.persistUnlocked()
+	if s.httpServer != nil {
+		s.httpServer.RemovePeerStatus(removeData.SiteId)
+	}
+}
+
+func (s *session) handlePeerRelay(relayData RelayPeerData, ack *ack) {
+	primaryRelay, err := resolveDomain(relayData.Endpoint)
+	if err != nil {
+		logger.Warn("Failed to resolve primary relay endpoint: %v", err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.monitor == nil {
+		ack.fail(ackErrorf(AckNotReady, "peer monitor not running"))
+		return
+	}
+	s.monitor.HandleFailover(relayData.SiteId, primaryRelay)
+}
+
+func (s *session) handleNoSites(msg websocket.WSMessage) {
+	logger.Info("Received no-sites message - no sites available for connection")
+
+	// if s.stopRegister != nil {
+	// 	s.stopRegister()
+	// 	s.stopRegister = nil
+	// }
+
+	// select {
+	// case <-s.stopHolepunch:
+	// 	// Channel already closed, do nothing
+	// default:
+	// 	close(s.stopHolepunch)
+	// }
+
+	logger.Info("No sites available - stopped registration and holepunch processes")
+}
+
+// handleTerminate tears the session down when Pangolin terminates this olm
+func (s *session) handleTerminate(msg websocket.WSMessage) {
+	logger.Info("Received terminate message")
+
+	// Close from another goroutine, the websocket is closed while this handler runs
+	go func() {
+		s.Close()
+
+		// A terminated olm must not bring the cached tunnel back up
+		if s.cachePath != "" {
+			if err := os.Remove(s.cachePath); err != nil && !os.IsNotExist(err) {
+				logger.Warn("Failed to remove configuration cache: %v", err)
+			}
+		}
+
+		if s.onTerminate != nil {
+			s.onTerminate(s)
+		}
+	}()
+}
+
+func (s *session) onConnect() error {
+	logger.Info("Websocket Connected")
+
+	if s.httpServer != nil {
+		s.httpServer.SetConnectionStatus(true)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil
+	}
+
+	if s.connected {
+		logger.Debug("Already connected, skipping registration")
+		if s.resumed {
+			s.resumed = false
+			go keepSendingPing(s.olm, s.stopPing)
+		}
+		return nil
+	}
+
+	if s.offlineTimer != nil {
+		s.offlineTimer.Stop()
+		s.offlineTimer = nil
+	}
+
+	// A cached tunnel stays up and marked offline until Pangolin sends its configuration
+	if !s.offline {
+		s.setState(httpserver.StateRegistering)
+	}
+
+	data := s.registrationDataUnlocked()
+	logger.Debug("Sending registration message to server: %v", data)
+
+	s.stopRegister = s.olm.SendMessageInterval("olm/wg/register", data, registerInterval)
+
+	go keepSendingPing(s.olm, s.stopPing)
+
+	logger.Info("Sent registration message")
+	return nil
+}
+
+// stopHolepunchingUnlocked closes the hole punch stop channel if it is still open.
+// This function assumes the mutex is already held by the caller
+func (s *session) stopHolepunchingUnlocked() {
+	select {
+	case <-s.stopHolepunch:
+		// Channel already closed, do nothing
+	default:
+		close(s.stopHolepunch)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+)
+
+// shutdown runs cleanup steps in the reverse of the order they were registered,
+// so a step registered after what it depends on is cleaned up before it
+type shutdown struct {
+	name  string
+	steps []shutdownStep
+}
+
+type shutdownStep struct {
+	name string
+	fn   func() error
+}
+
+func newShutdown(name string) *shutdown {
+	return &shutdown{name: name}
+}
+
+// Register adds a cleanup step, registered once the thing it cleans up exists
+func (sd *shutdown) Register(name string, fn func() error) {
+	sd.steps = append(sd.steps, shutdownStep{name: name, fn: fn})
+}
+
+// Run runs the steps newest first and logs each one. A failing step does not stop
+// the others. With a timeout, Run gives up on the steps left once it passes.
+func (sd *shutdown) Run(timeout time.Duration) error {
+	done := make(chan struct{})
+	current := make(chan string, len(sd.steps))
+
+	go func() {
+		defer close(done)
+		for i := len(sd.steps) - 1; i >= 0; i-- {
+			step := sd.steps[i]
+			current <- step.name
+
+			start := time.Now()
+			logger.Info("%s shutdown: %s", sd.name, step.name)
+			if err := step.fn(); err != nil {
+				logger.Warn("%s shutdown: %s failed after %v: %v", sd.name, step.name, time.Since(start), err)
+				continue
+			}
+			logger.Debug("%s shutdown: %s done in %v", sd.name, step.name, time.Since(start))
+		}
+	}()
+
+	if timeout <= 0 {
+		<-done
+		return nil
+	}
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(timeout):
+		var stuck string
+		for len(current) > 0 {
+			stuck = <-current
+		}
+		return fmt.Errorf("%s shutdown timed out after %v during %s", sd.name, timeout, stuck)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"golang.zx2c4.com/wireguard/tun"
+)
+
+const runtimeStateVersion = 1
+
+// runtimeState is what olm records about the tunnel it set up, so the next run
+// can tell whether it exited cleanly and what a crash left behind. Secrets stay
+// in the encrypted configuration cache.
+type runtimeState struct {
+	Version       int            `json:"version"`
+	PID           int            `json:"pid"`
+	OlmID         string         `json:"olmId,omitempty"`
+	InterfaceName string         `json:"interfaceName"`
+	TunnelIP      string         `json:"tunnelIP,omitempty"`
+	ServerIPs     []string       `json:"serverIPs,omitempty"` // Server IPs olm added routes for
+	Subnets       []string       `json:"subnets,omitempty"`   // Remote subnets olm added routes for
+	Relays        map[int]string `json:"relays,omitempty"`    // Relay in use by site ID
+	Clean         bool           `json:"clean"`               // Set when olm exits in an orderly way
+	LeftUp        bool           `json:"leftUp,omitempty"`    // Set when olm exits leaving the interface up for the next run
+	UpdatedAt     time.Time      `json:"updatedAt"`
+}
+
+// stateDir is the state directory of one interface, held under a lock so only
+// one olm uses the interface at a time
+type stateDir struct {
+	mu    sync.Mutex
+	path  string
+	lock  *os.File
+	state runtimeState
+}
+
+// interfaceInUseError is returned by openStateDir when another olm holds the lock
+type interfaceInUseError struct {
+	interfaceName string
+	owner         string
+}
+
+func (e *interfaceInUseError) Error() string {
+	return fmt.Sprintf("interface %s is in use by another olm (pid %s)", e.interfaceName, e.owner)
+}
+
+// openStateDir locks the interface in dir and returns its state directory
+// together with the state of the previous run, nil if there was none
+func openStateDir(dir, interfaceName string) (*stateDir, *runtimeState, error) {
+	if interfaceName == "" || filepath.Base(interfaceName) != interfaceName {
+		return nil, nil, fmt.Errorf("invalid interface name %q", interfaceName)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create state directory: %v", err)
+	}
+
+	lockPath := filepath.Join(dir, interfaceName+".lock")
+	lock, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open lock file: %v", err)
+	}
+	if err := lockFile(lock); err != nil {
+		owner, _ := os.ReadFile(lockPath)
+		lock.Close()
+		return nil, nil, &interfaceInUseError{interfaceName: interfaceName, owner: string(owner)}
+	}
+	lock.Truncate(0)
+	lock.WriteAt([]byte(strconv.Itoa(os.Getpid())), 0)
+
+	sd := &stateDir{
+		path: filepath.Join(dir, interfaceName+".state"),
+		lock: lock,
+	}
+
+	previous, err := readRuntimeState(sd.path)
+	if err != nil {
+		logger.Warn("Ignoring state of the previous run: %v", err)
+		previous = nil
+	}
+
+	sd.state = runtimeState{InterfaceName: interfaceName, Relays: make(map[int]string)}
+	if err := sd.writeUnlocked(); err != nil {
+		sd.Close(false)
+		return nil, nil, err
+	}
+	return sd, previous, nil
+}
+
+// readRuntimeState reads a state file, returning nil without error if there is none
+func readRuntimeState(path string) (*runtimeState, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state: %v", err)
+	}
+
+	var state runtimeState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("failed to decode state: %v", err)
+	}
+	if state.Version != runtimeStateVersion {
+		return nil, fmt.Errorf("unsupported state version %d", state.Version)
+	}
+	return &state, nil
+}
+
+// Update changes the recorded state and writes it out
+func (sd *stateDir) Update(change func(state *runtimeState)) {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	change(&sd.state)
+	if err := sd.writeUnlocked(); err != nil {
+		logger.Warn("Failed to save state: %v", err)
+	}
+}
+
+// Close records whether olm is exiting cleanly and releases the lock
+func (sd *stateDir) Close(clean bool) error {
+	sd.mu.Lock()
+	defer sd.mu.Unlock()
+
+	sd.state.Clean = clean
+	err := sd.writeUnlocked()
+	sd.lock.Close()
+	return err
+}
+
+// writeUnlocked replaces the state file atomically.
+// This function assumes the mutex is already held by the caller
+func (sd *stateDir) writeUnlocked() error {
+	sd.state.Version = runtimeStateVersion
+	sd.state.PID = os.Getpid()
+	sd.state.UpdatedAt = time.Now()
+
+	data, err := json.MarshalIndent(&sd.state, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %v", err)
+	}
+
+	tmp := sd.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	// Make sure the new state is on disk before it replaces the old one
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write state: %v", err)
+	}
+	f.Close()
+
+	if err := os.Rename(tmp, sd.path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace state: %v", err)
+	}
+	return nil
+}
+
+// cleanupLeftovers removes the routes and tunnel address a crashed run left
+// behind. Holding the lock means no other olm owns them.
+func cleanupLeftovers(previous *runtimeState) {
+	if previous == nil || previous.Clean || previous.TunnelIP == "" {
+		return
+	}
+
+	logger.Warn("Previous olm (pid %d) did not exit cleanly, last seen %s", previous.PID, previous.UpdatedAt.Format(time.RFC3339))
+
+	for _, serverIP := range previous.ServerIPs {
+		if err := removeRouteForServerIP(serverIP); err != nil {
+			logger.Debug("Leftover route for server IP %s: %v", serverIP, err)
+		}
+	}
+	for _, subnet := range previous.Subnets {
+		if err := removeRouteForSubnet(subnet); err != nil {
+			logger.Debug("Leftover route for remote subnet %s: %v", subnet, err)
+		}
+	}
+
+	if _, err := net.InterfaceByName(previous.InterfaceName); err != nil {
+		logger.Info("Removed leftover routes of %d sites", len(previous.ServerIPs))
+		return
+	}
+	logger.Warn("Found leftover interface %s, removing tunnel IP %s", previous.InterfaceName, previous.TunnelIP)
+	if err := UnconfigureInterface(previous.InterfaceName, previous.TunnelIP); err != nil {
+		logger.Warn("Failed to remove leftover tunnel IP: %v", err)
+	}
+}
+
+// tunnelLeftUp reports whether the previous olm left its interface up with
+// --leave-tunnel-up and the interface is still there
+func tunnelLeftUp(previous *runtimeState) bool {
+	if previous == nil || !previous.LeftUp || previous.TunnelIP == "" {
+		return false
+	}
+	_, err := net.InterfaceByName(previous.InterfaceName)
+	return err == nil
+}
+
+// adoptedTunnel is an interface the previous olm left up, waiting for the
+// first tunnel this olm brings up
+type adoptedTunnel struct {
+	tdev      tun.Device
+	tunnelIP  string
+	serverIPs []string // Server IPs routed through the interface
+	subnets   []string // Remote subnets routed through the interface
+}
+
+// adoptTunnel attaches to the interface the previous olm left up. Its
+// persistent flag is cleared, so it goes away with this olm unless it is
+// left up again.
+func adoptTunnel(previous *runtimeState, mtu int) (*adoptedTunnel, error) {
+	tdev, err := tun.CreateTUN(previous.InterfaceName, mtu)
+	if err != nil {
+		return nil, fmt.Errorf("failed to attach to %s: %v", previous.InterfaceName, err)
+	}
+	file, ok := tdev.(interface{ File() *os.File })
+	if !ok {
+		tdev.Close()
+		return nil, fmt.Errorf("TUN device cannot be adopted")
+	}
+	if err := setTUNPersist(file.File(), false); err != nil {
+		tdev.Close()
+		return nil, fmt.Errorf("failed to clear the persistent flag: %v", err)
+	}
+
+	logger.Info("Adopted interface %s left up by the previous olm (pid %d)", previous.InterfaceName, previous.PID)
+	return &adoptedTunnel{
+		tdev:      tdev,
+		tunnelIP:  previous.TunnelIP,
+		serverIPs: previous.ServerIPs,
+		subnets:   previous.Subnets,
+	}, nil
+}
@@ -0,0 +1,285 @@
+package stun
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+)
+
+// DefaultPort is the STUN port used when a server address has none
+const DefaultPort = "3478"
+
+// Mapping is how the NAT picks the public address of outgoing traffic (RFC 4787 section 4.1)
+type Mapping string
+
+const (
+	MappingEndpointIndependent     Mapping = "endpoint-independent"
+	MappingAddressDependent        Mapping = "address-dependent"
+	MappingAddressAndPortDependent Mapping = "address-and-port-dependent"
+	MappingUnknown                 Mapping = "unknown"
+)
+
+// Filtering is which incoming traffic the NAT lets through a mapping (RFC 4787 section 5)
+type Filtering string
+
+const (
+	FilteringEndpointIndependent     Filtering = "endpoint-independent"
+	FilteringAddressDependent        Filtering = "address-dependent"
+	FilteringAddressAndPortDependent Filtering = "address-and-port-dependent"
+	FilteringUnknown                 Filtering = "unknown"
+)
+
+// NAT types in the classic naming, derived from the mapping and filtering behaviour
+const (
+	NATOpen               = "open" // No NAT, the local address is the public one
+	NATFullCone           = "full-cone"
+	NATRestrictedCone     = "restricted-cone"
+	NATPortRestrictedCone = "port-restricted-cone"
+	NATCone               = "cone" // Endpoint-independent mapping, filtering unknown
+	NATSymmetric          = "symmetric"
+	NATUnknown            = "unknown"
+)
+
+// Result is the NAT behaviour seen from one local socket
+type Result struct {
+	PublicAddr netip.AddrPort
+	Mapping    Mapping
+	Filtering  Filtering
+	NATType    string
+}
+
+// Client runs the RFC 5780 behaviour discovery tests over a socket it does not own
+type Client struct {
+	conn        net.PacketConn
+	timeout     time.Duration
+	maxAttempts int
+}
+
+// NewClient creates a client sending from conn. The caller keeps ownership of conn.
+func NewClient(conn net.PacketConn) *Client {
+	return &Client{
+		conn:        conn,
+		timeout:     500 * time.Millisecond,
+		maxAttempts: 3,
+	}
+}
+
+// SetTimeout sets how long to wait for each response before retransmitting
+func (c *Client) SetTimeout(timeout time.Duration) {
+	c.timeout = timeout
+}
+
+// SetMaxAttempts sets how many times a request is sent before giving up
+func (c *Client) SetMaxAttempts(attempts int) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	c.maxAttempts = attempts
+}
+
+// Discover classifies the NAT in front of the socket using the given servers
+// (host or host:port). The first server that answers is used for the tests;
+// if it does not support RFC 5780 the mapping is checked against a second
+// server instead and the filtering stays unknown.
+func (c *Client) Discover(servers []string) (*Result, error) {
+	var primary netip.AddrPort
+	var first *message
+	var others []netip.AddrPort
+	for _, server := range servers {
+		addr, err := resolve(server)
+		if err != nil {
+			logger.Debug("Skipping STUN server %s: %v", server, err)
+			continue
+		}
+		if first != nil {
+			others = append(others, addr)
+			continue
+		}
+		resp, err := c.request(addr, false, false)
+		if err != nil {
+			logger.Debug("STUN server %s did not answer: %v", server, err)
+			continue
+		}
+		primary = addr
+		first = resp
+	}
+	if first == nil {
+		return nil, errors.New("no STUN server answered")
+	}
+
+	result := &Result{
+		PublicAddr: first.mapped,
+		Mapping:    MappingUnknown,
+		Filtering:  FilteringUnknown,
+	}
+
+	if c.isLocal(first.mapped) {
+		result.Mapping = MappingEndpointIndependent
+		result.Filtering = FilteringEndpointIndependent
+		result.NATType = NATOpen
+		return result, nil
+	}
+
+	other := first.otherAddress
+	if other.IsValid() && other.Addr() != primary.Addr() && other.Port() != primary.Port() {
+		result.Mapping = c.testMapping(primary, other, first.mapped)
+		result.Filtering = c.testFiltering(primary)
+	} else {
+		result.Mapping = c.compareServers(primary, others, first.mapped)
+	}
+	result.NATType = natType(result.Mapping, result.Filtering)
+	return result, nil
+}
+
+// testMapping runs mapping tests II and III of RFC 5780 section 4.3
+func (c *Client) testMapping(primary, other, mapped netip.AddrPort) Mapping {
+	resp, err := c.request(netip.AddrPortFrom(other.Addr(), primary.Port()), false, false)
+	if err != nil {
+		logger.Debug("STUN mapping test II failed: %v", err)
+		return MappingUnknown
+	}
+	if resp.mapped == mapped {
+		return MappingEndpointIndependent
+	}
+
+	mappedII := resp.mapped
+	resp, err = c.request(other, false, false)
+	if err != nil {
+		logger.Debug("STUN mapping test III failed: %v", err)
+		return MappingUnknown
+	}
+	if resp.mapped == mappedII {
+		return MappingAddressDependent
+	}
+	return MappingAddressAndPortDependent
+}
+
+// testFiltering runs filtering tests II and III of RFC 5780 section 4.4
+func (c *Client) testFiltering(primary netip.AddrPort) Filtering {
+	if _, err := c.request(primary, true, true); err == nil {
+		return FilteringEndpointIndependent
+	}
+	if _, err := c.request(primary, false, true); err == nil {
+		return FilteringAddressDependent
+	}
+	return FilteringAddressAndPortDependent
+}
+
+// compareServers checks the mapping against other servers when the primary
+// one cannot run the RFC 5780 tests. Only the address is known to differ, so
+// a changing mapping is reported as address-dependent.
+func (c *Client) compareServers(primary netip.AddrPort, others []netip.AddrPort, mapped netip.AddrPort) Mapping {
+	for _, addr := range others {
+		if addr.Addr() == primary.Addr() {
+			continue
+		}
+		resp, err := c.request(addr, false, false)
+		if err != nil {
+			logger.Debug("STUN server %s did not answer: %v", addr, err)
+			continue
+		}
+		if resp.mapped == mapped {
+			return MappingEndpointIndependent
+		}
+		return MappingAddressDependent
+	}
+	return MappingUnknown
+}
+
+// request sends a binding request to addr and waits for the matching response
+func (c *Client) request(addr netip.AddrPort, changeIP, changePort bool) (*message, error) {
+	req, err := newBindingRequest(changeIP, changePort)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %v", err)
+	}
+	packet := req.encode()
+	dst := net.UDPAddrFromAddrPort(addr)
+
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < c.maxAttempts; attempt++ {
+		if _, err := c.conn.WriteTo(packet, dst); err != nil {
+			return nil, fmt.Errorf("failed to send request: %v", err)
+		}
+
+		deadline := time.Now().Add(c.timeout)
+		c.conn.SetReadDeadline(deadline)
+		for {
+			n, _, err := c.conn.ReadFrom(buf)
+			if err != nil {
+				var netErr net.Error
+				if errors.As(err, &netErr) && netErr.Timeout() {
+					break
+				}
+				c.conn.SetReadDeadline(time.Time{})
+				return nil, fmt.Errorf("failed to read response: %v", err)
+			}
+			// Late answers to earlier requests and unrelated traffic are dropped
+			resp, err := decode(buf[:n])
+			if err != nil || resp.typ != typeBindingSuccess || resp.txID != req.txID || !resp.mapped.IsValid() {
+				continue
+			}
+			c.conn.SetReadDeadline(time.Time{})
+			return resp, nil
+		}
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	return nil, fmt.Errorf("no response after %d attempts", c.maxAttempts)
+}
+
+// isLocal reports whether mapped is the address of the socket itself
+func (c *Client) isLocal(mapped netip.AddrPort) bool {
+	local, ok := c.conn.LocalAddr().(*net.UDPAddr)
+	if !ok || local.Port != int(mapped.Port()) {
+		return false
+	}
+	if !local.IP.IsUnspecified() {
+		return local.IP.Equal(mapped.Addr().AsSlice())
+	}
+
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(mapped.Addr().AsSlice()) {
+			return true
+		}
+	}
+	return false
+}
+
+// natType names the NAT from its mapping and filtering behaviour
+func natType(mapping Mapping, filtering Filtering) string {
+	switch mapping {
+	case MappingAddressDependent, MappingAddressAndPortDependent:
+		return NATSymmetric
+	case MappingEndpointIndependent:
+		switch filtering {
+		case FilteringEndpointIndependent:
+			return NATFullCone
+		case FilteringAddressDependent:
+			return NATRestrictedCone
+		case FilteringAddressAndPortDependent:
+			return NATPortRestrictedCone
+		}
+		return NATCone
+	}
+	return NATUnknown
+}
+
+// resolve looks up the IPv4 address of a server, adding the default port if needed
+func resolve(server string) (netip.AddrPort, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, DefaultPort)
+	}
+	udpAddr, err := net.ResolveUDPAddr("udp4", server)
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	addrPort := udpAddr.AddrPort()
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port()), nil
+}
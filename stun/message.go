@@ -0,0 +1,210 @@
+package stun
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+const (
+	headerSize  = 20
+	magicCookie = 0x2112A442
+
+	typeBindingRequest = 0x0001
+	typeBindingSuccess = 0x0101
+
+	attrMappedAddress    = 0x0001
+	attrChangeRequest    = 0x0003
+	attrXorMappedAddress = 0x0020
+	attrResponseOrigin   = 0x802B
+	attrOtherAddress     = 0x802C
+
+	familyIPv4 = 0x01
+	familyIPv6 = 0x02
+
+	// CHANGE-REQUEST flags (RFC 5780 section 7.2)
+	changeIP   = 0x04
+	changePort = 0x02
+)
+
+// message is a STUN binding request or response with the attributes olm uses
+type message struct {
+	typ          uint16
+	txID         [12]byte
+	changeIP     bool
+	changePort   bool
+	mapped       netip.AddrPort // XOR-MAPPED-ADDRESS, or MAPPED-ADDRESS from older servers
+	otherAddress netip.AddrPort // Alternate address of an RFC 5780 server
+	responseFrom netip.AddrPort // RESPONSE-ORIGIN
+}
+
+// newBindingRequest creates a binding request with a random transaction ID
+func newBindingRequest(changeIP, changePort bool) (*message, error) {
+	m := &message{typ: typeBindingRequest, changeIP: changeIP, changePort: changePort}
+	if _, err := rand.Read(m.txID[:]); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// encode serializes the message
+func (m *message) encode() []byte {
+	var attrs []byte
+	if m.typ == typeBindingRequest && (m.changeIP || m.changePort) {
+		var flags uint32
+		if m.changeIP {
+			flags |= changeIP
+		}
+		if m.changePort {
+			flags |= changePort
+		}
+		value := make([]byte, 4)
+		binary.BigEndian.PutUint32(value, flags)
+		attrs = appendAttr(attrs, attrChangeRequest, value)
+	}
+	if m.mapped.IsValid() {
+		attrs = appendAttr(attrs, attrXorMappedAddress, m.xorAddress(m.mapped))
+		attrs = appendAttr(attrs, attrMappedAddress, encodeAddress(m.mapped))
+	}
+	if m.responseFrom.IsValid() {
+		attrs = appendAttr(attrs, attrResponseOrigin, encodeAddress(m.responseFrom))
+	}
+	if m.otherAddress.IsValid() {
+		attrs = appendAttr(attrs, attrOtherAddress, encodeAddress(m.otherAddress))
+	}
+
+	b := make([]byte, headerSize, headerSize+len(attrs))
+	binary.BigEndian.PutUint16(b[0:2], m.typ)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(attrs)))
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	copy(b[8:20], m.txID[:])
+	return append(b, attrs...)
+}
+
+// decode parses a STUN message, skipping attributes olm does not use
+func decode(b []byte) (*message, error) {
+	if len(b) < headerSize {
+		return nil, errors.New("message too short")
+	}
+	if b[0]&0xC0 != 0 || binary.BigEndian.Uint32(b[4:8]) != magicCookie {
+		return nil, errors.New("not a STUN message")
+	}
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length%4 != 0 || headerSize+length > len(b) {
+		return nil, errors.New("invalid message length")
+	}
+
+	m := &message{typ: binary.BigEndian.Uint16(b[0:2])}
+	copy(m.txID[:], b[8:20])
+
+	attrs := b[headerSize : headerSize+length]
+	for len(attrs) >= 4 {
+		typ := binary.BigEndian.Uint16(attrs[0:2])
+		size := int(binary.BigEndian.Uint16(attrs[2:4]))
+		padded := (size + 3) &^ 3
+		if 4+padded > len(attrs) {
+			return nil, errors.New("truncated attribute")
+		}
+		value := attrs[4 : 4+size]
+
+		var err error
+		switch typ {
+		case attrXorMappedAddress:
+			m.mapped, err = m.decodeXorAddress(value)
+		case attrMappedAddress:
+			if !m.mapped.IsValid() {
+				m.mapped, err = decodeAddress(value)
+			}
+		case attrOtherAddress:
+			m.otherAddress, err = decodeAddress(value)
+		case attrResponseOrigin:
+			m.responseFrom, err = decodeAddress(value)
+		case attrChangeRequest:
+			if size != 4 {
+				return nil, errors.New("invalid CHANGE-REQUEST")
+			}
+			flags := binary.BigEndian.Uint32(value)
+			m.changeIP = flags&changeIP != 0
+			m.changePort = flags&changePort != 0
+		}
+		if err != nil {
+			return nil, fmt.Errorf("attribute 0x%04x: %v", typ, err)
+		}
+		attrs = attrs[4+padded:]
+	}
+	return m, nil
+}
+
+func appendAttr(b []byte, typ uint16, value []byte) []byte {
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for i := len(value); i%4 != 0; i++ {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func encodeAddress(addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	family := byte(familyIPv4)
+	if ip.Is6() {
+		family = familyIPv6
+	}
+	b := []byte{0, family}
+	b = binary.BigEndian.AppendUint16(b, addr.Port())
+	return append(b, ip.AsSlice()...)
+}
+
+func decodeAddress(b []byte) (netip.AddrPort, error) {
+	if len(b) < 4 {
+		return netip.AddrPort{}, errors.New("address too short")
+	}
+	port := binary.BigEndian.Uint16(b[2:4])
+	switch b[1] {
+	case familyIPv4:
+		if len(b) != 8 {
+			return netip.AddrPort{}, errors.New("invalid IPv4 address")
+		}
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte(b[4:8])), port), nil
+	case familyIPv6:
+		if len(b) != 20 {
+			return netip.AddrPort{}, errors.New("invalid IPv6 address")
+		}
+		return netip.AddrPortFrom(netip.AddrFrom16([16]byte(b[4:20])), port), nil
+	default:
+		return netip.AddrPort{}, fmt.Errorf("unknown address family %d", b[1])
+	}
+}
+
+// xorKey is the cookie followed by the transaction ID, which XOR-MAPPED-ADDRESS is masked with
+func (m *message) xorKey() []byte {
+	key := binary.BigEndian.AppendUint32(nil, magicCookie)
+	return append(key, m.txID[:]...)
+}
+
+func (m *message) xorAddress(addr netip.AddrPort) []byte {
+	b := encodeAddress(addr)
+	m.xorMask(b)
+	return b
+}
+
+func (m *message) decodeXorAddress(b []byte) (netip.AddrPort, error) {
+	plain := append([]byte(nil), b...)
+	m.xorMask(plain)
+	return decodeAddress(plain)
+}
+
+// xorMask masks the port with the top of the cookie and the IP with the start
+// of the key, which is the cookie alone for IPv4
+func (m *message) xorMask(b []byte) {
+	key := m.xorKey()
+	for i := 2; i < len(b) && i < 4; i++ {
+		b[i] ^= key[i-2]
+	}
+	for i := 4; i < len(b) && i-4 < len(key); i++ {
+		b[i] ^= key[i-4]
+	}
+}
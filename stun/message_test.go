@@ -0,0 +1,185 @@
+package stun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net/netip"
+	"testing"
+)
+
+// RFC 5769 section 2.2 transaction ID and mapped address
+var (
+	rfc5769TxID   = [12]byte{0xb7, 0xe7, 0xa7, 0x01, 0xbc, 0x34, 0xd6, 0x86, 0xfa, 0x87, 0xdf, 0xae}
+	rfc5769Mapped = netip.MustParseAddrPort("192.0.2.1:32853")
+)
+
+// findAttr returns the value of the first attribute of typ in an encoded message
+func findAttr(t *testing.T, b []byte, typ uint16) []byte {
+	t.Helper()
+
+	attrs := b[headerSize:]
+	for len(attrs) >= 4 {
+		size := int(binary.BigEndian.Uint16(attrs[2:4]))
+		if binary.BigEndian.Uint16(attrs[0:2]) == typ {
+			return attrs[4 : 4+size]
+		}
+		attrs = attrs[4+(size+3)&^3:]
+	}
+	t.Fatalf("no attribute 0x%04x", typ)
+	return nil
+}
+
+func TestEncodeHeader(t *testing.T) {
+	m := &message{typ: typeBindingRequest, txID: rfc5769TxID}
+	b := m.encode()
+
+	want := append([]byte{0x00, 0x01, 0x00, 0x00, 0x21, 0x12, 0xa4, 0x42}, rfc5769TxID[:]...)
+	if !bytes.Equal(b, want) {
+		t.Errorf("encoded %x, want %x", b, want)
+	}
+}
+
+func TestXorMappedAddress(t *testing.T) {
+	m := &message{typ: typeBindingSuccess, txID: rfc5769TxID, mapped: rfc5769Mapped}
+	b := m.encode()
+
+	want := []byte{0x00, 0x01, 0xa1, 0x47, 0xe1, 0x12, 0xa6, 0x43}
+	if got := findAttr(t, b, attrXorMappedAddress); !bytes.Equal(got, want) {
+		t.Errorf("XOR-MAPPED-ADDRESS = %x, want %x", got, want)
+	}
+
+	decoded, err := decode(b)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if decoded.mapped != rfc5769Mapped {
+		t.Errorf("mapped = %s, want %s", decoded.mapped, rfc5769Mapped)
+	}
+}
+
+func TestXorMappedAddressIPv6(t *testing.T) {
+	mapped := netip.MustParseAddrPort("[2001:db8:1234:5678:11:2233:4455:6677]:32853")
+	m := &message{typ: typeBindingSuccess, txID: rfc5769TxID, mapped: mapped}
+	b := m.encode()
+
+	// RFC 5769 section 2.3
+	want := []byte{
+		0x00, 0x02, 0xa1, 0x47,
+		0x01, 0x13, 0xa9, 0xfa, 0xa5, 0xd3, 0xf1, 0x79,
+		0xbc, 0x25, 0xf4, 0xb5, 0xbe, 0xd2, 0xb9, 0xd9,
+	}
+	if got := findAttr(t, b, attrXorMappedAddress); !bytes.Equal(got, want) {
+		t.Errorf("XOR-MAPPED-ADDRESS = %x, want %x", got, want)
+	}
+
+	decoded, err := decode(b)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if decoded.mapped != mapped {
+		t.Errorf("mapped = %s, want %s", decoded.mapped, mapped)
+	}
+}
+
+func TestDecodeMappedAddressFallback(t *testing.T) {
+	b := make([]byte, headerSize)
+	binary.BigEndian.PutUint16(b[0:2], typeBindingSuccess)
+	binary.BigEndian.PutUint32(b[4:8], magicCookie)
+	b = append(b, appendAttr(nil, attrMappedAddress, encodeAddress(rfc5769Mapped))...)
+	binary.BigEndian.PutUint16(b[2:4], uint16(len(b)-headerSize))
+
+	decoded, err := decode(b)
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if decoded.mapped != rfc5769Mapped {
+		t.Errorf("mapped = %s, want %s", decoded.mapped, rfc5769Mapped)
+	}
+}
+
+func TestChangeRequest(t *testing.T) {
+	tests := []struct {
+		changeIP, changePort bool
+		flags                []byte
+	}{
+		{true, false, []byte{0, 0, 0, 0x04}},
+		{false, true, []byte{0, 0, 0, 0x02}},
+		{true, true, []byte{0, 0, 0, 0x06}},
+	}
+	for _, tt := range tests {
+		m := &message{typ: typeBindingRequest, changeIP: tt.changeIP, changePort: tt.changePort}
+		b := m.encode()
+
+		if got := findAttr(t, b, attrChangeRequest); !bytes.Equal(got, tt.flags) {
+			t.Errorf("CHANGE-REQUEST = %x, want %x", got, tt.flags)
+		}
+		decoded, err := decode(b)
+		if err != nil {
+			t.Fatalf("decode failed: %v", err)
+		}
+		if decoded.changeIP != tt.changeIP || decoded.changePort != tt.changePort {
+			t.Errorf("decoded changeIP=%v changePort=%v, want %v %v", decoded.changeIP, decoded.changePort, tt.changeIP, tt.changePort)
+		}
+	}
+
+	// A request without changes carries no CHANGE-REQUEST
+	m := &message{typ: typeBindingRequest}
+	if b := m.encode(); len(b) != headerSize {
+		t.Errorf("plain request has %d bytes of attributes", len(b)-headerSize)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := &message{
+		typ:          typeBindingSuccess,
+		txID:         rfc5769TxID,
+		mapped:       rfc5769Mapped,
+		otherAddress: netip.MustParseAddrPort("198.51.100.2:3479"),
+		responseFrom: netip.MustParseAddrPort("198.51.100.1:3478"),
+	}
+
+	decoded, err := decode(m.encode())
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if *decoded != *m {
+		t.Errorf("decoded %+v, want %+v", *decoded, *m)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	valid := (&message{typ: typeBindingSuccess, txID: rfc5769TxID, mapped: rfc5769Mapped}).encode()
+
+	badCookie := append([]byte(nil), valid...)
+	badCookie[4] = 0
+
+	badLength := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint16(badLength[2:4], uint16(len(valid)))
+
+	truncated := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint16(truncated[headerSize+2:headerSize+4], 64)
+
+	badChange := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(badChange[4:8], magicCookie)
+	badChange = append(badChange, appendAttr(nil, attrChangeRequest, []byte{0, 6})...)
+	binary.BigEndian.PutUint16(badChange[2:4], uint16(len(badChange)-headerSize))
+
+	badFamily := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(badFamily[4:8], magicCookie)
+	badFamily = append(badFamily, appendAttr(nil, attrOtherAddress, []byte{0, 9, 0, 1, 1, 2, 3, 4})...)
+	binary.BigEndian.PutUint16(badFamily[2:4], uint16(len(badFamily)-headerSize))
+
+	tests := map[string][]byte{
+		"short":                valid[:headerSize-1],
+		"bad cookie":           badCookie,
+		"length past end":      badLength,
+		"truncated attribute":  truncated,
+		"short CHANGE-REQUEST": badChange,
+		"unknown family":       badFamily,
+	}
+	for name, b := range tests {
+		if _, err := decode(b); err == nil {
+			t.Errorf("%s: decoded without error", name)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package stun
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+
+	"github.com/fosrl/newt/logger"
+)
+
+// Server is a minimal RFC 5780 STUN server answering binding requests on two
+// IPs and two ports, enough to stand in for a public server in tests
+type Server struct {
+	primary   netip.AddrPort
+	alternate netip.AddrPort
+	conns     map[netip.AddrPort]*net.UDPConn
+	running   bool
+	runLock   sync.Mutex
+	wg        sync.WaitGroup
+}
+
+// NewServer creates a server listening on primary and alternate (ip:port),
+// which must differ in both IP and port. It also listens on the two mixed
+// combinations so CHANGE-REQUEST can be answered.
+func NewServer(primary, alternate string) (*Server, error) {
+	p, err := netip.ParseAddrPort(primary)
+	if err != nil {
+		return nil, fmt.Errorf("invalid primary address: %v", err)
+	}
+	a, err := netip.ParseAddrPort(alternate)
+	if err != nil {
+		return nil, fmt.Errorf("invalid alternate address: %v", err)
+	}
+	if p.Addr() == a.Addr() || p.Port() == a.Port() {
+		return nil, fmt.Errorf("primary and alternate address must differ in IP and port")
+	}
+	return &Server{primary: p, alternate: a}, nil
+}
+
+// Start begins answering requests in the background
+func (s *Server) Start() error {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	if s.running {
+		return nil
+	}
+
+	s.conns = make(map[netip.AddrPort]*net.UDPConn)
+	for _, ip := range []netip.Addr{s.primary.Addr(), s.alternate.Addr()} {
+		for _, port := range []uint16{s.primary.Port(), s.alternate.Port()} {
+			addr := netip.AddrPortFrom(ip, port)
+			conn, err := net.ListenUDP("udp", net.UDPAddrFromAddrPort(addr))
+			if err != nil {
+				s.closeConnsLocked()
+				return fmt.Errorf("failed to listen on %s: %v", addr, err)
+			}
+			s.conns[addr] = conn
+		}
+	}
+
+	s.running = true
+	for addr, conn := range s.conns {
+		s.wg.Add(1)
+		go s.serve(addr, conn)
+	}
+
+	logger.Info("STUN server listening on %s with alternate %s", s.primary, s.alternate)
+	return nil
+}
+
+// Stop stops answering requests and closes the sockets
+func (s *Server) Stop() {
+	s.runLock.Lock()
+	if !s.running {
+		s.runLock.Unlock()
+		return
+	}
+	s.running = false
+	s.closeConnsLocked()
+	s.runLock.Unlock()
+
+	s.wg.Wait()
+}
+
+func (s *Server) closeConnsLocked() {
+	for _, conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// serve reads requests arriving on local until the socket is closed
+func (s *Server) serve(local netip.AddrPort, conn *net.UDPConn) {
+	defer s.wg.Done()
+
+	buf := make([]byte, 1500)
+	for {
+		n, remote, err := conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return
+		}
+
+		req, err := decode(buf[:n])
+		if err != nil || req.typ != typeBindingRequest {
+			logger.Debug("Ignoring invalid STUN request from %s: %v", remote, err)
+			continue
+		}
+
+		// Answer from the socket the client asked for
+		ip, port := local.Addr(), local.Port()
+		if req.changeIP {
+			ip = s.otherIP(ip)
+		}
+		if req.changePort {
+			port = s.otherPort(port)
+		}
+		from := netip.AddrPortFrom(ip, port)
+
+		resp := &message{
+			typ:          typeBindingSuccess,
+			txID:         req.txID,
+			mapped:       netip.AddrPortFrom(remote.Addr().Unmap(), remote.Port()),
+			otherAddress: netip.AddrPortFrom(s.otherIP(local.Addr()), s.otherPort(local.Port())),
+			responseFrom: from,
+		}
+
+		s.runLock.Lock()
+		out := s.conns[from]
+		s.runLock.Unlock()
+		if out == nil {
+			continue
+		}
+		if _, err := out.WriteToUDPAddrPort(resp.encode(), remote); err != nil {
+			logger.Debug("Failed to answer STUN request from %s: %v", remote, err)
+		}
+	}
+}
+
+func (s *Server) otherIP(ip netip.Addr) netip.Addr {
+	if ip == s.primary.Addr() {
+		return s.alternate.Addr()
+	}
+	return s.primary.Addr()
+}
+
+func (s *Server) otherPort(port uint16) uint16 {
+	if port == s.primary.Port() {
+		return s.alternate.Port()
+	}
+	return s.primary.Port()
+}
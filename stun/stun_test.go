@@ -0,0 +1,215 @@
+package stun
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// freePort returns a UDP port that is currently free on ip
+func freePort(t *testing.T, ip string) uint16 {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(ip)})
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", ip, err)
+	}
+	defer conn.Close()
+	return uint16(conn.LocalAddr().(*net.UDPAddr).Port)
+}
+
+// startServer runs a server on 127.0.0.1 with its alternate on 127.0.0.2
+func startServer(t *testing.T) (primary, alternate netip.AddrPort) {
+	t.Helper()
+
+	primaryPort := freePort(t, "127.0.0.1")
+	alternatePort := freePort(t, "127.0.0.2")
+	for alternatePort == primaryPort {
+		alternatePort = freePort(t, "127.0.0.2")
+	}
+	primary = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), primaryPort)
+	alternate = netip.AddrPortFrom(netip.MustParseAddr("127.0.0.2"), alternatePort)
+
+	server, err := NewServer(primary.String(), alternate.String())
+	if err != nil {
+		t.Fatalf("failed to create server: %v", err)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	return primary, alternate
+}
+
+// newTestClient creates a client on conn that gives up quickly
+func newTestClient(conn net.PacketConn) *Client {
+	client := NewClient(conn)
+	client.SetTimeout(200 * time.Millisecond)
+	client.SetMaxAttempts(1)
+	return client
+}
+
+func listenLoopback(t *testing.T) *net.UDPConn {
+	t.Helper()
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// connectedConn only receives from the address it is connected to, like a
+// port-restricted cone NAT. WriteTo ignores the destination.
+type connectedConn struct {
+	*net.UDPConn
+}
+
+func (c connectedConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	return c.Write(b)
+}
+
+func TestNewServerRequiresDifferentIPAndPort(t *testing.T) {
+	if _, err := NewServer("127.0.0.1:3478", "127.0.0.2:3478"); err == nil {
+		t.Errorf("accepted alternate on the same port")
+	}
+	if _, err := NewServer("127.0.0.1:3478", "127.0.0.1:3479"); err == nil {
+		t.Errorf("accepted alternate on the same IP")
+	}
+	if _, err := NewServer("127.0.0.1", "127.0.0.2:3479"); err == nil {
+		t.Errorf("accepted primary without port")
+	}
+}
+
+func TestServerAnswersFromRequestedAddress(t *testing.T) {
+	primary, alternate := startServer(t)
+	client := newTestClient(listenLoopback(t))
+
+	tests := []struct {
+		changeIP, changePort bool
+		from                 netip.AddrPort
+	}{
+		{false, false, primary},
+		{false, true, netip.AddrPortFrom(primary.Addr(), alternate.Port())},
+		{true, false, netip.AddrPortFrom(alternate.Addr(), primary.Port())},
+		{true, true, alternate},
+	}
+	for _, tt := range tests {
+		resp, err := client.request(primary, tt.changeIP, tt.changePort)
+		if err != nil {
+			t.Fatalf("changeIP=%v changePort=%v: %v", tt.changeIP, tt.changePort, err)
+		}
+		if resp.responseFrom != tt.from {
+			t.Errorf("changeIP=%v changePort=%v: response from %s, want %s", tt.changeIP, tt.changePort, resp.responseFrom, tt.from)
+		}
+		if resp.otherAddress != alternate {
+			t.Errorf("other address = %s, want %s", resp.otherAddress, alternate)
+		}
+	}
+}
+
+func TestDiscoverOpen(t *testing.T) {
+	primary, _ := startServer(t)
+	conn := listenLoopback(t)
+	client := newTestClient(conn)
+
+	result, err := client.Discover([]string{primary.String()})
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	local := conn.LocalAddr().(*net.UDPAddr).AddrPort()
+	if result.PublicAddr != local {
+		t.Errorf("public address = %s, want %s", result.PublicAddr, local)
+	}
+	if result.Mapping != MappingEndpointIndependent {
+		t.Errorf("mapping = %s, want %s", result.Mapping, MappingEndpointIndependent)
+	}
+	if result.Filtering != FilteringEndpointIndependent {
+		t.Errorf("filtering = %s, want %s", result.Filtering, FilteringEndpointIndependent)
+	}
+	if result.NATType != NATOpen {
+		t.Errorf("NAT type = %s, want %s", result.NATType, NATOpen)
+	}
+}
+
+func TestDiscoverSkipsDeadServers(t *testing.T) {
+	primary, _ := startServer(t)
+	dead := netip.AddrPortFrom(primary.Addr(), freePort(t, "127.0.0.1"))
+	client := newTestClient(listenLoopback(t))
+
+	result, err := client.Discover([]string{"invalid host:", dead.String(), primary.String()})
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+	if result.NATType != NATOpen {
+		t.Errorf("NAT type = %s, want %s", result.NATType, NATOpen)
+	}
+
+	if _, err := client.Discover([]string{dead.String()}); err == nil {
+		t.Errorf("Discover succeeded without a server")
+	}
+}
+
+func TestMappingAndFiltering(t *testing.T) {
+	primary, alternate := startServer(t)
+	client := newTestClient(listenLoopback(t))
+
+	first, err := client.request(primary, false, false)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+
+	mapping := client.testMapping(primary, alternate, first.mapped)
+	if mapping != MappingEndpointIndependent {
+		t.Errorf("mapping = %s, want %s", mapping, MappingEndpointIndependent)
+	}
+	filtering := client.testFiltering(primary)
+	if filtering != FilteringEndpointIndependent {
+		t.Errorf("filtering = %s, want %s", filtering, FilteringEndpointIndependent)
+	}
+	if nat := natType(mapping, filtering); nat != NATFullCone {
+		t.Errorf("NAT type = %s, want %s", nat, NATFullCone)
+	}
+}
+
+func TestFilteringPortRestricted(t *testing.T) {
+	primary, _ := startServer(t)
+	conn, err := net.DialUDP("udp4", nil, net.UDPAddrFromAddrPort(primary))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	client := newTestClient(connectedConn{conn})
+
+	// Answers from the other IP or port never arrive
+	filtering := client.testFiltering(primary)
+	if filtering != FilteringAddressAndPortDependent {
+		t.Errorf("filtering = %s, want %s", filtering, FilteringAddressAndPortDependent)
+	}
+	if nat := natType(MappingEndpointIndependent, filtering); nat != NATPortRestrictedCone {
+		t.Errorf("NAT type = %s, want %s", nat, NATPortRestrictedCone)
+	}
+}
+
+func TestNATType(t *testing.T) {
+	tests := []struct {
+		mapping   Mapping
+		filtering Filtering
+		want      string
+	}{
+		{MappingEndpointIndependent, FilteringEndpointIndependent, NATFullCone},
+		{MappingEndpointIndependent, FilteringAddressDependent, NATRestrictedCone},
+		{MappingEndpointIndependent, FilteringAddressAndPortDependent, NATPortRestrictedCone},
+		{MappingEndpointIndependent, FilteringUnknown, NATCone},
+		{MappingAddressDependent, FilteringEndpointIndependent, NATSymmetric},
+		{MappingAddressAndPortDependent, FilteringUnknown, NATSymmetric},
+		{MappingUnknown, FilteringEndpointIndependent, NATUnknown},
+	}
+	for _, tt := range tests {
+		if got := natType(tt.mapping, tt.filtering); got != tt.want {
+			t.Errorf("natType(%s, %s) = %s, want %s", tt.mapping, tt.filtering, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+//go:build linux
+
+package main
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// setTUNPersist sets or clears the persistent flag of the TUN device behind f.
+// A persistent interface keeps its address and routes after olm exits.
+func setTUNPersist(f *os.File, persist bool) error {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	value := 0
+	if persist {
+		value = 1
+	}
+	var ioctlErr error
+	// Control keeps f in non-blocking mode, unlike Fd
+	if err := raw.Control(func(fd uintptr) {
+		ioctlErr = unix.IoctlSetInt(int(fd), unix.TUNSETPERSIST, value)
+	}); err != nil {
+		return err
+	}
+	return ioctlErr
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// setTUNPersist fails, only Linux TUN devices can outlive olm
+func setTUNPersist(f *os.File, persist bool) error {
+	return fmt.Errorf("persistent TUN devices are not supported on %s", runtime.GOOS)
+}
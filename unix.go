@@ -33,3 +33,19 @@ func uapiOpen(interfaceName string) (*os.File, error) {
 func uapiListen(interfaceName string, fileUAPI *os.File) (net.Listener, error) {
 	return ipc.UAPIListen(interfaceName, fileUAPI)
 }
+
+// defaultControlSocket returns the default path of the control socket
+func defaultControlSocket() string {
+	return "/var/run/olm/olm.sock"
+}
+
+// defaultStateDir returns the default directory of the state and lock files
+func defaultStateDir() string {
+	return "/var/lib/olm"
+}
+
+// lockFile takes an exclusive lock on f without waiting. The lock is released
+// when f is closed or the process exits.
+func lockFile(f *os.File) error {
+	return unix.Flock(int(f.Fd()), unix.LOCK_EX|unix.LOCK_NB)
+}
@@ -0,0 +1,503 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+	"github.com/fosrl/olm/httpserver"
+	"golang.zx2c4.com/wireguard/conn"
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// ENV_OLM_HANDOFF_FD names the file descriptor of the handoff state passed to an upgraded olm
+	ENV_OLM_HANDOFF_FD = "OLM_HANDOFF_FD"
+
+	handoffVersion = 1
+
+	// How long the new binary may take to answer "version" before the upgrade is refused
+	upgradeCheckTimeout = 5 * time.Second
+)
+
+// handoffState is the session an olm passes to the binary replacing it, along
+// with the file descriptors of its TUN device and WireGuard UDP sockets
+type handoffState struct {
+	Version       int             `json:"version"`
+	OlmID         string          `json:"olmId"`
+	Secret        string          `json:"secret"`
+	Endpoint      string          `json:"endpoint"`
+	PrivateKey    string          `json:"privateKey"`
+	SourcePort    uint16          `json:"sourcePort"`
+	InterfaceName string          `json:"interfaceName"`
+	WgData        WgData          `json:"wgData"`
+	Relays        map[int]string  `json:"relays,omitempty"` // Relay in use by site ID, for relayed sites
+	Features      map[string]bool `json:"features"`
+	TunFD         int             `json:"tunFd"`
+	UDPFDs        []int           `json:"udpFds"`
+}
+
+// handoff writes the state needed to resume the session to a descriptor that
+// survives exec, then detaches the session from its tunnel. The tunnel keeps
+// running until the process is replaced. Nothing is detached on failure.
+func (s *session) handoff(secret string) (*handoffState, int, error) {
+	s.mu.Lock()
+	if !s.connected || s.offline || s.dev == nil {
+		s.mu.Unlock()
+		return nil, -1, fmt.Errorf("no tunnel to hand off")
+	}
+
+	file, ok := s.tdev.(interface{ File() *os.File })
+	if !ok {
+		s.mu.Unlock()
+		return nil, -1, fmt.Errorf("TUN device cannot be handed off")
+	}
+	bind, ok := s.bind.Bind.(*socketBind)
+	if !ok {
+		s.mu.Unlock()
+		return nil, -1, fmt.Errorf("WireGuard sockets cannot be handed off")
+	}
+
+	state := &handoffState{
+		Version:       handoffVersion,
+		OlmID:         s.id,
+		Secret:        secret,
+		Endpoint:      s.endpoint,
+		PrivateKey:    s.privateKey.String(),
+		SourcePort:    s.sourcePort,
+		InterfaceName: s.interfaceName,
+		WgData:        s.wgData,
+		Relays:        make(map[int]string),
+		Features:      make(map[string]bool),
+		TunFD:         -1,
+	}
+	for name, enabled := range s.features {
+		state.Features[name] = enabled
+	}
+	if s.monitor != nil {
+		for _, site := range s.wgData.Sites {
+			if relay := s.monitor.Relay(site.SiteId); relay != "" {
+				state.Relays[site.SiteId] = relay
+			}
+		}
+	}
+
+	stateFD, err := state.prepare(file.File(), bind.Sockets())
+	s.mu.Unlock()
+	if err != nil {
+		return nil, -1, err
+	}
+
+	s.Shutdown(true)
+	logger.Info("Handing off tunnel %s with %d sites and %d sockets", state.InterfaceName, len(state.WgData.Sites), len(state.UDPFDs))
+	return state, stateFD, nil
+}
+
+// prepare duplicates the descriptors of the TUN device and sockets into the
+// state and writes it out, returning the descriptor of the written state
+func (state *handoffState) prepare(tunFile *os.File, sockets []*net.UDPConn) (int, error) {
+	if len(sockets) == 0 {
+		return -1, fmt.Errorf("WireGuard has no open sockets")
+	}
+
+	var err error
+	state.TunFD, err = dupFile(tunFile)
+	if err != nil {
+		return -1, fmt.Errorf("failed to duplicate TUN device: %v", err)
+	}
+	for _, udpConn := range sockets {
+		fd, err := dupFile(udpConn)
+		if err != nil {
+			state.closeFDs()
+			return -1, fmt.Errorf("failed to duplicate WireGuard socket: %v", err)
+		}
+		state.UDPFDs = append(state.UDPFDs, fd)
+	}
+
+	stateFD, err := writeHandoff(state)
+	if err != nil {
+		state.closeFDs()
+		return -1, err
+	}
+	return stateFD, nil
+}
+
+// closeFDs closes the duplicated descriptors of a handoff that did not happen
+func (state *handoffState) closeFDs() {
+	if state.TunFD >= 0 {
+		os.NewFile(uintptr(state.TunFD), "tun").Close()
+		state.TunFD = -1
+	}
+	for _, fd := range state.UDPFDs {
+		os.NewFile(uintptr(fd), "udp").Close()
+	}
+	state.UDPFDs = nil
+}
+
+// releaseDevice stops the device of a handed off session without touching the
+// interface, address or routes, which live on through the handed off descriptors
+func (s *session) releaseDevice() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.dev == nil {
+		return
+	}
+	if s.bind != nil {
+		s.bind.CloseSockets()
+	}
+	s.dev.Close()
+	s.dev = nil
+	s.tdev = nil
+	s.bind = nil
+}
+
+// upgradeTo hands the session off to binary and replaces this process with it.
+// It only returns if the upgrade failed, after resuming the session on the
+// handed off descriptors.
+func upgradeTo(manager *sessionManager, binary string) {
+	state, stateFD, err := manager.Handoff()
+	if err != nil {
+		logger.Error("Upgrade to %s failed: %v", binary, err)
+		return
+	}
+
+	// Everything else this process holds is closed on exec
+	logger.Info("Starting %s", binary)
+	err = execUpgrade(binary, stateFD)
+
+	logger.Error("Upgrade to %s failed, resuming the tunnel: %v", binary, err)
+	os.NewFile(uintptr(stateFD), "handoff").Close()
+	if err := manager.Resume(state); err != nil {
+		logger.Error("Failed to resume tunnel, connecting again: %v", err)
+		if err := manager.Connect(state.OlmID, state.Secret, state.Endpoint); err != nil {
+			logger.Error("%v", err)
+		}
+	}
+}
+
+// resume takes over a tunnel handed off by the previous olm. The interface
+// address and routes are still in place, so only the device and monitors are
+// started and the peers configured again.
+func (s *session) resume(state *handoffState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	privateKey, err := wgtypes.ParseKey(state.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("invalid private key in handoff: %v", err)
+	}
+	s.privateKey = privateKey
+	s.sourcePort = state.SourcePort
+	s.interfaceName = state.InterfaceName
+	s.wgData = state.WgData
+	for name, enabled := range state.Features {
+		s.features[name] = enabled
+	}
+
+	s.tdev, err = createTUNFromFD(strconv.Itoa(state.TunFD), s.config.mtu)
+	if err != nil {
+		return fmt.Errorf("failed to adopt TUN device: %v", err)
+	}
+
+	bind, err := newHandoffBind(s.sourcePort, state.UDPFDs)
+	if err != nil {
+		s.tdev.Close()
+		s.tdev = nil
+		return err
+	}
+	if err := s.startDeviceUnlocked(bind); err != nil {
+		s.closeTunnelUnlocked()
+		return err
+	}
+
+	peers, failures := ConfigurePeers(s.dev, s.monitor, s.wgData.Sites, s.privateKey, s.endpoint)
+	s.peers = make(map[int]*preparedPeer)
+	for _, peer := range peers {
+		s.peers[peer.site.SiteId] = peer
+	}
+	for siteID, err := range failures {
+		logger.Error("Failed to configure peer for site %d: %v", siteID, err)
+		s.addEvent(httpserver.EventPeerFailed, siteID, fmt.Sprintf("Failed to configure peer: %v", err))
+	}
+
+	if err := s.dev.Up(); err != nil {
+		s.closeTunnelUnlocked()
+		return fmt.Errorf("failed to bring up WireGuard device: %v", err)
+	}
+
+	if s.httpServer != nil {
+		s.httpServer.SetTunnelIP(s.wgData.TunnelIP)
+	}
+
+	s.startMonitorUnlocked()
+	for _, site := range s.wgData.Sites {
+		if s.httpServer != nil {
+			s.httpServer.UpdatePeerStatus(site.SiteId, false, 0)
+			s.httpServer.UpdatePeerEndpoint(site.SiteId, site.Endpoint)
+		}
+	}
+	s.monitor.Start()
+
+	// Put relayed sites back on the relay they were using
+	for siteID, relay := range state.Relays {
+		s.monitor.HandleFailover(siteID, relay)
+	}
+
+	// Pangolin still has this olm registered, so the session carries on without registering
+	s.connected = true
+	s.resumed = true
+	s.recordTunnelUnlocked()
+	s.setState(httpserver.StateConnected)
+
+	logger.Info("Resumed tunnel %s with %d sites", s.interfaceName, len(s.wgData.Sites))
+	return nil
+}
+
+// writeHandoff writes state to an unlinked file and returns a descriptor of it
+// that survives exec
+func writeHandoff(state *handoffState) (int, error) {
+	f, err := os.CreateTemp("", "olm-handoff-*")
+	if err != nil {
+		return -1, fmt.Errorf("failed to create handoff file: %v", err)
+	}
+	defer f.Close()
+	os.Remove(f.Name())
+
+	if err := json.NewEncoder(f).Encode(state); err != nil {
+		return -1, fmt.Errorf("failed to write handoff state: %v", err)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return -1, fmt.Errorf("failed to rewind handoff file: %v", err)
+	}
+	return dupFile(f)
+}
+
+// loadHandoff reads the state handed off by the previous olm, if this process
+// was started by an upgrade
+func loadHandoff() (*handoffState, error) {
+	fdStr := os.Getenv(ENV_OLM_HANDOFF_FD)
+	if fdStr == "" {
+		return nil, nil
+	}
+	os.Unsetenv(ENV_OLM_HANDOFF_FD)
+
+	fd, err := strconv.ParseUint(fdStr, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", ENV_OLM_HANDOFF_FD, err)
+	}
+	f := os.NewFile(uintptr(fd), "handoff")
+	defer f.Close()
+
+	var state handoffState
+	if err := json.NewDecoder(f).Decode(&state); err != nil {
+		return nil, fmt.Errorf("failed to read handoff state: %v", err)
+	}
+	if state.Version != handoffVersion {
+		return nil, fmt.Errorf("unsupported handoff version %d", state.Version)
+	}
+	if err := state.WgData.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid handoff configuration: %v", err)
+	}
+	return &state, nil
+}
+
+// checkUpgradeBinary makes sure binary runs before the running olm hands off to it
+func checkUpgradeBinary(binary string) error {
+	info, err := os.Stat(binary)
+	if err != nil {
+		return fmt.Errorf("invalid binary: %v", err)
+	}
+	if !info.Mode().IsRegular() || info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not an executable file", binary)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), upgradeCheckTimeout)
+	defer cancel()
+	out, err := exec.CommandContext(ctx, binary, "version").Output()
+	if err != nil {
+		return fmt.Errorf("%s does not run: %v", binary, err)
+	}
+	logger.Info("Upgrading from olm %s to %s", olmVersion, strings.TrimSpace(string(out)))
+	return nil
+}
+
+// socketBind serves WireGuard on UDP sockets it opens on a fixed port, or
+// inherits from the previous olm. Unlike the default bind it exposes its
+// sockets, so they can be handed to the next olm on upgrade.
+type socketBind struct {
+	mu    sync.Mutex
+	port  uint16
+	conns []*net.UDPConn // Inherited sockets until the first Open, then the open ones
+	open  bool
+}
+
+func newSocketBind(port uint16) *socketBind {
+	return &socketBind{port: port}
+}
+
+// newHandoffBind adopts the sockets handed off by the previous olm
+func newHandoffBind(port uint16, fds []int) (*socketBind, error) {
+	b := newSocketBind(port)
+	for _, fd := range fds {
+		f := os.NewFile(uintptr(fd), "udp")
+		pc, err := net.FilePacketConn(f)
+		f.Close()
+		if err != nil {
+			b.closeConns()
+			return nil, fmt.Errorf("failed to adopt WireGuard socket: %v", err)
+		}
+		udpConn, ok := pc.(*net.UDPConn)
+		if !ok {
+			pc.Close()
+			b.closeConns()
+			return nil, fmt.Errorf("handed off socket is not UDP")
+		}
+		b.conns = append(b.conns, udpConn)
+	}
+	return b, nil
+}
+
+// Open serves the inherited sockets, or opens fresh ones on the fixed port.
+// The requested port is ignored like with fixedPortBind.
+func (b *socketBind) Open(port uint16) ([]conn.ReceiveFunc, uint16, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.open {
+		return nil, 0, conn.ErrBindAlreadyOpen
+	}
+
+	if len(b.conns) == 0 {
+		v4, err := net.ListenUDP("udp4", &net.UDPAddr{Port: int(b.port)})
+		if err != nil {
+			return nil, 0, err
+		}
+		b.conns = append(b.conns, v4)
+		b.port = uint16(v4.LocalAddr().(*net.UDPAddr).Port)
+
+		// IPv6 is optional, as with the default bind
+		if v6, err := net.ListenUDP("udp6", &net.UDPAddr{Port: int(b.port)}); err == nil {
+			b.conns = append(b.conns, v6)
+		} else {
+			logger.Debug("Not listening on IPv6: %v", err)
+		}
+	}
+
+	b.open = true
+	fns := make([]conn.ReceiveFunc, 0, len(b.conns))
+	for _, udpConn := range b.conns {
+		fns = append(fns, receiveFrom(udpConn))
+	}
+	return fns, b.port, nil
+}
+
+// Close closes the sockets. Inherited sockets are kept until they were opened.
+func (b *socketBind) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+	b.open = false
+	return b.closeConns()
+}
+
+// Sockets returns the open sockets
+func (b *socketBind) Sockets() []*net.UDPConn {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.open {
+		return nil
+	}
+	return append([]*net.UDPConn(nil), b.conns...)
+}
+
+// SetMark is a no-op, olm never sets a firewall mark on the device
+func (b *socketBind) SetMark(mark uint32) error {
+	return nil
+}
+
+func (b *socketBind) Send(bufs [][]byte, ep conn.Endpoint) error {
+	b.mu.Lock()
+	conns := b.conns
+	b.mu.Unlock()
+
+	stdEp, ok := ep.(*conn.StdNetEndpoint)
+	if !ok {
+		return conn.ErrWrongEndpointType
+	}
+	udpConn := socketFor(conns, stdEp.AddrPort.Addr())
+	if udpConn == nil {
+		return fmt.Errorf("no socket for %s", stdEp.AddrPort)
+	}
+	for _, buf := range bufs {
+		if _, err := udpConn.WriteToUDPAddrPort(buf, stdEp.AddrPort); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *socketBind) ParseEndpoint(s string) (conn.Endpoint, error) {
+	addrPort, err := netip.ParseAddrPort(s)
+	if err != nil {
+		return nil, err
+	}
+	return &conn.StdNetEndpoint{AddrPort: addrPort}, nil
+}
+
+func (b *socketBind) BatchSize() int {
+	return 1
+}
+
+// closeConns closes every socket of the bind.
+// This function assumes the mutex is already held by the caller
+func (b *socketBind) closeConns() error {
+	var firstErr error
+	for _, udpConn := range b.conns {
+		if err := udpConn.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	b.conns = nil
+	return firstErr
+}
+
+// socketFor picks the socket of the address family of addr
+func socketFor(conns []*net.UDPConn, addr netip.Addr) *net.UDPConn {
+	for _, udpConn := range conns {
+		local, ok := udpConn.LocalAddr().(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		if (local.IP.To4() != nil) == addr.Unmap().Is4() {
+			return udpConn
+		}
+	}
+	return nil
+}
+
+// receiveFrom reads one packet at a time from a socket
+func receiveFrom(udpConn *net.UDPConn) conn.ReceiveFunc {
+	return func(packets [][]byte, sizes []int, eps []conn.Endpoint) (int, error) {
+		n, addr, err := udpConn.ReadFromUDPAddrPort(packets[0])
+		if err != nil {
+			return 0, err
+		}
+		sizes[0] = n
+		eps[0] = &conn.StdNetEndpoint{AddrPort: netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}
+		return 1, nil
+	}
+}
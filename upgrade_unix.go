@@ -0,0 +1,51 @@
+//go:build !windows
+
+package main
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+// dupFile duplicates the descriptor of f without close-on-exec, so it survives exec
+func dupFile(f syscall.Conn) (int, error) {
+	raw, err := f.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+
+	newFD := -1
+	var dupErr error
+	// Control keeps f in non-blocking mode, unlike Fd
+	if err := raw.Control(func(fd uintptr) {
+		newFD, dupErr = unix.Dup(int(fd))
+	}); err != nil {
+		return -1, err
+	}
+	return newFD, dupErr
+}
+
+// newTunnelBind returns the bind WireGuard uses on port. Its sockets can be
+// handed off on upgrade.
+func newTunnelBind(port uint16) conn.Bind {
+	return newSocketBind(port)
+}
+
+// execUpgrade replaces this process with binary, keeping the process ID and
+// the descriptors in the handoff state. It only returns on failure.
+func execUpgrade(binary string, stateFD int) error {
+	env := []string{ENV_OLM_HANDOFF_FD + "=" + strconv.Itoa(stateFD)}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, ENV_OLM_HANDOFF_FD+"=") {
+			env = append(env, kv)
+		}
+	}
+
+	args := append([]string{binary}, os.Args[1:]...)
+	return syscall.Exec(binary, args, env)
+}
@@ -0,0 +1,23 @@
+//go:build windows
+
+package main
+
+import (
+	"fmt"
+	"syscall"
+
+	"golang.zx2c4.com/wireguard/conn"
+)
+
+func dupFile(f syscall.Conn) (int, error) {
+	return -1, fmt.Errorf("upgrades are not supported on Windows")
+}
+
+// newTunnelBind returns the bind WireGuard uses on port
+func newTunnelBind(port uint16) conn.Bind {
+	return NewFixedPortBind(port)
+}
+
+func execUpgrade(binary string, stateFD int) error {
+	return fmt.Errorf("upgrades are not supported on Windows")
+}
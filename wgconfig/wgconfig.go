@@ -0,0 +1,169 @@
+package wgconfig
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+const (
+	// PathDirect means the peer is reached on its own (hole punched) endpoint
+	PathDirect = "direct"
+	// PathRelay means the peer is reached through a relay
+	PathRelay = "relay"
+
+	// DefaultKeepalive is the persistent keepalive used for site peers
+	DefaultKeepalive = time.Second
+)
+
+// PeerSpec describes the desired WireGuard configuration of one peer
+type PeerSpec struct {
+	PublicKey    wgtypes.Key
+	PresharedKey *wgtypes.Key   // nil for none
+	Endpoint     netip.AddrPort // Zero value leaves the endpoint unchanged
+	Path         string         // PathDirect or PathRelay, not rendered
+	AllowedIPs   []netip.Prefix // Replace the peer's allowed IPs when non-nil
+	Keepalive    time.Duration  // Persistent keepalive, 0 leaves it unchanged
+	UpdateOnly   bool           // Only update an existing peer, never create one
+	Remove       bool           // Remove the peer, every other field is ignored
+}
+
+// Config is a device configuration applied with a single IpcSet
+type Config struct {
+	PrivateKey *wgtypes.Key // nil leaves the device key unchanged
+	Peers      []PeerSpec
+}
+
+// UAPI renders the configuration as WireGuard UAPI set text. The same
+// configuration always renders to the same text.
+func (c Config) UAPI() string {
+	var b strings.Builder
+	if c.PrivateKey != nil {
+		fmt.Fprintf(&b, "private_key=%s\n", hexKey(*c.PrivateKey))
+	}
+	for _, peer := range c.Peers {
+		peer.writeUAPI(&b)
+	}
+	return b.String()
+}
+
+// UAPI renders the peer as WireGuard UAPI set text
+func (p PeerSpec) UAPI() string {
+	var b strings.Builder
+	p.writeUAPI(&b)
+	return b.String()
+}
+
+func (p PeerSpec) writeUAPI(b *strings.Builder) {
+	fmt.Fprintf(b, "public_key=%s\n", hexKey(p.PublicKey))
+
+	if p.Remove {
+		b.WriteString("remove=true\n")
+		return
+	}
+	if p.UpdateOnly {
+		b.WriteString("update_only=true\n")
+	}
+	if p.PresharedKey != nil {
+		fmt.Fprintf(b, "preshared_key=%s\n", hexKey(*p.PresharedKey))
+	}
+	if p.Endpoint.IsValid() {
+		fmt.Fprintf(b, "endpoint=%s\n", p.Endpoint)
+	}
+	if p.Keepalive > 0 {
+		fmt.Fprintf(b, "persistent_keepalive_interval=%d\n", int(p.Keepalive.Seconds()))
+	}
+	if p.AllowedIPs != nil {
+		b.WriteString("replace_allowed_ips=true\n")
+		for _, prefix := range canonicalPrefixes(p.AllowedIPs) {
+			fmt.Fprintf(b, "allowed_ip=%s\n", prefix)
+		}
+	}
+}
+
+// WithEndpoint returns a copy of the peer pointed at endpoint over path
+func (p PeerSpec) WithEndpoint(endpoint netip.AddrPort, path string) PeerSpec {
+	p.Endpoint = endpoint
+	p.Path = path
+	p.AllowedIPs = append([]netip.Prefix(nil), p.AllowedIPs...)
+	return p
+}
+
+// RemovePeer returns the spec that removes the peer with the given public key
+func RemovePeer(publicKey wgtypes.Key) PeerSpec {
+	return PeerSpec{PublicKey: publicKey, Remove: true}
+}
+
+// ParseKey parses a base64 WireGuard key
+func ParseKey(key string) (wgtypes.Key, error) {
+	parsed, err := wgtypes.ParseKey(strings.TrimSpace(key))
+	if err != nil {
+		return wgtypes.Key{}, fmt.Errorf("invalid key: %v", err)
+	}
+	return parsed, nil
+}
+
+// ParseEndpoint parses a resolved ip:port endpoint
+func ParseEndpoint(endpoint string) (netip.AddrPort, error) {
+	addrPort, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("invalid endpoint %q: %v", endpoint, err)
+	}
+	return addrPort, nil
+}
+
+// SiteAllowedIPs returns the allowed IPs of a site: its server IP as a single
+// host route, plus its comma-separated remote subnets
+func SiteAllowedIPs(serverIP string, remoteSubnets string) ([]netip.Prefix, error) {
+	addr, err := netip.ParseAddr(strings.Split(strings.TrimSpace(serverIP), "/")[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid server IP %q: %v", serverIP, err)
+	}
+	prefixes := []netip.Prefix{netip.PrefixFrom(addr, addr.BitLen())}
+
+	for _, subnet := range strings.Split(remoteSubnets, ",") {
+		subnet = strings.TrimSpace(subnet)
+		if subnet == "" {
+			continue
+		}
+		prefix, err := netip.ParsePrefix(subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote subnet %q: %v", subnet, err)
+		}
+		prefixes = append(prefixes, prefix)
+	}
+
+	return prefixes, nil
+}
+
+// canonicalPrefixes masks, sorts and deduplicates prefixes
+func canonicalPrefixes(prefixes []netip.Prefix) []netip.Prefix {
+	canonical := make([]netip.Prefix, 0, len(prefixes))
+	for _, prefix := range prefixes {
+		canonical = append(canonical, prefix.Masked())
+	}
+
+	sort.Slice(canonical, func(i, j int) bool {
+		if c := canonical[i].Addr().Compare(canonical[j].Addr()); c != 0 {
+			return c < 0
+		}
+		return canonical[i].Bits() < canonical[j].Bits()
+	})
+
+	unique := make([]netip.Prefix, 0, len(canonical))
+	for _, prefix := range canonical {
+		if len(unique) == 0 || prefix != unique[len(unique)-1] {
+			unique = append(unique, prefix)
+		}
+	}
+	return unique
+}
+
+func hexKey(key wgtypes.Key) string {
+	return hex.EncodeToString(key[:])
+}
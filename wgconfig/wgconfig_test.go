@@ -0,0 +1,187 @@
+package wgconfig
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
+)
+
+// testKey returns a key with every byte set to b
+func testKey(b byte) wgtypes.Key {
+	var key wgtypes.Key
+	for i := range key {
+		key[i] = b
+	}
+	return key
+}
+
+// hexOf is the UAPI form of testKey(b)
+func hexOf(b byte) string {
+	return strings.Repeat(fmt.Sprintf("%02x", b), 32)
+}
+
+func TestUAPI(t *testing.T) {
+	psk := testKey(0x03)
+	direct := PeerSpec{
+		PublicKey:  testKey(0x01),
+		Endpoint:   netip.MustParseAddrPort("203.0.113.7:51820"),
+		Path:       PathDirect,
+		AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.90.128.1/32")},
+		Keepalive:  DefaultKeepalive,
+	}
+
+	tests := []struct {
+		name string
+		spec PeerSpec
+		want string
+	}{
+		{
+			name: "direct peer",
+			spec: direct,
+			want: "public_key=" + hexOf(0x01) + "\n" +
+				"endpoint=203.0.113.7:51820\n" +
+				"persistent_keepalive_interval=1\n" +
+				"replace_allowed_ips=true\n" +
+				"allowed_ip=100.90.128.1/32\n",
+		},
+		{
+			name: "relayed peer",
+			spec: direct.WithEndpoint(netip.MustParseAddrPort("198.51.100.2:21820"), PathRelay),
+			want: "public_key=" + hexOf(0x01) + "\n" +
+				"endpoint=198.51.100.2:21820\n" +
+				"persistent_keepalive_interval=1\n" +
+				"replace_allowed_ips=true\n" +
+				"allowed_ip=100.90.128.1/32\n",
+		},
+		{
+			name: "update only with preshared key",
+			spec: PeerSpec{
+				PublicKey:    testKey(0x01),
+				PresharedKey: &psk,
+				Endpoint:     netip.MustParseAddrPort("[2001:db8::1]:51820"),
+				UpdateOnly:   true,
+			},
+			want: "public_key=" + hexOf(0x01) + "\n" +
+				"update_only=true\n" +
+				"preshared_key=" + hexOf(0x03) + "\n" +
+				"endpoint=[2001:db8::1]:51820\n",
+		},
+		{
+			name: "remove",
+			spec: RemovePeer(testKey(0x01)),
+			want: "public_key=" + hexOf(0x01) + "\n" +
+				"remove=true\n",
+		},
+		{
+			name: "remove ignores other fields",
+			spec: PeerSpec{PublicKey: testKey(0x01), Remove: true, UpdateOnly: true, Endpoint: direct.Endpoint},
+			want: "public_key=" + hexOf(0x01) + "\n" +
+				"remove=true\n",
+		},
+		{
+			name: "sorted allowed IPs",
+			spec: PeerSpec{
+				PublicKey: testKey(0x01),
+				AllowedIPs: []netip.Prefix{
+					netip.MustParsePrefix("10.0.5.9/16"),
+					netip.MustParsePrefix("100.90.128.1/32"),
+					netip.MustParsePrefix("10.0.0.0/8"),
+					netip.MustParsePrefix("10.0.0.0/16"),
+					netip.MustParsePrefix("fd00::1/64"),
+				},
+			},
+			want: "public_key=" + hexOf(0x01) + "\n" +
+				"replace_allowed_ips=true\n" +
+				"allowed_ip=10.0.0.0/8\n" +
+				"allowed_ip=10.0.0.0/16\n" +
+				"allowed_ip=100.90.128.1/32\n" +
+				"allowed_ip=fd00::/64\n",
+		},
+		{
+			name: "no endpoint",
+			spec: PeerSpec{
+				PublicKey:  testKey(0x01),
+				AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.90.128.1/32")},
+				Keepalive:  25 * time.Second,
+			},
+			want: "public_key=" + hexOf(0x01) + "\n" +
+				"persistent_keepalive_interval=25\n" +
+				"replace_allowed_ips=true\n" +
+				"allowed_ip=100.90.128.1/32\n",
+		},
+		{
+			name: "empty allowed IPs clear the peer's",
+			spec: PeerSpec{PublicKey: testKey(0x01), AllowedIPs: []netip.Prefix{}},
+			want: "public_key=" + hexOf(0x01) + "\n" +
+				"replace_allowed_ips=true\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.spec.UAPI(); got != tt.want {
+				t.Errorf("UAPI() =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConfigUAPI(t *testing.T) {
+	privateKey := testKey(0x02)
+	config := Config{
+		PrivateKey: &privateKey,
+		Peers: []PeerSpec{
+			{PublicKey: testKey(0x01), Endpoint: netip.MustParseAddrPort("203.0.113.7:51820")},
+			RemovePeer(testKey(0x04)),
+		},
+	}
+
+	want := "private_key=" + hexOf(0x02) + "\n" +
+		"public_key=" + hexOf(0x01) + "\n" +
+		"endpoint=203.0.113.7:51820\n" +
+		"public_key=" + hexOf(0x04) + "\n" +
+		"remove=true\n"
+	if got := config.UAPI(); got != want {
+		t.Errorf("UAPI() =\n%s\nwant\n%s", got, want)
+	}
+	if config.UAPI() != config.UAPI() {
+		t.Errorf("UAPI() is not stable")
+	}
+}
+
+func TestWithEndpointCopiesAllowedIPs(t *testing.T) {
+	spec := PeerSpec{AllowedIPs: []netip.Prefix{netip.MustParsePrefix("100.90.128.1/32")}}
+	relayed := spec.WithEndpoint(netip.MustParseAddrPort("198.51.100.2:21820"), PathRelay)
+	relayed.AllowedIPs[0] = netip.MustParsePrefix("10.0.0.0/8")
+
+	if spec.AllowedIPs[0] != netip.MustParsePrefix("100.90.128.1/32") {
+		t.Errorf("WithEndpoint shares allowed IPs with the original spec")
+	}
+	if relayed.Path != PathRelay || spec.Path != "" {
+		t.Errorf("path = %q, original %q", relayed.Path, spec.Path)
+	}
+}
+
+func TestSiteAllowedIPs(t *testing.T) {
+	prefixes, err := SiteAllowedIPs("100.90.128.1/24", "10.0.0.0/24, ,192.168.1.0/24")
+	if err != nil {
+		t.Fatalf("SiteAllowedIPs failed: %v", err)
+	}
+	want := []string{"100.90.128.1/32", "10.0.0.0/24", "192.168.1.0/24"}
+	if len(prefixes) != len(want) {
+		t.Fatalf("prefixes = %v, want %v", prefixes, want)
+	}
+	for i, prefix := range prefixes {
+		if prefix.String() != want[i] {
+			t.Errorf("prefix %d = %s, want %s", i, prefix, want[i])
+		}
+	}
+
+	if _, err := SiteAllowedIPs("100.90.128.1", "10.0.0.0/33"); err == nil {
+		t.Errorf("invalid remote subnet was accepted")
+	}
+}
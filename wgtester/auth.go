@@ -0,0 +1,27 @@
+package wgtester
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Context string mixed into every derived probe key
+const authKeyInfo = "olm wgtester v2 hmac"
+
+// DeriveSessionKey derives the HMAC key of one client session from the
+// key material shared between olm and the site
+func DeriveSessionKey(material []byte, sessionID uint32) []byte {
+	info := make([]byte, len(authKeyInfo)+4)
+	copy(info, authKeyInfo)
+	binary.BigEndian.PutUint32(info[len(authKeyInfo):], sessionID)
+
+	key := make([]byte, sha256.Size)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, material, nil, info), key); err != nil {
+		// HKDF only fails when asked for more than 255 hashes of output
+		panic(err)
+	}
+	return key
+}
@@ -0,0 +1,116 @@
+package wgtester
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	// Protocol version 1: magic, type and timestamp only
+	ProtocolV1 uint8 = 1
+	// Protocol version 2: adds a version byte, flags, a session ID and a sequence number
+	ProtocolV2 uint8 = 2
+
+	// v2 packet format:
+	// - 4 bytes: magic header (0xDEADBEEF)
+	// - 1 byte: packet type (1 = request, 2 = response)
+	// - 1 byte: protocol version (2)
+	// - 1 byte: flags (bit 0 = authenticated)
+	// - 4 bytes: session ID (random per client)
+	// - 4 bytes: sequence number
+	// - 8 bytes: timestamp (for round-trip timing)
+	// - 16 bytes: truncated HMAC-SHA256 of the above, only when authenticated
+	packetSizeV2 = 23
+
+	// Flag set on v2 packets that carry an authentication tag
+	flagAuthenticated uint8 = 0x01
+	// Size of the truncated HMAC-SHA256 tag
+	authTagSize = 16
+)
+
+var errMalformedPacket = errors.New("malformed packet")
+
+// packet is a decoded wgtester packet of either protocol version
+type packet struct {
+	version   uint8
+	typ       uint8
+	flags     uint8
+	sessionID uint32
+	seq       uint32
+	timestamp int64
+}
+
+// marshal encodes the packet in the format of its protocol version
+func (p packet) marshal() []byte {
+	if p.version == ProtocolV1 {
+		buf := make([]byte, packetSize)
+		binary.BigEndian.PutUint32(buf[0:4], magicHeader)
+		buf[4] = p.typ
+		binary.BigEndian.PutUint64(buf[5:13], uint64(p.timestamp))
+		return buf
+	}
+
+	buf := make([]byte, packetSizeV2)
+	binary.BigEndian.PutUint32(buf[0:4], magicHeader)
+	buf[4] = p.typ
+	buf[5] = ProtocolV2
+	buf[6] = p.flags
+	binary.BigEndian.PutUint32(buf[7:11], p.sessionID)
+	binary.BigEndian.PutUint32(buf[11:15], p.seq)
+	binary.BigEndian.PutUint64(buf[15:23], uint64(p.timestamp))
+	return buf
+}
+
+// marshalAuth encodes a v2 packet with the authenticated flag and an HMAC tag
+func (p packet) marshalAuth(key []byte) []byte {
+	p.version = ProtocolV2
+	p.flags |= flagAuthenticated
+	buf := p.marshal()
+	return append(buf, authTag(key, buf)...)
+}
+
+// authTag computes the truncated HMAC-SHA256 of a packet
+func authTag(key []byte, buf []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(buf)
+	return mac.Sum(nil)[:authTagSize]
+}
+
+// authenticated reports whether buf is a v2 packet with a valid tag for key
+func authenticated(buf []byte, key []byte) bool {
+	if len(buf) != packetSizeV2+authTagSize || buf[6]&flagAuthenticated == 0 {
+		return false
+	}
+	return hmac.Equal(buf[packetSizeV2:], authTag(key, buf[:packetSizeV2]))
+}
+
+// parsePacket decodes a v1 or v2 packet. The version is told apart by length.
+// The authentication tag of a v2 packet is not checked here.
+func parsePacket(buf []byte) (packet, error) {
+	if len(buf) < packetSize || binary.BigEndian.Uint32(buf[0:4]) != magicHeader {
+		return packet{}, errMalformedPacket
+	}
+
+	p := packet{typ: buf[4]}
+	if p.typ != packetTypeRequest && p.typ != packetTypeResponse {
+		return packet{}, errMalformedPacket
+	}
+
+	switch {
+	case len(buf) == packetSize:
+		p.version = ProtocolV1
+		p.timestamp = int64(binary.BigEndian.Uint64(buf[5:13]))
+	case (len(buf) == packetSizeV2 || len(buf) == packetSizeV2+authTagSize) && buf[5] == ProtocolV2:
+		p.version = ProtocolV2
+		p.flags = buf[6]
+		p.sessionID = binary.BigEndian.Uint32(buf[7:11])
+		p.seq = binary.BigEndian.Uint32(buf[11:15])
+		p.timestamp = int64(binary.BigEndian.Uint64(buf[15:23]))
+	default:
+		return packet{}, errMalformedPacket
+	}
+
+	return p, nil
+}
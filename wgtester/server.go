@@ -0,0 +1,320 @@
+package wgtester
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/fosrl/newt/logger"
+)
+
+const (
+	// Default number of requests per second answered for each source IP
+	defaultRate = 50
+	// Default burst allowed above the rate for each source IP
+	defaultBurst = 100
+	// Maximum number of source IPs tracked before the least recently seen is evicted
+	maxTrackedSources = 4096
+	// Maximum number of derived session keys cached before the cache is emptied
+	maxCachedKeys = 4096
+)
+
+// SourceStats holds the counters of a single source IP
+type SourceStats struct {
+	Requests  uint64 `json:"requests"`
+	Responses uint64 `json:"responses"`
+	Limited   uint64 `json:"limited"`   // Requests dropped by the rate limiter
+	Malformed uint64 `json:"malformed"` // Packets that were not valid requests
+
+	Unauthenticated uint64    `json:"unauthenticated"` // Requests dropped for a missing or bad tag
+	LastSeen        time.Time `json:"lastSeen"`
+}
+
+// sourceState is the rate limiter and stats of a single source IP
+type sourceState struct {
+	tokens     float64
+	lastRefill time.Time
+	stats      SourceStats
+}
+
+// Server answers wgtester request packets with response packets
+type Server struct {
+	addr       string
+	conn       *net.UDPConn
+	rate       float64
+	burst      int
+	sources    map[string]*sourceState
+	authKey    []byte            // Key material for authenticated probes, nil for none
+	keys       map[uint32][]byte // Session keys of authenticated sessions, by session ID
+	statsLock  sync.Mutex
+	running    bool
+	runLock    sync.Mutex
+	shutdownCh chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewServer creates a new responder listening on addr (host:port)
+func NewServer(addr string) *Server {
+	return &Server{
+		addr:    addr,
+		rate:    defaultRate,
+		burst:   defaultBurst,
+		sources: make(map[string]*sourceState),
+		keys:    make(map[uint32][]byte),
+	}
+}
+
+// SetRateLimit changes how many requests per second are answered for each
+// source IP, with burst extra requests allowed. A rate of 0 disables limiting.
+func (s *Server) SetRateLimit(rate float64, burst int) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	if burst < 1 {
+		burst = 1
+	}
+	s.rate = rate
+	s.burst = burst
+}
+
+// SetAuthKey requires every request to carry a valid tag keyed from material,
+// and signs the responses. Unauthenticated requests, including all v1
+// requests, are dropped. A nil or empty material disables authentication.
+func (s *Server) SetAuthKey(material []byte) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	s.keys = make(map[uint32][]byte)
+	if len(material) == 0 {
+		s.authKey = nil
+		return
+	}
+	s.authKey = append([]byte(nil), material...)
+}
+
+// Start begins answering requests in the background
+func (s *Server) Start() error {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	if s.running {
+		return nil
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s: %v", s.addr, err)
+	}
+
+	s.conn, err = net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %v", s.addr, err)
+	}
+
+	s.running = true
+	s.shutdownCh = make(chan struct{})
+
+	s.wg.Add(1)
+	go s.serve(s.conn, s.shutdownCh)
+
+	logger.Info("wgtester responder listening on %s", s.conn.LocalAddr())
+	return nil
+}
+
+// Addr returns the address the server is listening on, or nil if it is not running
+func (s *Server) Addr() net.Addr {
+	s.runLock.Lock()
+	defer s.runLock.Unlock()
+
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+// Stop stops answering requests and closes the socket
+func (s *Server) Stop() {
+	s.runLock.Lock()
+	if !s.running {
+		s.runLock.Unlock()
+		return
+	}
+	s.running = false
+	close(s.shutdownCh)
+	s.conn.Close()
+	s.runLock.Unlock()
+
+	s.wg.Wait()
+}
+
+// Stats returns a copy of the counters of every tracked source IP
+func (s *Server) Stats() map[string]SourceStats {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	stats := make(map[string]SourceStats, len(s.sources))
+	for ip, state := range s.sources {
+		stats[ip] = state.stats
+	}
+	return stats
+}
+
+// serve reads requests until the socket is closed
+func (s *Server) serve(conn *net.UDPConn, shutdownCh chan struct{}) {
+	defer s.wg.Done()
+
+	buffer := make([]byte, 1500)
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-shutdownCh:
+				return
+			default:
+			}
+			logger.Error("wgtester responder read error: %v", err)
+			continue
+		}
+
+		response, ok := s.handlePacket(buffer[:n], remoteAddr)
+		if !ok {
+			continue
+		}
+
+		if _, err := conn.WriteToUDP(response, remoteAddr); err != nil {
+			logger.Debug("wgtester responder failed to answer %s: %v", remoteAddr, err)
+			continue
+		}
+
+		s.statsLock.Lock()
+		if state, exists := s.sources[remoteAddr.IP.String()]; exists {
+			state.stats.Responses++
+		}
+		s.statsLock.Unlock()
+	}
+}
+
+// handlePacket validates a request, applies the rate limit and builds the response
+func (s *Server) handlePacket(buf []byte, remoteAddr *net.UDPAddr) ([]byte, bool) {
+	now := time.Now()
+
+	s.statsLock.Lock()
+	state := s.sourceLocked(remoteAddr.IP.String(), now)
+	state.stats.LastSeen = now
+
+	req, err := parsePacket(buf)
+	if err != nil || req.typ != packetTypeRequest {
+		state.stats.Malformed++
+		s.statsLock.Unlock()
+		return nil, false
+	}
+
+	state.stats.Requests++
+
+	// Limit before any key is derived, so a flood costs no more than a parse
+	if !s.allowLocked(state, now) {
+		state.stats.Limited++
+		s.statsLock.Unlock()
+		return nil, false
+	}
+
+	authKey := s.authKey
+	sessionKey := s.keys[req.sessionID]
+	s.statsLock.Unlock()
+
+	if authKey != nil {
+		cached := sessionKey != nil
+		if !cached && req.version == ProtocolV2 {
+			sessionKey = DeriveSessionKey(authKey, req.sessionID)
+		}
+		if req.version != ProtocolV2 || !authenticated(buf, sessionKey) {
+			s.statsLock.Lock()
+			state.stats.Unauthenticated++
+			s.statsLock.Unlock()
+			return nil, false
+		}
+		if !cached {
+			s.cacheKey(authKey, req.sessionID, sessionKey)
+		}
+	}
+
+	// Echo the request back in the same version with the type changed so the
+	// client can match it and compute the RTT
+	req.typ = packetTypeResponse
+	if authKey != nil {
+		return req.marshalAuth(sessionKey), true
+	}
+	req.flags &^= flagAuthenticated
+	return req.marshal(), true
+}
+
+// cacheKey remembers the session key of a session that authenticated, unless
+// the key material changed since it was derived
+func (s *Server) cacheKey(material []byte, sessionID uint32, sessionKey []byte) {
+	s.statsLock.Lock()
+	defer s.statsLock.Unlock()
+
+	if !bytes.Equal(material, s.authKey) {
+		return
+	}
+	if len(s.keys) >= maxCachedKeys {
+		s.keys = make(map[uint32][]byte)
+	}
+	s.keys[sessionID] = sessionKey
+}
+
+// sourceLocked returns the state of a source IP, creating it if needed.
+// This function assumes statsLock is already held by the caller
+func (s *Server) sourceLocked(ip string, now time.Time) *sourceState {
+	state, exists := s.sources[ip]
+	if exists {
+		return state
+	}
+
+	if len(s.sources) >= maxTrackedSources {
+		s.evictOldestLocked()
+	}
+
+	state = &sourceState{
+		tokens:     float64(s.burst),
+		lastRefill: now,
+	}
+	s.sources[ip] = state
+	return state
+}
+
+// evictOldestLocked forgets the least recently seen source IP.
+// This function assumes statsLock is already held by the caller
+func (s *Server) evictOldestLocked() {
+	var oldestIP string
+	var oldest time.Time
+	for ip, state := range s.sources {
+		if oldestIP == "" || state.stats.LastSeen.Before(oldest) {
+			oldestIP = ip
+			oldest = state.stats.LastSeen
+		}
+	}
+	delete(s.sources, oldestIP)
+}
+
+// allowLocked applies the token bucket of a source.
+// This function assumes statsLock is already held by the caller
+func (s *Server) allowLocked(state *sourceState, now time.Time) bool {
+	if s.rate <= 0 {
+		return true
+	}
+
+	state.tokens += now.Sub(state.lastRefill).Seconds() * s.rate
+	if state.tokens > float64(s.burst) {
+		state.tokens = float64(s.burst)
+	}
+	state.lastRefill = now
+
+	if state.tokens < 1 {
+		return false
+	}
+	state.tokens--
+	return true
+}
@@ -0,0 +1,83 @@
+package wgtester
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// Summary holds statistics over a series of probes
+type Summary struct {
+	Sent     int           `json:"sent"`
+	Received int           `json:"received"`
+	Loss     float64       `json:"loss"` // Fraction of probes without a response, 0 to 1
+	Min      time.Duration `json:"min"`
+	Avg      time.Duration `json:"avg"`
+	Max      time.Duration `json:"max"`
+	Jitter   time.Duration `json:"jitter"` // Mean difference between consecutive RTTs
+	P50      time.Duration `json:"p50"`
+	P90      time.Duration `json:"p90"`
+	P95      time.Duration `json:"p95"`
+	P99      time.Duration `json:"p99"`
+}
+
+// Summarize computes a Summary for sent probes given the RTTs of the ones
+// that were answered, in the order they were received
+func Summarize(sent int, rtts []time.Duration) Summary {
+	summary := Summary{
+		Sent:     sent,
+		Received: len(rtts),
+	}
+
+	if sent > 0 {
+		summary.Loss = float64(sent-len(rtts)) / float64(sent)
+	}
+
+	if len(rtts) == 0 {
+		return summary
+	}
+
+	var total, jitter time.Duration
+	for i, rtt := range rtts {
+		total += rtt
+		if i > 0 {
+			diff := rtt - rtts[i-1]
+			if diff < 0 {
+				diff = -diff
+			}
+			jitter += diff
+		}
+	}
+	summary.Avg = total / time.Duration(len(rtts))
+	if len(rtts) > 1 {
+		summary.Jitter = jitter / time.Duration(len(rtts)-1)
+	}
+
+	sorted := make([]time.Duration, len(rtts))
+	copy(sorted, rtts)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+
+	summary.Min = sorted[0]
+	summary.Max = sorted[len(sorted)-1]
+	summary.P50 = Percentile(sorted, 50)
+	summary.P90 = Percentile(sorted, 90)
+	summary.P95 = Percentile(sorted, 95)
+	summary.P99 = Percentile(sorted, 99)
+
+	return summary
+}
+
+// Percentile returns the p-th percentile (nearest rank) of RTTs sorted in ascending order
+func Percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	if rank > len(sorted) {
+		rank = len(sorted)
+	}
+	return sorted[rank-1]
+}
@@ -2,7 +2,7 @@ package wgtester
 
 import (
 	"context"
-	"encoding/binary"
+	mrand "math/rand"
 	"net"
 	"sync"
 	"time"
@@ -17,11 +17,21 @@ const (
 	packetTypeRequest uint8 = 1
 	// Response packet type
 	packetTypeResponse uint8 = 2
-	// Packet format:
+	// v1 packet format:
 	// - 4 bytes: magic header (0xDEADBEEF)
 	// - 1 byte: packet type (1 = request, 2 = response)
 	// - 8 bytes: timestamp (for round-trip timing)
 	packetSize = 13
+	// Consecutive failed tests after which the protocol version is negotiated again
+	renegotiateAfter = 3
+
+	// Default monitor thresholds: 3 failed tests out of the last 5 mark the
+	// connection down and 5 successful tests in a row mark it up again
+	defaultFailThreshold    = 3
+	defaultFailWindow       = 5
+	defaultRecoverThreshold = 5
+	// Default minimum time the monitor stays in a state before changing it
+	defaultMinDwell = 5 * time.Second
 )
 
 // Client handles checking connectivity to a server
@@ -35,6 +45,22 @@ type Client struct {
 	packetInterval time.Duration
 	timeout        time.Duration
 	maxAttempts    int
+
+	failThreshold    int           // Failed tests within failWindow that mark the connection down
+	failWindow       int           // Number of recent tests considered for failThreshold
+	recoverThreshold int           // Consecutive successful tests that mark the connection up
+	minDwell         time.Duration // Minimum time between state changes
+	probeCallback    ProbeCallback // Called with every monitor test result
+
+	sessionID       uint32
+	seq             uint32
+	protocolVersion uint8 // Forced protocol version, 0 to negotiate
+	negotiated      uint8 // Version the responder answered, 0 if unknown
+	failures        int
+	authKey         []byte // Session key for authenticated probes, nil for none
+	unauthenticated uint64 // Responses rejected for a missing or bad tag
+	window          *window
+	windowLock      sync.Mutex // Protects the fields above
 }
 
 // ConnectionStatus represents the current connection state
@@ -46,11 +72,17 @@ type ConnectionStatus struct {
 // NewClient creates a new connection test client
 func NewClient(serverAddr string) (*Client, error) {
 	return &Client{
-		serverAddr:     serverAddr,
-		shutdownCh:     make(chan struct{}),
-		packetInterval: 2 * time.Second,
-		timeout:        500 * time.Millisecond, // Timeout for individual packets
-		maxAttempts:    3,                      // Default max attempts
+		serverAddr:       serverAddr,
+		shutdownCh:       make(chan struct{}),
+		packetInterval:   2 * time.Second,
+		timeout:          500 * time.Millisecond, // Timeout for individual packets
+		maxAttempts:      3,                      // Default max attempts
+		failThreshold:    defaultFailThreshold,
+		failWindow:       defaultFailWindow,
+		recoverThreshold: defaultRecoverThreshold,
+		minDwell:         defaultMinDwell,
+		sessionID:        mrand.Uint32(),
+		window:           newWindow(defaultWindowSize),
 	}, nil
 }
 
@@ -69,6 +101,63 @@ func (c *Client) SetMaxAttempts(attempts int) {
 	c.maxAttempts = attempts
 }
 
+// SetThresholds changes when the monitor changes state: the connection is
+// reported down once failures of the last window tests failed, and up again
+// after recoveries successful tests in a row. Takes effect on the next StartMonitor.
+func (c *Client) SetThresholds(failures, window, recoveries int) {
+	if window < 1 {
+		window = 1
+	}
+	if failures < 1 {
+		failures = 1
+	}
+	if failures > window {
+		failures = window
+	}
+	if recoveries < 1 {
+		recoveries = 1
+	}
+	c.failThreshold = failures
+	c.failWindow = window
+	c.recoverThreshold = recoveries
+}
+
+// SetMinDwell changes the minimum time the monitor stays in a state before
+// reporting a change
+func (c *Client) SetMinDwell(d time.Duration) {
+	c.minDwell = d
+}
+
+// SetProtocolVersion forces the protocol version (ProtocolV1 or ProtocolV2).
+// 0 negotiates with the responder, which is the default.
+func (c *Client) SetProtocolVersion(version uint8) {
+	c.windowLock.Lock()
+	defer c.windowLock.Unlock()
+	c.protocolVersion = version
+}
+
+// SetAuthKey enables authenticated probes with a key derived from material
+// shared with the responder. Responses without a valid tag are then rejected.
+// Authentication requires protocol v2, so v1 fallback is disabled while a key
+// is set. A nil or empty material disables authentication.
+func (c *Client) SetAuthKey(material []byte) {
+	c.windowLock.Lock()
+	defer c.windowLock.Unlock()
+
+	if len(material) == 0 {
+		c.authKey = nil
+		return
+	}
+	c.authKey = DeriveSessionKey(material, c.sessionID)
+}
+
+// SetWindowSize changes how many recent requests WindowStats covers
+func (c *Client) SetWindowSize(size int) {
+	c.windowLock.Lock()
+	defer c.windowLock.Unlock()
+	c.window = newWindow(size)
+}
+
 // Close cleans up client resources
 func (c *Client) Close() {
 	c.StopMonitor()
@@ -107,82 +196,202 @@ func (c *Client) ensureConnection() error {
 // TestConnection checks if the connection to the server is working
 // Returns true if connected, false otherwise
 func (c *Client) TestConnection(ctx context.Context) (bool, time.Duration) {
+	connected, rtt, _ := c.TestConnectionAttempts(ctx)
+	return connected, rtt
+}
+
+// TestConnectionAttempts is like TestConnection but also returns the number
+// of request packets sent before a response arrived or the test gave up
+func (c *Client) TestConnectionAttempts(ctx context.Context) (bool, time.Duration, int) {
 	if err := c.ensureConnection(); err != nil {
 		logger.Warn("Failed to ensure connection: %v", err)
-		return false, 0
+		return false, 0, 0
 	}
 
-	// Prepare packet buffer
-	packet := make([]byte, packetSize)
-	binary.BigEndian.PutUint32(packet[0:4], magicHeader)
-	packet[4] = packetTypeRequest
-
 	// Send multiple attempts as specified
+	attempts := 0
 	for attempt := 0; attempt < c.maxAttempts; attempt++ {
 		select {
 		case <-ctx.Done():
-			return false, 0
+			c.recordFailure()
+			return false, 0, attempts
 		default:
-			// Add current timestamp to packet
-			timestamp := time.Now().UnixNano()
-			binary.BigEndian.PutUint64(packet[5:13], uint64(timestamp))
+		}
 
-			// Lock the connection for the entire send/receive operation
-			c.connLock.Lock()
+		// Lock the connection for the entire send/receive operation
+		c.connLock.Lock()
 
-			// Check if connection is still valid after acquiring lock
-			if c.conn == nil {
-				c.connLock.Unlock()
-				return false, 0
-			}
+		// Check if connection is still valid after acquiring lock
+		if c.conn == nil {
+			c.connLock.Unlock()
+			return false, 0, attempts
+		}
 
-			logger.Debug("Attempting to send monitor packet to %s", c.serverAddr)
-			_, err := c.conn.Write(packet)
-			if err != nil {
-				c.connLock.Unlock()
-				logger.Info("Error sending packet: %v", err)
-				continue
-			}
-			logger.Debug("Successfully sent monitor packet")
+		attempts++
+		connected, rtt, err := c.sendAndWait()
+		c.connLock.Unlock()
 
-			// Set read deadline
-			c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+		if err != nil {
+			logger.Info("Error sending packet: %v", err)
+			continue
+		}
+		if connected {
+			c.windowLock.Lock()
+			c.failures = 0
+			c.windowLock.Unlock()
+			return true, rtt, attempts
+		}
 
-			// Wait for response
-			responseBuffer := make([]byte, packetSize)
-			n, err := c.conn.Read(responseBuffer)
-			c.connLock.Unlock()
+		// Timeout, brief pause before the next attempt
+		time.Sleep(100 * time.Millisecond)
+	}
 
-			if err != nil {
-				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-					// Timeout, try next attempt
-					time.Sleep(100 * time.Millisecond) // Brief pause between attempts
-					continue
-				}
-				logger.Error("Error reading response: %v", err)
-				continue
-			}
+	c.recordFailure()
+	return false, 0, attempts
+}
 
-			if n != packetSize {
-				continue // Malformed packet
-			}
+// sendAndWait sends one request and waits for its response until the timeout.
+// Responses to earlier requests that arrive meanwhile are recorded as late.
+// This function assumes connLock is already held by the caller
+func (c *Client) sendAndWait() (bool, time.Duration, error) {
+	c.windowLock.Lock()
+	version := c.versionLocked()
+	c.seq++
+	req := packet{
+		version:   version,
+		typ:       packetTypeRequest,
+		sessionID: c.sessionID,
+		seq:       c.seq,
+		timestamp: time.Now().UnixNano(),
+	}
+	c.window.add(req.seq, req.timestamp)
+	authKey := c.authKey
+	c.windowLock.Unlock()
+
+	logger.Debug("Attempting to send monitor packet to %s", c.serverAddr)
+	if authKey != nil {
+		if _, err := c.conn.Write(req.marshalAuth(authKey)); err != nil {
+			return false, 0, err
+		}
+	} else if version == 0 {
+		// Not negotiated yet: ask in both formats, whichever is answered wins
+		req.version = ProtocolV2
+		if _, err := c.conn.Write(req.marshal()); err != nil {
+			return false, 0, err
+		}
+		req.version = ProtocolV1
+	}
+	if authKey == nil {
+		if _, err := c.conn.Write(req.marshal()); err != nil {
+			return false, 0, err
+		}
+	}
+	logger.Debug("Successfully sent monitor packet")
 
-			// Verify response
-			magic := binary.BigEndian.Uint32(responseBuffer[0:4])
-			packetType := responseBuffer[4]
-			if magic != magicHeader || packetType != packetTypeResponse {
-				continue // Not our response
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+
+	buffer := make([]byte, 1500)
+	for {
+		n, err := c.conn.Read(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				return false, 0, nil
 			}
+			logger.Error("Error reading response: %v", err)
+			return false, 0, nil
+		}
 
-			// Extract the original timestamp and calculate RTT
-			sentTimestamp := int64(binary.BigEndian.Uint64(responseBuffer[5:13]))
-			rtt := time.Duration(time.Now().UnixNano() - sentTimestamp)
+		resp, err := parsePacket(buffer[:n])
+		if err != nil || resp.typ != packetTypeResponse {
+			continue // Not our response
+		}
+		if resp.version == ProtocolV2 && resp.sessionID != c.sessionID {
+			continue // Response to another client
+		}
+		if authKey != nil && !authenticated(buffer[:n], authKey) {
+			c.windowLock.Lock()
+			c.unauthenticated++
+			c.windowLock.Unlock()
+			logger.Debug("Rejected unauthenticated monitor response from %s", c.serverAddr)
+			continue
+		}
 
-			return true, rtt
+		rtt := time.Duration(time.Now().UnixNano() - resp.timestamp)
+		if c.handleResponse(req, resp, rtt) {
+			return true, rtt, nil
 		}
 	}
+}
+
+// handleResponse matches a response to the request it answers and returns
+// true if it answers the current request
+func (c *Client) handleResponse(req packet, resp packet, rtt time.Duration) bool {
+	c.windowLock.Lock()
+	defer c.windowLock.Unlock()
+
+	var match *sample
+	if resp.version == ProtocolV2 {
+		// Any v2 answer proves the responder speaks v2
+		if c.protocolVersion == 0 && c.negotiated != ProtocolV2 {
+			logger.Debug("Using wgtester protocol v2 with %s", c.serverAddr)
+			c.negotiated = ProtocolV2
+		}
+		match = c.window.find(func(s *sample) bool { return s.seq == resp.seq && s.timestamp == resp.timestamp })
+	} else {
+		match = c.window.find(func(s *sample) bool { return s.timestamp == resp.timestamp })
+	}
+
+	current := match != nil && match.seq == req.seq
+	if !c.window.markReceived(match, rtt, !current) || !current {
+		if match != nil && !current {
+			logger.Debug("Late response for seq %d from %s", match.seq, c.serverAddr)
+		}
+		return false
+	}
+
+	if resp.version == ProtocolV1 && c.protocolVersion == 0 && c.negotiated == 0 {
+		logger.Debug("Falling back to wgtester protocol v1 with %s", c.serverAddr)
+		c.negotiated = ProtocolV1
+	}
+	return true
+}
+
+// versionLocked returns the protocol version to send, or 0 to negotiate.
+// This function assumes windowLock is already held by the caller
+func (c *Client) versionLocked() uint8 {
+	if c.authKey != nil {
+		return ProtocolV2
+	}
+	if c.protocolVersion != 0 {
+		return c.protocolVersion
+	}
+	return c.negotiated
+}
 
-	return false, 0
+// recordFailure counts a failed test and forgets the negotiated version after
+// several in a row, in case the responder was replaced
+func (c *Client) recordFailure() {
+	c.windowLock.Lock()
+	defer c.windowLock.Unlock()
+
+	c.failures++
+	if c.failures >= renegotiateAfter && c.negotiated != 0 {
+		logger.Debug("Renegotiating wgtester protocol with %s", c.serverAddr)
+		c.negotiated = 0
+	}
+}
+
+// WindowStats returns loss, late responses and jitter over the most recent requests
+func (c *Client) WindowStats() WindowStats {
+	c.windowLock.Lock()
+	defer c.windowLock.Unlock()
+
+	stats := c.window.stats()
+	stats.Version = c.versionLocked()
+	stats.SessionID = c.sessionID
+	stats.Authenticated = c.authKey != nil
+	stats.Unauthenticated = c.unauthenticated
+	return stats
 }
 
 // TestConnectionWithTimeout tries to test connection with a timeout
@@ -196,6 +405,15 @@ func (c *Client) TestConnectionWithTimeout(timeout time.Duration) (bool, time.Du
 // MonitorCallback is the function type for connection status change callbacks
 type MonitorCallback func(status ConnectionStatus)
 
+// ProbeCallback is called with the raw result of every monitor test
+type ProbeCallback func(connected bool, rtt time.Duration)
+
+// SetProbeCallback sets the function called with every monitor test result,
+// before thresholds are applied. Takes effect on the next StartMonitor.
+func (c *Client) SetProbeCallback(callback ProbeCallback) {
+	c.probeCallback = callback
+}
+
 // StartMonitor begins monitoring the connection and calls the callback
 // when the connection status changes
 func (c *Client) StartMonitor(callback MonitorCallback) error {
@@ -214,10 +432,10 @@ func (c *Client) StartMonitor(callback MonitorCallback) error {
 	c.monitorRunning = true
 	c.shutdownCh = make(chan struct{})
 
-	go func() {
-		var lastConnected bool
-		firstRun := true
+	state := newMonitorState(c.failThreshold, c.failWindow, c.recoverThreshold, c.minDwell)
+	probeCallback := c.probeCallback
 
+	go func() {
 		ticker := time.NewTicker(c.packetInterval)
 		defer ticker.Stop()
 
@@ -230,14 +448,16 @@ func (c *Client) StartMonitor(callback MonitorCallback) error {
 				connected, rtt := c.TestConnection(ctx)
 				cancel()
 
-				// Callback if status changed or it's the first check
-				if connected != lastConnected || firstRun {
+				if probeCallback != nil {
+					probeCallback(connected, rtt)
+				}
+
+				// Callback only once the thresholds confirm a change
+				if state.update(connected, time.Now()) {
 					callback(ConnectionStatus{
-						Connected: connected,
+						Connected: state.connected,
 						RTT:       rtt,
 					})
-					lastConnected = connected
-					firstRun = false
 				}
 			}
 		}
@@ -246,6 +466,85 @@ func (c *Client) StartMonitor(callback MonitorCallback) error {
 	return nil
 }
 
+// monitorState debounces test results so a single lost probe does not flip
+// the reported connection state
+type monitorState struct {
+	failThreshold    int
+	recoverThreshold int
+	minDwell         time.Duration
+
+	results    []bool // Ring of the most recent results
+	next       int
+	count      int
+	successes  int // Consecutive successful tests
+	known      bool
+	connected  bool
+	lastChange time.Time
+}
+
+func newMonitorState(failThreshold, failWindow, recoverThreshold int, minDwell time.Duration) *monitorState {
+	return &monitorState{
+		failThreshold:    failThreshold,
+		recoverThreshold: recoverThreshold,
+		minDwell:         minDwell,
+		results:          make([]bool, failWindow),
+	}
+}
+
+// update records a test result and returns true if the reported state changed.
+// Until a state is known, the first success reports up right away while
+// down still needs the failure threshold.
+func (m *monitorState) update(connected bool, now time.Time) bool {
+	m.results[m.next] = connected
+	m.next = (m.next + 1) % len(m.results)
+	if m.count < len(m.results) {
+		m.count++
+	}
+	if connected {
+		m.successes++
+	} else {
+		m.successes = 0
+	}
+
+	failures := 0
+	for i := 0; i < m.count; i++ {
+		if !m.results[i] {
+			failures++
+		}
+	}
+
+	var next bool
+	switch {
+	case !m.known:
+		if connected {
+			next = true
+		} else if failures >= m.failThreshold {
+			next = false
+		} else {
+			return false
+		}
+	case m.connected && failures >= m.failThreshold:
+		next = false
+	case !m.connected && m.successes >= m.recoverThreshold:
+		next = true
+	default:
+		return false
+	}
+
+	if m.known && now.Sub(m.lastChange) < m.minDwell {
+		return false // Hold the current state a little longer
+	}
+
+	m.known = true
+	m.connected = next
+	m.lastChange = now
+
+	// Start counting afresh so old failures can't flip a recovered connection
+	m.count = 0
+	m.next = 0
+	return true
+}
+
 // StopMonitor stops the connection monitoring
 func (c *Client) StopMonitor() {
 	c.monitorLock.Lock()
@@ -0,0 +1,181 @@
+package wgtester
+
+import (
+	"testing"
+	"time"
+)
+
+// startServer runs a responder on a loopback port for the duration of the test
+func startServer(t *testing.T, configure func(*Server)) *Server {
+	t.Helper()
+
+	server := NewServer("127.0.0.1:0")
+	if configure != nil {
+		configure(server)
+	}
+	if err := server.Start(); err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	t.Cleanup(server.Stop)
+	return server
+}
+
+// newTestClient creates a client of server that gives up quickly
+func newTestClient(t *testing.T, server *Server) *Client {
+	t.Helper()
+
+	client, err := NewClient(server.Addr().String())
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	client.SetTimeout(200 * time.Millisecond)
+	client.SetMaxAttempts(1)
+	t.Cleanup(client.Close)
+	return client
+}
+
+// sourceStats returns the server counters of the loopback source
+func sourceStats(t *testing.T, server *Server) SourceStats {
+	t.Helper()
+
+	stats, ok := server.Stats()["127.0.0.1"]
+	if !ok {
+		t.Fatalf("server has no stats for 127.0.0.1")
+	}
+	return stats
+}
+
+func TestClientServerV1(t *testing.T) {
+	server := startServer(t, nil)
+	client := newTestClient(t, server)
+	client.SetProtocolVersion(ProtocolV1)
+
+	connected, rtt := client.TestConnectionWithTimeout(time.Second)
+	if !connected {
+		t.Fatalf("v1 test failed")
+	}
+	if rtt <= 0 {
+		t.Errorf("rtt = %v, want > 0", rtt)
+	}
+	if v := client.WindowStats().Version; v != ProtocolV1 {
+		t.Errorf("version = %d, want %d", v, ProtocolV1)
+	}
+	if stats := sourceStats(t, server); stats.Requests != 1 {
+		t.Errorf("requests = %d, want 1", stats.Requests)
+	}
+}
+
+func TestClientServerNegotiatesV2(t *testing.T) {
+	server := startServer(t, nil)
+	client := newTestClient(t, server)
+
+	if connected, _ := client.TestConnectionWithTimeout(time.Second); !connected {
+		t.Fatalf("test failed")
+	}
+	if v := client.WindowStats().Version; v != ProtocolV2 {
+		t.Errorf("version = %d, want %d", v, ProtocolV2)
+	}
+}
+
+func TestClientServerAuthenticated(t *testing.T) {
+	material := []byte("shared monitor key")
+	server := startServer(t, func(s *Server) { s.SetAuthKey(material) })
+	client := newTestClient(t, server)
+	client.SetAuthKey(material)
+
+	if connected, _ := client.TestConnectionWithTimeout(time.Second); !connected {
+		t.Fatalf("authenticated test failed")
+	}
+	stats := client.WindowStats()
+	if !stats.Authenticated || stats.Version != ProtocolV2 {
+		t.Errorf("stats = %+v, want authenticated v2", stats)
+	}
+	if stats.Unauthenticated != 0 {
+		t.Errorf("client rejected %d responses", stats.Unauthenticated)
+	}
+	if server := sourceStats(t, server); server.Unauthenticated != 0 || server.Requests != 1 {
+		t.Errorf("server stats = %+v, want 1 request and no rejections", server)
+	}
+}
+
+func TestClientServerBadTag(t *testing.T) {
+	server := startServer(t, func(s *Server) { s.SetAuthKey([]byte("server key")) })
+	client := newTestClient(t, server)
+	client.SetAuthKey([]byte("client key"))
+
+	if connected, _ := client.TestConnectionWithTimeout(time.Second); connected {
+		t.Fatalf("test with a bad tag succeeded")
+	}
+	stats := sourceStats(t, server)
+	if stats.Unauthenticated != 1 || stats.Requests != 1 {
+		t.Errorf("server stats = %+v, want 1 request, unauthenticated", stats)
+	}
+}
+
+func TestClientRejectsUnsignedResponse(t *testing.T) {
+	server := startServer(t, nil)
+	client := newTestClient(t, server)
+	client.SetAuthKey([]byte("client key"))
+
+	if connected, _ := client.TestConnectionWithTimeout(time.Second); connected {
+		t.Fatalf("unsigned response was accepted")
+	}
+	if n := client.WindowStats().Unauthenticated; n != 1 {
+		t.Errorf("client rejected %d responses, want 1", n)
+	}
+}
+
+func TestServerRateLimit(t *testing.T) {
+	server := startServer(t, func(s *Server) { s.SetRateLimit(0.1, 1) })
+	client := newTestClient(t, server)
+	client.SetProtocolVersion(ProtocolV2)
+
+	if connected, _ := client.TestConnectionWithTimeout(time.Second); !connected {
+		t.Fatalf("first test failed")
+	}
+	if connected, _ := client.TestConnectionWithTimeout(time.Second); connected {
+		t.Fatalf("second test was answered above the rate limit")
+	}
+	stats := sourceStats(t, server)
+	if stats.Limited != 1 || stats.Requests != 2 {
+		t.Errorf("server stats = %+v, want 2 requests with 1 limited", stats)
+	}
+}
+
+func TestServerRateLimitsBeforeAuthentication(t *testing.T) {
+	server := startServer(t, func(s *Server) {
+		s.SetAuthKey([]byte("server key"))
+		s.SetRateLimit(0.1, 1)
+	})
+	client := newTestClient(t, server)
+	client.SetAuthKey([]byte("client key"))
+
+	for i := 0; i < 2; i++ {
+		if connected, _ := client.TestConnectionWithTimeout(time.Second); connected {
+			t.Fatalf("test with a bad tag succeeded")
+		}
+	}
+	stats := sourceStats(t, server)
+	if stats.Limited != 1 || stats.Unauthenticated != 1 {
+		t.Errorf("server stats = %+v, want 1 limited and 1 unauthenticated", stats)
+	}
+}
+
+func TestServerCachesSessionKeys(t *testing.T) {
+	material := []byte("shared monitor key")
+	server := startServer(t, func(s *Server) { s.SetAuthKey(material) })
+	client := newTestClient(t, server)
+	client.SetAuthKey(material)
+
+	for i := 0; i < 2; i++ {
+		if connected, _ := client.TestConnectionWithTimeout(time.Second); !connected {
+			t.Fatalf("authenticated test %d failed", i)
+		}
+	}
+
+	server.statsLock.Lock()
+	defer server.statsLock.Unlock()
+	if len(server.keys) != 1 || server.keys[client.sessionID] == nil {
+		t.Errorf("cached keys = %d, want the key of session %d", len(server.keys), client.sessionID)
+	}
+}
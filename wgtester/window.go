@@ -0,0 +1,106 @@
+package wgtester
+
+import "time"
+
+// Default number of recent requests used for loss, reordering and jitter
+const defaultWindowSize = 100
+
+// WindowStats describes the most recent requests sent by a client
+type WindowStats struct {
+	Sent      int           `json:"sent"`
+	Received  int           `json:"received"`
+	Late      int           `json:"late"` // Responses that arrived after their request timed out
+	Loss      float64       `json:"loss"` // Fraction of requests never answered, 0 to 1
+	Jitter    time.Duration `json:"jitter"`
+	Version   uint8         `json:"version"` // Negotiated protocol version, 0 if not yet known
+	SessionID uint32        `json:"sessionId"`
+
+	Authenticated   bool   `json:"authenticated"`   // Whether probes carry an HMAC tag
+	Unauthenticated uint64 `json:"unauthenticated"` // Responses rejected for a missing or bad tag, since the client was created
+}
+
+// sample is one request tracked in the window
+type sample struct {
+	seq       uint32
+	timestamp int64
+	received  bool
+	late      bool
+}
+
+// window is a ring buffer of the most recent requests
+type window struct {
+	samples []sample
+	next    int
+	count   int
+	jitter  float64 // RFC 3550 interarrival jitter estimate in nanoseconds
+	lastRTT time.Duration
+	haveRTT bool
+}
+
+func newWindow(size int) *window {
+	if size < 1 {
+		size = 1
+	}
+	return &window{samples: make([]sample, size)}
+}
+
+// add records a newly sent request, evicting the oldest once the window is full
+func (w *window) add(seq uint32, timestamp int64) {
+	w.samples[w.next] = sample{seq: seq, timestamp: timestamp}
+	w.next = (w.next + 1) % len(w.samples)
+	if w.count < len(w.samples) {
+		w.count++
+	}
+}
+
+// find returns the tracked request matching the predicate, or nil
+func (w *window) find(match func(s *sample) bool) *sample {
+	for i := 0; i < w.count; i++ {
+		s := &w.samples[i]
+		if match(s) {
+			return s
+		}
+	}
+	return nil
+}
+
+// markReceived records a response. late is set when the request had already
+// been given up on. It returns false for duplicates and unknown requests.
+func (w *window) markReceived(s *sample, rtt time.Duration, late bool) bool {
+	if s == nil || s.received {
+		return false
+	}
+	s.received = true
+	s.late = late
+
+	if w.haveRTT {
+		d := float64(rtt - w.lastRTT)
+		if d < 0 {
+			d = -d
+		}
+		w.jitter += (d - w.jitter) / 16
+	}
+	w.lastRTT = rtt
+	w.haveRTT = true
+	return true
+}
+
+// stats summarizes the window
+func (w *window) stats() WindowStats {
+	stats := WindowStats{
+		Sent:   w.count,
+		Jitter: time.Duration(w.jitter),
+	}
+	for i := 0; i < w.count; i++ {
+		if w.samples[i].received {
+			stats.Received++
+		}
+		if w.samples[i].late {
+			stats.Late++
+		}
+	}
+	if stats.Sent > 0 {
+		stats.Loss = float64(stats.Sent-stats.Received) / float64(stats.Sent)
+	}
+	return stats
+}
@@ -6,7 +6,9 @@ import (
 	"errors"
 	"net"
 	"os"
+	"path/filepath"
 
+	"golang.org/x/sys/windows"
 	"golang.zx2c4.com/wireguard/ipc"
 	"golang.zx2c4.com/wireguard/tun"
 )
@@ -23,3 +25,20 @@ func uapiListen(interfaceName string, fileUAPI *os.File) (net.Listener, error) {
 	// On Windows, UAPIListen only takes one parameter
 	return ipc.UAPIListen(interfaceName)
 }
+
+// defaultControlSocket returns the default path of the control socket
+func defaultControlSocket() string {
+	return filepath.Join(os.Getenv("PROGRAMDATA"), "olm", "olm.sock")
+}
+
+// defaultStateDir returns the default directory of the state and lock files
+func defaultStateDir() string {
+	return filepath.Join(os.Getenv("PROGRAMDATA"), "olm")
+}
+
+// lockFile takes an exclusive lock on f without waiting. The lock is released
+// when f is closed or the process exits.
+func lockFile(f *os.File) error {
+	var overlapped windows.Overlapped
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, &overlapped)
+}